@@ -2,11 +2,16 @@ package config
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/typeeng/pg_track_events/agent/internal/env"
+	"github.com/typeeng/pg_track_events/agent/internal/logger"
 )
 
 const (
@@ -30,10 +35,89 @@ const (
 	eventLogTableNameEnvKey  = "EVENT_LOG_TABLE_NAME"
 	defaultEventLogTableName = "event_log"
 
+	deadLetterTableNameEnvKey  = "DEAD_LETTER_TABLE_NAME"
+	defaultDeadLetterTableName = "dead_letter"
+
+	// 0 disables dead-lettering and retries events forever, even those that failed permanently
+	maxRetriesEnvKey  = "MAX_RETRIES"
+	defaultMaxRetries = 0
+
+	// Number of batches processed concurrently
+	workersEnvKey  = "WORKERS"
+	defaultWorkers = 1
+
+	// Each destination's SendBatch is cancelled after this long, 0 disables the timeout
+	destinationTimeoutEnvKey  = "DESTINATION_TIMEOUT"
+	defaultDestinationTimeout = 30 * time.Second
+
+	// Number of destinations sent to at once, 0 sends to every destination at once
+	destinationConcurrencyEnvKey  = "DESTINATION_CONCURRENCY"
+	defaultDestinationConcurrency = 0
+
+	// Address for the /healthz, /readyz and /status endpoints, empty disables the HTTP server
+	httpAddrEnvKey = "HTTP_ADDR"
+
+	// Spans are exported over OTLP when either endpoint is set, the exporter reads the
+	// rest of its configuration from the standard OTEL_* variables
+	otlpEndpointEnvKey       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otlpTracesEndpointEnvKey = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+
+	// How often the database schema is re-read to pick up migrations, 0 disables the check
+	schemaCheckIntervalEnvKey  = "SCHEMA_CHECK_INTERVAL"
+	defaultSchemaCheckInterval = time.Minute
+
+	// How often the events config file is checked for changes to reload, 0 disables the check.
+	// The config is also reloaded on SIGHUP.
+	configWatchIntervalEnvKey  = "CONFIG_WATCH_INTERVAL"
+	defaultConfigWatchInterval = 10 * time.Second
+
+	// Time given to in-flight batches and destination flushes when the agent is stopped
+	shutdownTimeoutEnvKey  = "SHUTDOWN_TIMEOUT"
+	defaultShutdownTimeout = 30 * time.Second
+
+	// entity holds back events for a row while an earlier event for it is pending
+	orderingEnvKey  = "ORDERING"
+	defaultOrdering = OrderingNone
+
+	// lock holds the row locks while calling destinations, lease claims events and commits right away
+	claimModeEnvKey  = "CLAIM_MODE"
+	defaultClaimMode = ClaimModeLock
+
+	leaseTimeoutEnvKey  = "LEASE_TIMEOUT"
+	defaultLeaseTimeout = 5 * time.Minute
+
+	// Transactions with more changes are batched like any other events and are not seen by
+	// transaction rules, so one bulk update can't make a batch unbounded
+	maxTransactionSizeEnvKey  = "MAX_TRANSACTION_SIZE"
+	defaultMaxTransactionSize = 10000
+
+	// Identifies the agent's claims in lease mode, defaults to hostname-pid
+	agentIDEnvKey = "AGENT_ID"
+
 	analyticsConfigPathEnvKey       = "EVENTS_CONFIG_PATH"
 	defaultEventStreamingConfigPath = "pg_track_events.config.yaml"
 )
 
+// ClaimMode is how the agent takes events from the event log
+type ClaimMode string
+
+const (
+	// ClaimModeLock keeps the events locked in a transaction until they are delivered
+	ClaimModeLock ClaimMode = "lock"
+	// ClaimModeLease claims the events for LEASE_TIMEOUT and delivers them outside a transaction
+	ClaimModeLease ClaimMode = "lease"
+)
+
+// Ordering is the delivery order the agent guarantees for events
+type Ordering string
+
+const (
+	// OrderingNone delivers events as soon as they are due, a retried event can arrive after later events for the same row
+	OrderingNone Ordering = "none"
+	// OrderingEntity only delivers an event once every earlier event for the same row has left the event log
+	OrderingEntity Ordering = "entity"
+)
+
 type AgentConfig struct {
 	DatabaseURL             string
 	BatchSize               int
@@ -41,34 +125,121 @@ type AgentConfig struct {
 	DefaultSchemaName       string
 	InternalSchemaName      string
 	EventLogTableName       string
+	DeadLetterTableName     string
+	MaxRetries              int
+	Workers                 int
+	DestinationTimeout      time.Duration
+	DestinationConcurrency  int
+	ShutdownTimeout         time.Duration
+	SchemaCheckInterval     time.Duration
+	ConfigWatchInterval     time.Duration
+	HTTPAddr                string
+	TracingEnabled          bool
+	Ordering                Ordering
+	ClaimMode               ClaimMode
+	LeaseTimeout            time.Duration
+	MaxTransactionSize      int
+	AgentID                 string
 	PgxPreferSimpleProtocol bool
-	EventStreamingConfig    *EventStreamingConfig
+	// EventStreamingConfigPath is the file EventStreamingConfig was parsed from, empty if it wasn't read from a file
+	EventStreamingConfigPath string
+	EventStreamingConfig     *EventStreamingConfig
 }
 
-var config *AgentConfig
-
 // contextKey is used as a key for storing configuration in context
 type contextKey struct{}
 
 var configKey = contextKey{}
 
+// ErrNoConfig is returned when a context has no configuration attached
+var ErrNoConfig = errors.New("no agent config in context, attach one with config.WithConfig")
+
 // WithConfig returns a new context with the given configuration
 func WithConfig(ctx context.Context, cfg *AgentConfig) context.Context {
 	return context.WithValue(ctx, configKey, cfg)
 }
 
-// ConfigFromContext returns the configuration from the context if it exists,
-// otherwise returns the global configuration
-func ConfigFromContext(ctx context.Context) *AgentConfig {
-	if cfg, ok := ctx.Value(configKey).(*AgentConfig); ok {
-		return cfg
+// ConfigFromContext returns the configuration attached to the context with WithConfig,
+// or ErrNoConfig if there is none
+func ConfigFromContext(ctx context.Context) (*AgentConfig, error) {
+	cfg, ok := ctx.Value(configKey).(*AgentConfig)
+	if !ok || cfg == nil {
+		return nil, ErrNoConfig
+	}
+	return cfg, nil
+}
+
+// LoadOption changes where LoadAgentConfig reads the configuration from
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	databaseURL string
+	// Only one of the events config sources is used, the last one set
+	eventStreamingConfigPath string
+	eventStreamingConfigData []byte
+	eventStreamingConfig     *EventStreamingConfig
+	// err is returned by LoadAgentConfig, for options that fail before it runs
+	err error
+}
+
+// WithDatabaseURL sets the database URL instead of reading DATABASE_URL
+func WithDatabaseURL(databaseURL string) LoadOption {
+	return func(o *loadOptions) {
+		o.databaseURL = databaseURL
+	}
+}
+
+// WithEventStreamingConfigPath reads the events config from the file instead of EVENTS_CONFIG_PATH.
+// The file is watched for changes, see CONFIG_WATCH_INTERVAL.
+func WithEventStreamingConfigPath(path string) LoadOption {
+	return func(o *loadOptions) {
+		o.eventStreamingConfigPath = path
+		o.eventStreamingConfigData = nil
+		o.eventStreamingConfig = nil
+	}
+}
+
+// WithEventStreamingConfigBytes parses the events config from the YAML
+func WithEventStreamingConfigBytes(data []byte) LoadOption {
+	return func(o *loadOptions) {
+		o.eventStreamingConfigPath = ""
+		o.eventStreamingConfigData = data
+		o.eventStreamingConfig = nil
 	}
-	return getDefaultConfig()
 }
 
-func getDefaultConfig() *AgentConfig {
-	if config != nil {
-		return config
+// WithEventStreamingConfigReader parses the events config from the YAML read from r. The
+// reader is consumed right away, a read error is returned by LoadAgentConfig.
+func WithEventStreamingConfigReader(r io.Reader) LoadOption {
+	data, err := io.ReadAll(r)
+	return func(o *loadOptions) {
+		o.eventStreamingConfigPath = ""
+		o.eventStreamingConfigData = data
+		o.eventStreamingConfig = nil
+		if err != nil {
+			o.err = fmt.Errorf("failed to read events config: %w", err)
+		}
+	}
+}
+
+// WithEventStreamingConfig uses the events config as is, it is validated by LoadAgentConfig
+func WithEventStreamingConfig(esc *EventStreamingConfig) LoadOption {
+	return func(o *loadOptions) {
+		o.eventStreamingConfigPath = ""
+		o.eventStreamingConfigData = nil
+		o.eventStreamingConfig = esc
+	}
+}
+
+// LoadAgentConfig reads the agent configuration from the environment and the events config
+// from the file at EVENTS_CONFIG_PATH, unless options provide them
+func LoadAgentConfig(opts ...LoadOption) (*AgentConfig, error) {
+	var options loadOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.err != nil {
+		return nil, options.err
 	}
 
 	var err error
@@ -79,13 +250,28 @@ func getDefaultConfig() *AgentConfig {
 		DefaultSchemaName:       defaultSchemaName,
 		InternalSchemaName:      defaultInternalSchemaName,
 		EventLogTableName:       defaultEventLogTableName,
+		DeadLetterTableName:     defaultDeadLetterTableName,
+		MaxRetries:              defaultMaxRetries,
+		Workers:                 defaultWorkers,
+		DestinationTimeout:      defaultDestinationTimeout,
+		DestinationConcurrency:  defaultDestinationConcurrency,
+		ShutdownTimeout:         defaultShutdownTimeout,
+		SchemaCheckInterval:     defaultSchemaCheckInterval,
+		ConfigWatchInterval:     defaultConfigWatchInterval,
+		Ordering:                defaultOrdering,
+		ClaimMode:               defaultClaimMode,
+		LeaseTimeout:            defaultLeaseTimeout,
+		MaxTransactionSize:      defaultMaxTransactionSize,
 		PgxPreferSimpleProtocol: defaultPgxPreferSimpleProtocol,
 		EventStreamingConfig:    &EventStreamingConfig{},
 	}
 
-	cfg.DatabaseURL = env.FirstOrDefault(cfg.DatabaseURL, databaseURLEnvKey)
+	cfg.DatabaseURL = options.databaseURL
+	if cfg.DatabaseURL == "" {
+		cfg.DatabaseURL = env.First(databaseURLEnvKey)
+	}
 	if cfg.DatabaseURL == "" {
-		panic("DATABASE_URL is not set")
+		return nil, fmt.Errorf("DATABASE_URL is not set")
 	}
 
 	cfg.PgxPreferSimpleProtocol = strings.TrimSpace(env.FirstOrDefault(strconv.FormatBool(cfg.PgxPreferSimpleProtocol), pgxPreferSimpleProtocolEnvKey)) == "true"
@@ -104,16 +290,124 @@ func getDefaultConfig() *AgentConfig {
 		}
 	}
 
+	// Parse MaxRetries from environment
+	if maxRetriesStr := env.First(maxRetriesEnvKey); maxRetriesStr != "" {
+		if maxRetries, err := strconv.Atoi(maxRetriesStr); err == nil && maxRetries >= 0 {
+			cfg.MaxRetries = maxRetries
+		}
+	}
+
+	// Parse Workers from environment
+	if workersStr := env.First(workersEnvKey); workersStr != "" {
+		if workers, err := strconv.Atoi(workersStr); err == nil && workers > 0 {
+			cfg.Workers = workers
+		}
+	}
+
+	// Parse DestinationTimeout from environment
+	if timeoutStr := env.First(destinationTimeoutEnvKey); timeoutStr != "" {
+		if timeout, err := time.ParseDuration(timeoutStr); err == nil && timeout >= 0 {
+			cfg.DestinationTimeout = timeout
+		}
+	}
+
+	// Parse DestinationConcurrency from environment
+	if concurrencyStr := env.First(destinationConcurrencyEnvKey); concurrencyStr != "" {
+		if concurrency, err := strconv.Atoi(concurrencyStr); err == nil && concurrency >= 0 {
+			cfg.DestinationConcurrency = concurrency
+		}
+	}
+
+	// Parse ShutdownTimeout from environment
+	if timeoutStr := env.First(shutdownTimeoutEnvKey); timeoutStr != "" {
+		if timeout, err := time.ParseDuration(timeoutStr); err == nil && timeout > 0 {
+			cfg.ShutdownTimeout = timeout
+		}
+	}
+
+	// Parse SchemaCheckInterval from environment
+	if intervalStr := env.First(schemaCheckIntervalEnvKey); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil && interval >= 0 {
+			cfg.SchemaCheckInterval = interval
+		}
+	}
+
+	// Parse ConfigWatchInterval from environment
+	if intervalStr := env.First(configWatchIntervalEnvKey); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil && interval >= 0 {
+			cfg.ConfigWatchInterval = interval
+		}
+	}
+
+	switch ordering := Ordering(strings.TrimSpace(env.First(orderingEnvKey))); ordering {
+	case "":
+	case OrderingNone, OrderingEntity:
+		cfg.Ordering = ordering
+	default:
+		return nil, fmt.Errorf("ORDERING must be %q or %q, got %q", OrderingNone, OrderingEntity, ordering)
+	}
+
+	switch claimMode := ClaimMode(strings.TrimSpace(env.First(claimModeEnvKey))); claimMode {
+	case "":
+	case ClaimModeLock, ClaimModeLease:
+		cfg.ClaimMode = claimMode
+	default:
+		return nil, fmt.Errorf("CLAIM_MODE must be %q or %q, got %q", ClaimModeLock, ClaimModeLease, claimMode)
+	}
+
+	if err := logger.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Parse LeaseTimeout from environment
+	if leaseTimeoutStr := env.First(leaseTimeoutEnvKey); leaseTimeoutStr != "" {
+		if leaseTimeout, err := time.ParseDuration(leaseTimeoutStr); err == nil && leaseTimeout > 0 {
+			cfg.LeaseTimeout = leaseTimeout
+		}
+	}
+
+	// Parse MaxTransactionSize from environment
+	if sizeStr := env.First(maxTransactionSizeEnvKey); sizeStr != "" {
+		if size, err := strconv.Atoi(sizeStr); err == nil && size > 0 {
+			cfg.MaxTransactionSize = size
+		}
+	}
+
+	cfg.AgentID = env.FirstOrDefault(defaultAgentID(), agentIDEnvKey)
+	cfg.HTTPAddr = env.First(httpAddrEnvKey)
+	cfg.TracingEnabled = env.First(otlpTracesEndpointEnvKey, otlpEndpointEnvKey) != ""
+
 	cfg.DefaultSchemaName = env.FirstOrDefault(cfg.DefaultSchemaName, defaultSchemaNameEnvKey)
 	cfg.InternalSchemaName = env.FirstOrDefault(cfg.InternalSchemaName, internalSchemaNameEnvKey)
 	cfg.EventLogTableName = env.FirstOrDefault(cfg.EventLogTableName, eventLogTableNameEnvKey)
+	cfg.DeadLetterTableName = env.FirstOrDefault(cfg.DeadLetterTableName, deadLetterTableNameEnvKey)
 
-	cfg.EventStreamingConfig, err = ParseEventStreamingConfig(env.FirstOrDefault(defaultEventStreamingConfigPath, analyticsConfigPathEnvKey))
+	switch {
+	case options.eventStreamingConfig != nil:
+		if err := options.eventStreamingConfig.Validate(nil, nil); err != nil {
+			return nil, fmt.Errorf("validation failed: %w", err)
+		}
+		cfg.EventStreamingConfig = options.eventStreamingConfig
+	case options.eventStreamingConfigData != nil:
+		cfg.EventStreamingConfig, err = ParseEventStreamingConfigBytes(options.eventStreamingConfigData)
+	default:
+		cfg.EventStreamingConfigPath = options.eventStreamingConfigPath
+		if cfg.EventStreamingConfigPath == "" {
+			cfg.EventStreamingConfigPath = env.FirstOrDefault(defaultEventStreamingConfigPath, analyticsConfigPathEnvKey)
+		}
+		cfg.EventStreamingConfig, err = ParseEventStreamingConfig(cfg.EventStreamingConfigPath)
+	}
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to load events config: %w", err)
 	}
 
-	config = cfg
+	return cfg, nil
+}
 
-	return cfg
+func defaultAgentID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "agent"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
 }
@@ -3,10 +3,13 @@ package config
 import (
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/google/cel-go/cel"
 	"github.com/typeeng/pg_track_events/agent/internal/env"
@@ -21,13 +24,21 @@ import (
 type SimpleEvent struct {
 	Event      string            `yaml:"event"`
 	Properties map[string]string `yaml:"properties,omitempty"`
+	// Cond is an optional CEL expression returning whether the event is emitted
+	Cond string `yaml:"cond,omitempty"`
+	// WhenChanged limits an update rule to updates that changed one of these columns
+	WhenChanged []string `yaml:"when_changed,omitempty"`
 	// Compiled CEL expressions for properties
 	CompiledProperties map[string]cel.Program
+	// Compiled CEL expression for the condition, nil when the event is always emitted
+	CompiledCond cel.Program
 }
 
 // ConditionalEvent represents an event with conditions
 type ConditionalEvent struct {
 	Cond string `yaml:"cond"`
+	// WhenChanged limits an update rule to updates that changed one of these columns
+	WhenChanged []string `yaml:"when_changed,omitempty"`
 	// Compiled CEL expression for the condition
 	CompiledCond   cel.Program
 	CondEventsPbFd protoreflect.FileDescriptor
@@ -76,11 +87,73 @@ func (ec *EventConfigUnmarshaler) UnmarshalYAML(value *yaml.Node) error {
 	return fmt.Errorf("invalid event config format")
 }
 
+// WhenChangedColumns returns the columns of the rule's when_changed, nil when it has none
+func (ec EventConfigUnmarshaler) WhenChangedColumns() []string {
+	switch c := ec.EventConfig.(type) {
+	case *SimpleEvent:
+		return c.WhenChanged
+	case *ConditionalEvent:
+		return c.WhenChanged
+	}
+	return nil
+}
+
+// EventNames returns the names of the events the rule can emit
+func (ec EventConfigUnmarshaler) EventNames() []string {
+	switch c := ec.EventConfig.(type) {
+	case *SimpleEvent:
+		return []string{c.Event}
+	case *ConditionalEvent:
+		return c.GetEventNames()
+	}
+	return nil
+}
+
+// MatchesChanges reports whether an update that changed the columns is evaluated by the
+// rule, which is always the case for rules without when_changed
+func (ec EventConfigUnmarshaler) MatchesChanges(changedColumns []string) bool {
+	whenChanged := ec.WhenChangedColumns()
+	if len(whenChanged) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(whenChanged, func(column string) bool {
+		return slices.Contains(changedColumns, column)
+	})
+}
+
+// EventRules are the rules of a table operation, each evaluated and emitted independently.
+// The config can give a single rule or a list.
+type EventRules []EventConfigUnmarshaler
+
+func (er *EventRules) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		var rule EventConfigUnmarshaler
+		if err := value.Decode(&rule); err != nil {
+			return err
+		}
+		*er = EventRules{rule}
+		return nil
+	}
+
+	var rules []EventConfigUnmarshaler
+	if err := value.Decode(&rules); err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("at least one event rule is required")
+	}
+	*er = rules
+	return nil
+}
+
 // TrackingConfig maps table operations to event configurations
-type TrackingConfig map[string]EventConfigUnmarshaler
+type TrackingConfig map[string]EventRules
 
 // DestinationConfig represents the configuration for a single analytics destination
 type DestinationConfig struct {
+	// Type is the destination kind (posthog, s3, ...). It defaults to the destination's key,
+	// set it to configure several instances of the same kind under different keys.
+	Type string `yaml:"type,omitempty"`
 	// All destinations will be filtered by this pattern
 	Filter string `yaml:"filter,omitempty"`
 	// API Key (generic)
@@ -104,21 +177,42 @@ type DestinationConfig struct {
 	SecretKey string `yaml:"secretKey,omitempty"`
 }
 
+// Destination names are prefixed with the config section they were declared in, so
+// the same kind can be configured for both processed and raw DB events.
+const (
+	processedEventDestinationPrefix = "destinations."
+	rawDBEventDestinationPrefix     = "raw_db_event_destinations."
+)
+
 type InitializedProcessedEventDestination struct {
+	// Name uniquely identifies the destination and is recorded in event_log.delivered_to
+	Name        string
 	Kind        string
 	Filter      string
 	Destination destinations.ProcessedEventDestination
 }
 
 type InitializedDBEventDestination struct {
+	// Name uniquely identifies the destination and is recorded in event_log.delivered_to
+	Name        string
 	Kind        string
 	Filter      string
 	Destination destinations.DBEventDestination
 }
 
+// KindFor returns the kind of the destination declared under destKey
+func (dc *DestinationConfig) KindFor(destKey string) string {
+	if dc.Type != "" {
+		return dc.Type
+	}
+	return destKey
+}
+
 // Validate checks if the APIKey is in the correct format
 func (dc *DestinationConfig) Validate(destKey string) error {
 	var err error
+	dc.Type = strings.TrimSpace(dc.Type)
+	destKey = dc.KindFor(destKey)
 	if dc.Filter == "" {
 		dc.Filter = "*"
 	}
@@ -251,12 +345,111 @@ type EventStreamingConfig struct {
 	Destinations           map[string]DestinationConfig `yaml:"destinations,omitempty"`
 	RawDBEventDestinations map[string]DestinationConfig `yaml:"raw_db_event_destinations,omitempty"`
 	Ignore                 IgnoreConfig                 `yaml:"ignore,omitempty"`
+	// NotifyChannel is the channel the triggers pg_notify on, the agent LISTENs on it when set
+	NotifyChannel string `yaml:"notify_channel,omitempty"`
+	// Replication reads changes for some tables from a logical replication slot instead of triggers
+	Replication *ReplicationConfig `yaml:"replication,omitempty"`
+	// Monitoring periodically checks the event log and alerts when it backs up
+	Monitoring *MonitoringConfig `yaml:"monitoring,omitempty"`
+	// TxContext makes the triggers record the transaction of each change, see TxContextConfig
+	TxContext *TxContextConfig `yaml:"tx_context,omitempty"`
 
 	// For testing
 	E2eProcessedEventChan chan<- *eventmodels.ProcessedEvent
 	E2eDBEventChan        chan<- *eventmodels.DBEvent
 }
 
+// identifierPattern matches the channel, slot and publication names we accept
+var identifierPattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+const (
+	defaultReplicationSlot        = "pg_track_events"
+	defaultReplicationPublication = "pg_track_events"
+)
+
+// ReplicationConfig configures the logical replication source. The listed tables are
+// published instead of having triggers, and their changes are read from the slot.
+type ReplicationConfig struct {
+	// Slot is the pgoutput logical replication slot, created by the agent if it doesn't exist
+	Slot string `yaml:"slot,omitempty"`
+	// Publication is managed by the CLI and publishes the listed tables
+	Publication string   `yaml:"publication,omitempty"`
+	Tables      []string `yaml:"tables"`
+}
+
+// TxContextConfig is applied by the CLI to the triggers, which record the txid and the
+// connection of each change. Changes read from the replication slot only have the txid.
+type TxContextConfig struct {
+	// Settings are the custom settings recorded with each change, e.g. app.user_id
+	Settings []string `yaml:"settings,omitempty"`
+}
+
+// Validate applies defaults and checks the slot and publication names
+func (rc *ReplicationConfig) Validate() error {
+	if rc.Slot == "" {
+		rc.Slot = defaultReplicationSlot
+	}
+	if rc.Publication == "" {
+		rc.Publication = defaultReplicationPublication
+	}
+	if !identifierPattern.MatchString(rc.Slot) {
+		return fmt.Errorf("invalid slot %q: must only contain letters, numbers and underscores", rc.Slot)
+	}
+	if !identifierPattern.MatchString(rc.Publication) {
+		return fmt.Errorf("invalid publication %q: must only contain letters, numbers and underscores", rc.Publication)
+	}
+	if len(rc.Tables) == 0 {
+		return fmt.Errorf("at least one table is required")
+	}
+	return nil
+}
+
+// HasTable reports whether changes to the table are read from the replication slot
+func (rc *ReplicationConfig) HasTable(tableName string) bool {
+	return slices.Contains(rc.Tables, tableName)
+}
+
+const defaultMonitoringInterval = time.Minute
+
+// MonitoringConfig configures the queue monitor. A threshold left at zero is not checked.
+type MonitoringConfig struct {
+	// Interval is how often the event log is checked
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// MaxPending is the number of events in the event log above which the queue is backing up
+	MaxPending int64 `yaml:"max_pending,omitempty"`
+	// MaxRetrying is the number of events that have failed at least once above which deliveries are failing
+	MaxRetrying int64 `yaml:"max_retrying,omitempty"`
+	// MaxOldestAge is how long the oldest event can wait in the event log
+	MaxOldestAge time.Duration `yaml:"max_oldest_age,omitempty"`
+	// WebhookURL is posted to when a threshold is exceeded and when the queue recovers.
+	// It can reference an environment variable.
+	WebhookURL string `yaml:"webhook_url,omitempty"`
+}
+
+// Validate applies defaults, checks the thresholds and resolves the webhook URL
+func (mc *MonitoringConfig) Validate() error {
+	if mc.Interval == 0 {
+		mc.Interval = defaultMonitoringInterval
+	}
+	if mc.Interval < 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if mc.MaxPending < 0 || mc.MaxRetrying < 0 || mc.MaxOldestAge < 0 {
+		return fmt.Errorf("thresholds must not be negative")
+	}
+	if mc.WebhookURL != "" {
+		var err error
+		if mc.WebhookURL, err = env.ValueOrRequiredEnvVar(mc.WebhookURL); err != nil {
+			return fmt.Errorf("webhook_url: %w", err)
+		}
+		u, err := url.Parse(mc.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook_url must be an http or https URL")
+		}
+	}
+	return nil
+}
+
 // compileProperties compiles CEL expressions for a map of properties
 func compileProperties(env *cel.Env, properties map[string]string) (map[string]cel.Program, error) {
 	compiled := make(map[string]cel.Program)
@@ -270,71 +463,185 @@ func compileProperties(env *cel.Env, properties map[string]string) (map[string]c
 	return compiled, nil
 }
 
-// Validate performs validation on the entire configuration
-func (esc *EventStreamingConfig) Validate(pbPkgName *string, pbFd protoreflect.FileDescriptor) error {
-	// Validate tracking configuration
-	tablePattern := regexp.MustCompile(`^([a-zA-Z0-9_]+)\.(insert|update|delete)$`)
-	for key, eventConfig := range esc.Track {
+var (
+	tablePattern           = regexp.MustCompile(`^([a-zA-Z0-9_]+)\.(insert|update|delete)$`)
+	transactionRulePattern = regexp.MustCompile(`^(` + celutils.TransactionRuleTable + `)\.([a-zA-Z0-9_]+)$`)
+)
+
+// Compile checks the table operation and transaction rule keys and compiles the CEL
+// expressions of every event against the schema descriptor, which is nil when the schema isn't known
+func (tc TrackingConfig) Compile(pbPkgName *string, pbFd protoreflect.FileDescriptor) error {
+	for key, rules := range tc {
 		matches := tablePattern.FindStringSubmatch(key)
+		if matches == nil {
+			matches = transactionRulePattern.FindStringSubmatch(key)
+		}
 		if matches == nil {
 			return fmt.Errorf("invalid table operation format: %s", key)
 		}
 		tableName := matches[1]
 		eventType := matches[2]
+		if !celutils.IsTransactionRule(tableName, eventType) && celutils.IsReservedTableName(tableName) {
+			return fmt.Errorf("table %s can't be tracked, its name is reserved for the %s variable: %s", tableName, tableName, key)
+		}
+
+		// Deliveries of a list's events are tracked by event name, see eventmodels.ProcessedEvent
+		emittedBy := make(map[string]int)
+		for i, rule := range rules {
+			for _, name := range rule.EventNames() {
+				if first, ok := emittedBy[name]; ok {
+					return fmt.Errorf("%s[%d]: event %s is also emitted by %s[%d], the rules of a list must emit different events", key, i, name, key, first)
+				}
+				emittedBy[name] = i
+			}
+		}
 
 		// Create CEL environment for this table and event type
 		baseEnvOpts := celutils.GenerateBaseCELEnvOptions(pbPkgName, pbFd, tableName, eventType)
 
-		// Compile CEL expressions based on event type
-		switch ec := eventConfig.EventConfig.(type) {
-		case *SimpleEvent:
-			env, err := celutils.CreateCELEnv(baseEnvOpts...)
-			if err != nil {
-				return fmt.Errorf("failed to create CEL environment for %s: %w", key, err)
+		for i, rule := range rules {
+			ref := key
+			if len(rules) > 1 {
+				ref = fmt.Sprintf("%s[%d]", key, i)
 			}
-			// Compile properties for SimpleEvent
-			ec.CompiledProperties, err = compileProperties(env, ec.Properties)
-			if err != nil {
-				return fmt.Errorf("failed to compile properties for %s: %w", key, err)
+			if err := checkWhenChanged(ref, tableName, eventType, rule.WhenChangedColumns(), pbFd); err != nil {
+				return err
 			}
-
-		case *ConditionalEvent:
-			var err error
-			ec.CondEventsPbFd, err = celutils.GenerateEventRefPb(ec.GetEventNames())
-			if err != nil {
-				return fmt.Errorf("failed to create CEL environment for %s: %w", key, err)
+			if err := compileEventConfig(ref, rule.EventConfig, baseEnvOpts); err != nil {
+				return err
 			}
-			eventsEnvOpts, err := celutils.GenerateCELEventsOptionsFromPbFd(ec.CondEventsPbFd)
-			if err != nil {
-				return fmt.Errorf("failed to create CEL environment for %s: %w", key, err)
-			}
-			env, err := celutils.CreateCELEnv(append(baseEnvOpts, eventsEnvOpts...)...)
+		}
+	}
+
+	return nil
+}
+
+// checkWhenChanged checks that when_changed is only used by update rules and, when the
+// schema is known, that its columns exist
+func checkWhenChanged(ref, tableName, eventType string, columns []string, pbFd protoreflect.FileDescriptor) error {
+	if len(columns) == 0 {
+		return nil
+	}
+	if eventType != "update" {
+		return fmt.Errorf("when_changed is only supported for update rules: %s", ref)
+	}
+	if pbFd == nil {
+		return nil
+	}
+	msg := pbFd.Messages().ByName(protoreflect.Name(tableName))
+	if msg == nil {
+		return nil
+	}
+	for _, column := range columns {
+		if msg.Fields().ByName(protoreflect.Name(column)) == nil {
+			return fmt.Errorf("when_changed column %s does not exist in table %s: %s", column, tableName, ref)
+		}
+	}
+	return nil
+}
+
+// compileEventConfig compiles the CEL expressions of one rule, ref names it in errors
+func compileEventConfig(ref string, eventConfig EventConfig, baseEnvOpts []cel.EnvOption) error {
+	// Compile CEL expressions based on event type
+	switch ec := eventConfig.(type) {
+	case *SimpleEvent:
+		env, err := celutils.CreateCELEnv(baseEnvOpts...)
+		if err != nil {
+			return fmt.Errorf("failed to create CEL environment for %s: %w", ref, err)
+		}
+		// Compile properties for SimpleEvent
+		ec.CompiledProperties, err = compileProperties(env, ec.Properties)
+		if err != nil {
+			return fmt.Errorf("failed to compile properties for %s: %w", ref, err)
+		}
+		ec.CompiledCond = nil
+		if ec.Cond != "" {
+			ec.CompiledCond, err = celutils.CompileBoolCondition(env, ec.Cond)
 			if err != nil {
-				return fmt.Errorf("failed to create CEL environment for %s: %w", key, err)
+				return fmt.Errorf("failed to compile condition for %s: %w", ref, err)
 			}
-			// Compile condition
-			ec.CompiledCond, err = celutils.CompileEventCondition(env, ec.Cond)
+		}
+
+	case *ConditionalEvent:
+		var err error
+		ec.CondEventsPbFd, err = celutils.GenerateEventRefPb(ec.GetEventNames())
+		if err != nil {
+			return fmt.Errorf("failed to create CEL environment for %s: %w", ref, err)
+		}
+		eventsEnvOpts, err := celutils.GenerateCELEventsOptionsFromPbFd(ec.CondEventsPbFd)
+		if err != nil {
+			return fmt.Errorf("failed to create CEL environment for %s: %w", ref, err)
+		}
+		env, err := celutils.CreateCELEnv(append(baseEnvOpts, eventsEnvOpts...)...)
+		if err != nil {
+			return fmt.Errorf("failed to create CEL environment for %s: %w", ref, err)
+		}
+		// Compile condition
+		ec.CompiledCond, err = celutils.CompileEventCondition(env, ec.Cond)
+		if err != nil {
+			return fmt.Errorf("failed to compile condition for %s: %w", ref, err)
+		}
+
+		// Initialize the compiled events map
+		ec.CompiledEvents = make(map[string]map[string]cel.Program)
+
+		// Compile properties for each event in ConditionalEvent
+		for eventName, eventProperties := range ec.Events {
+			ec.CompiledEvents[eventName], err = compileProperties(env, eventProperties)
 			if err != nil {
-				return fmt.Errorf("failed to compile condition for %s: %w", key, err)
+				return fmt.Errorf("failed to compile properties for %s.%s: %w", ref, eventName, err)
 			}
+		}
+	}
 
-			// Initialize the compiled events map
-			ec.CompiledEvents = make(map[string]map[string]cel.Program)
+	return nil
+}
 
-			// Compile properties for each event in ConditionalEvent
-			for eventName, eventProperties := range ec.Events {
-				ec.CompiledEvents[eventName], err = compileProperties(env, eventProperties)
-				if err != nil {
-					return fmt.Errorf("failed to compile properties for %s.%s: %w", key, eventName, err)
-				}
+// TransactionRules returns the sorted keys of the rules that match a whole transaction
+func (tc TrackingConfig) TransactionRules() []string {
+	var keys []string
+	for key := range tc {
+		if table, op, ok := strings.Cut(key, "."); ok && celutils.IsTransactionRule(table, op) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Clone copies the tracking config so it can be compiled without touching the programs in use
+func (tc TrackingConfig) Clone() TrackingConfig {
+	clone := make(TrackingConfig, len(tc))
+	for key, rules := range tc {
+		clonedRules := make(EventRules, len(rules))
+		for i, rule := range rules {
+			switch ec := rule.EventConfig.(type) {
+			case *SimpleEvent:
+				copied := *ec
+				clonedRules[i] = EventConfigUnmarshaler{EventConfig: &copied}
+			case *ConditionalEvent:
+				copied := *ec
+				clonedRules[i] = EventConfigUnmarshaler{EventConfig: &copied}
+			default:
+				clonedRules[i] = rule
 			}
 		}
+		clone[key] = clonedRules
+	}
+	return clone
+}
+
+// Validate performs validation on the entire configuration
+func (esc *EventStreamingConfig) Validate(pbPkgName *string, pbFd protoreflect.FileDescriptor) error {
+	// Validate tracking configuration
+	if err := esc.Track.Compile(pbPkgName, pbFd); err != nil {
+		return err
 	}
 
 	// Validate destinations
 	for destKey, dest := range esc.Destinations {
 		if err := dest.Validate(destKey); err != nil {
-			return fmt.Errorf("destination validation failed: %w", err)
+			return fmt.Errorf("destination validation failed for %s: %w", destKey, err)
 		}
 		// Update the original map with any changes made during validation
 		esc.Destinations[destKey] = dest
@@ -342,7 +649,7 @@ func (esc *EventStreamingConfig) Validate(pbPkgName *string, pbFd protoreflect.F
 
 	for destKey, dest := range esc.RawDBEventDestinations {
 		if err := dest.Validate(destKey); err != nil {
-			return fmt.Errorf("raw db event destination validation failed: %w", err)
+			return fmt.Errorf("raw db event destination validation failed for %s: %w", destKey, err)
 		}
 		// Update the original map with any changes made during validation
 		esc.RawDBEventDestinations[destKey] = dest
@@ -353,14 +660,64 @@ func (esc *EventStreamingConfig) Validate(pbPkgName *string, pbFd protoreflect.F
 		return fmt.Errorf("ignore configuration validation failed: %w", err)
 	}
 
+	if esc.NotifyChannel != "" && !identifierPattern.MatchString(esc.NotifyChannel) {
+		return fmt.Errorf("invalid notify_channel %q: must only contain letters, numbers and underscores", esc.NotifyChannel)
+	}
+
+	if esc.Replication != nil {
+		if err := esc.Replication.Validate(); err != nil {
+			return fmt.Errorf("replication configuration validation failed: %w", err)
+		}
+	}
+
+	if esc.Monitoring != nil {
+		if err := esc.Monitoring.Validate(); err != nil {
+			return fmt.Errorf("monitoring configuration validation failed: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// ChangedDestinations returns a config holding only the destinations of esc that are new or
+// configured differently than in previous, so a reload only initializes those
+func (esc *EventStreamingConfig) ChangedDestinations(previous *EventStreamingConfig) *EventStreamingConfig {
+	changed := &EventStreamingConfig{
+		Destinations:           make(map[string]DestinationConfig),
+		RawDBEventDestinations: make(map[string]DestinationConfig),
+		E2eProcessedEventChan:  esc.E2eProcessedEventChan,
+		E2eDBEventChan:         esc.E2eDBEventChan,
+	}
+	for key, destination := range esc.Destinations {
+		if previousDestination, ok := previous.Destinations[key]; !ok || previousDestination != destination {
+			changed.Destinations[key] = destination
+		}
+	}
+	for key, destination := range esc.RawDBEventDestinations {
+		if previousDestination, ok := previous.RawDBEventDestinations[key]; !ok || previousDestination != destination {
+			changed.RawDBEventDestinations[key] = destination
+		}
+	}
+	return changed
+}
+
+// DestinationNames returns the names the destinations are initialized with
+func (esc *EventStreamingConfig) DestinationNames() map[string]bool {
+	names := make(map[string]bool, len(esc.Destinations)+len(esc.RawDBEventDestinations))
+	for key := range esc.Destinations {
+		names[processedEventDestinationPrefix+key] = true
+	}
+	for key := range esc.RawDBEventDestinations {
+		names[rawDBEventDestinationPrefix+key] = true
+	}
+	return names
+}
+
 func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger) ([]InitializedProcessedEventDestination, []InitializedDBEventDestination, error) {
 	initializedDestinations := make([]InitializedProcessedEventDestination, 0, len(esc.Destinations))
 	initializedDBDestinations := make([]InitializedDBEventDestination, 0, len(esc.RawDBEventDestinations))
-	for kind, destination := range esc.RawDBEventDestinations {
-		switch kind {
+	for key, destination := range esc.RawDBEventDestinations {
+		switch kind := destination.KindFor(key); kind {
 		case "bigquery":
 			bq, err := destinations.NewBigQueryRawDBEventDestination(
 				destination.CredentialsJSON,
@@ -368,9 +725,10 @@ func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger)
 				logger,
 			)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to create bigquery destination: %w", err)
+				return nil, nil, fmt.Errorf("failed to create bigquery destination %s: %w", key, err)
 			}
 			initializedDBDestinations = append(initializedDBDestinations, InitializedDBEventDestination{
+				Name:        rawDBEventDestinationPrefix + key,
 				Kind:        kind,
 				Filter:      destination.Filter,
 				Destination: bq,
@@ -386,9 +744,10 @@ func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger)
 				logger,
 			)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to create s3 destination: %w", err)
+				return nil, nil, fmt.Errorf("failed to create s3 destination %s: %w", key, err)
 			}
 			initializedDBDestinations = append(initializedDBDestinations, InitializedDBEventDestination{
+				Name:        rawDBEventDestinationPrefix + key,
 				Kind:        kind,
 				Filter:      destination.Filter,
 				Destination: s3,
@@ -398,11 +757,12 @@ func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger)
 		}
 	}
 
-	for kind, destination := range esc.Destinations {
-		switch kind {
+	for key, destination := range esc.Destinations {
+		switch kind := destination.KindFor(key); kind {
 		case "e2e_test_processed_events":
 			e2eDest := destinations.NewTestProcessedEventDestination(esc.E2eProcessedEventChan)
 			initializedDestinations = append(initializedDestinations, InitializedProcessedEventDestination{
+				Name:        processedEventDestinationPrefix + key,
 				Kind:        kind,
 				Filter:      destination.Filter,
 				Destination: e2eDest,
@@ -410,6 +770,7 @@ func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger)
 		case "e2e_test_db_events":
 			e2eDest := destinations.NewTestDBEventDestination(esc.E2eDBEventChan)
 			initializedDBDestinations = append(initializedDBDestinations, InitializedDBEventDestination{
+				Name:        processedEventDestinationPrefix + key,
 				Kind:        kind,
 				Filter:      destination.Filter,
 				Destination: e2eDest,
@@ -417,9 +778,10 @@ func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger)
 		case "mixpanel":
 			mp, err := destinations.NewMixpanelDestination(destination.ProjectToken, destination.APIEndpoint, destination.DataEndpoint, logger)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to create mixpanel destination: %w", err)
+				return nil, nil, fmt.Errorf("failed to create mixpanel destination %s: %w", key, err)
 			}
 			initializedDestinations = append(initializedDestinations, InitializedProcessedEventDestination{
+				Name:        processedEventDestinationPrefix + key,
 				Kind:        kind,
 				Filter:      destination.Filter,
 				Destination: mp,
@@ -427,9 +789,10 @@ func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger)
 		case "posthog":
 			ph, err := destinations.NewPostHogDestination(destination.APIKey, destination.Endpoint, logger)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to create posthog destination: %w", err)
+				return nil, nil, fmt.Errorf("failed to create posthog destination %s: %w", key, err)
 			}
 			initializedDestinations = append(initializedDestinations, InitializedProcessedEventDestination{
+				Name:        processedEventDestinationPrefix + key,
 				Kind:        kind,
 				Filter:      destination.Filter,
 				Destination: ph,
@@ -437,9 +800,10 @@ func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger)
 		case "amplitude":
 			amp, err := destinations.NewAmplitudeDestination(destination.APIKey, destination.Endpoint, logger)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to create amplitude destination: %w", err)
+				return nil, nil, fmt.Errorf("failed to create amplitude destination %s: %w", key, err)
 			}
 			initializedDestinations = append(initializedDestinations, InitializedProcessedEventDestination{
+				Name:        processedEventDestinationPrefix + key,
 				Kind:        kind,
 				Filter:      destination.Filter,
 				Destination: amp,
@@ -451,9 +815,10 @@ func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger)
 				logger,
 			)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to create bigquery destination: %w", err)
+				return nil, nil, fmt.Errorf("failed to create bigquery destination %s: %w", key, err)
 			}
 			initializedDestinations = append(initializedDestinations, InitializedProcessedEventDestination{
+				Name:        processedEventDestinationPrefix + key,
 				Kind:        kind,
 				Filter:      destination.Filter,
 				Destination: bq,
@@ -469,9 +834,10 @@ func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger)
 				logger,
 			)
 			if err != nil {
-				return nil, nil, fmt.Errorf("failed to create s3 destination: %w", err)
+				return nil, nil, fmt.Errorf("failed to create s3 destination %s: %w", key, err)
 			}
 			initializedDestinations = append(initializedDestinations, InitializedProcessedEventDestination{
+				Name:        processedEventDestinationPrefix + key,
 				Kind:        kind,
 				Filter:      destination.Filter,
 				Destination: s3,
@@ -483,13 +849,17 @@ func (esc *EventStreamingConfig) GetInitializedDestinations(logger *slog.Logger)
 	return initializedDestinations, initializedDBDestinations, nil
 }
 
-// ParseEventStreamingConfig parses and validates a YAML configuration
+// ParseEventStreamingConfig reads the YAML configuration file, then parses and validates it
 func ParseEventStreamingConfig(path string) (*EventStreamingConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
+	return ParseEventStreamingConfigBytes(data)
+}
 
+// ParseEventStreamingConfigBytes parses and validates the events config YAML
+func ParseEventStreamingConfigBytes(data []byte) (*EventStreamingConfig, error) {
 	config := &EventStreamingConfig{}
 
 	if err := yaml.Unmarshal(data, config); err != nil {
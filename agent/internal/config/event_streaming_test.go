@@ -0,0 +1,187 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestEventRulesUnmarshalYAML(t *testing.T) {
+	var track TrackingConfig
+	err := yaml.Unmarshal([]byte(`
+users.insert:
+  event: USER_SIGNUP
+  properties:
+    id: new.id
+users.update:
+  - event: USER_UPDATED
+    properties:
+      id: new.id
+  - event: PLAN_CHANGED
+    cond: old.plan != new.plan
+    when_changed: [plan]
+  - cond: 'new.banned ? events.USER_BANNED : null'
+    when_changed: [banned]
+    USER_BANNED:
+      id: new.id
+`), &track)
+	if err != nil {
+		t.Fatalf("yaml.Unmarshal() error = %v", err)
+	}
+
+	inserts := track["users.insert"]
+	if len(inserts) != 1 {
+		t.Fatalf("users.insert has %d rules, want 1", len(inserts))
+	}
+	signup, ok := inserts[0].EventConfig.(*SimpleEvent)
+	if !ok || signup.Event != "USER_SIGNUP" || signup.Properties["id"] != "new.id" {
+		t.Errorf("users.insert rule = %+v, want the USER_SIGNUP simple event", inserts[0].EventConfig)
+	}
+
+	updates := track["users.update"]
+	if len(updates) != 3 {
+		t.Fatalf("users.update has %d rules, want 3", len(updates))
+	}
+	if updated, ok := updates[0].EventConfig.(*SimpleEvent); !ok || updated.Event != "USER_UPDATED" || updated.Cond != "" {
+		t.Errorf("rule 0 = %+v, want USER_UPDATED without a cond", updates[0].EventConfig)
+	}
+	if planChanged, ok := updates[1].EventConfig.(*SimpleEvent); !ok || planChanged.Cond != "old.plan != new.plan" {
+		t.Errorf("rule 1 = %+v, want PLAN_CHANGED with a bool cond", updates[1].EventConfig)
+	}
+	banned, ok := updates[2].EventConfig.(*ConditionalEvent)
+	if !ok {
+		t.Fatalf("rule 2 = %T, want *ConditionalEvent", updates[2].EventConfig)
+	}
+	if banned.Events["USER_BANNED"]["id"] != "new.id" {
+		t.Errorf("rule 2 events = %v, want USER_BANNED with an id", banned.Events)
+	}
+	if got := updates[2].WhenChangedColumns(); !slices.Equal(got, []string{"banned"}) {
+		t.Errorf("rule 2 when_changed = %v, want [banned]", got)
+	}
+	if got := updates[0].WhenChangedColumns(); got != nil {
+		t.Errorf("rule 0 when_changed = %v, want none", got)
+	}
+}
+
+func TestEventRulesUnmarshalYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{name: "empty list", yaml: "users.update: []"},
+		{name: "rule without event or cond", yaml: "users.insert:\n  properties:\n    id: new.id"},
+		{name: "invalid rule in a list", yaml: "users.insert:\n  - event: USER_SIGNUP\n  - properties: {id: new.id}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var track TrackingConfig
+			if err := yaml.Unmarshal([]byte(tt.yaml), &track); err == nil {
+				t.Errorf("yaml.Unmarshal() = %v, want an error", track)
+			}
+		})
+	}
+}
+
+func TestMatchesChanges(t *testing.T) {
+	always := EventConfigUnmarshaler{EventConfig: &SimpleEvent{Event: "USER_UPDATED"}}
+	planOrEmail := EventConfigUnmarshaler{EventConfig: &SimpleEvent{Event: "PROFILE_CHANGED", WhenChanged: []string{"plan", "email"}}}
+
+	tests := []struct {
+		name    string
+		rule    EventConfigUnmarshaler
+		changed []string
+		want    bool
+	}{
+		{name: "no when_changed", rule: always, changed: []string{}, want: true},
+		{name: "one of the columns changed", rule: planOrEmail, changed: []string{"email", "updated_at"}, want: true},
+		{name: "other columns changed", rule: planOrEmail, changed: []string{"updated_at"}, want: false},
+		{name: "nothing changed", rule: planOrEmail, changed: []string{}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.MatchesChanges(tt.changed); got != tt.want {
+				t.Errorf("MatchesChanges(%v) = %v, want %v", tt.changed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEventStreamingConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "valid rules",
+			yaml: "track:\n  users.insert:\n    event: USER_SIGNUP\n    properties:\n      id: new.id",
+		},
+		{
+			name:    "when_changed on an insert",
+			yaml:    "track:\n  users.insert:\n    event: USER_SIGNUP\n    when_changed: [plan]",
+			wantErr: "when_changed is only supported for update rules: users.insert",
+		},
+		{
+			name:    "invalid expression in a list",
+			yaml:    "track:\n  users.update:\n    - event: USER_UPDATED\n    - event: PLAN_CHANGED\n      properties:\n        plan: new.plan +",
+			wantErr: "users.update[1]",
+		},
+		{
+			name:    "event emitted by two rules of a list",
+			yaml:    "track:\n  users.update:\n    - event: USER_UPDATED\n    - cond: 'true ? events.USER_UPDATED : null'\n      USER_UPDATED:\n        id: new.id",
+			wantErr: "users.update[1]: event USER_UPDATED is also emitted by users.update[0]",
+		},
+		{
+			name:    "table named meta",
+			yaml:    "track:\n  meta.insert:\n    event: META_CREATED",
+			wantErr: "table meta can't be tracked",
+		},
+		{
+			name:    "table named tx",
+			yaml:    "track:\n  tx.update:\n    event: TX_UPDATED",
+			wantErr: "table tx can't be tracked",
+		},
+		{
+			name:    "table named changed_columns",
+			yaml:    "track:\n  changed_columns.delete:\n    event: DELETED",
+			wantErr: "table changed_columns can't be tracked",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseEventStreamingConfigBytes([]byte(tt.yaml))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ParseEventStreamingConfigBytes() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseEventStreamingConfigBytes() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTransactionRules(t *testing.T) {
+	esc, err := ParseEventStreamingConfigBytes([]byte(`
+track:
+  users.insert:
+    event: USER_SIGNUP
+  tx.order_placed:
+    cond: 'changes.exists(c, c.table == "orders") ? events.ORDER_PLACED : null'
+    ORDER_PLACED:
+      lines: changes.size()
+`))
+	if err != nil {
+		t.Fatalf("ParseEventStreamingConfigBytes() error = %v", err)
+	}
+	if got := esc.Track.TransactionRules(); !slices.Equal(got, []string{"tx.order_placed"}) {
+		t.Errorf("TransactionRules() = %v, want [tx.order_placed]", got)
+	}
+}
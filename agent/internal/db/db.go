@@ -17,7 +17,10 @@ import (
 )
 
 func NewDB(ctx context.Context) (*pgxpool.Pool, error) {
-	cfg := config.ConfigFromContext(ctx)
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	poolConfig, err := pgxpool.ParseConfig(cfg.DatabaseURL)
 	if err != nil {
@@ -37,42 +40,268 @@ func NewDB(ctx context.Context) (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
+// dbEventColumns are the event_log columns scanned by scanDBEvents, in order
+const dbEventColumns = "id, event_type, row_table_name, logged_at, retries, last_error, last_retry_at, process_after, old_row, new_row, metadata, txid, tx_context, entity_key, delivered_to"
+
 // FetchDBEvents retrieves a batch of events from the event_log table
 // using SELECT FOR UPDATE SKIP LOCKED to implement a queue pattern.
 // It returns the events and the pgx transaction which must be committed
-// or rolled back by the caller.
-func FetchDBEvents(ctx context.Context, pool *pgxpool.Pool) ([]*eventmodels.DBEvent, pgx.Tx, error) {
+// or rolled back by the caller. With groupTransactions the batch holds all of the
+// transactions' changes, see batchCTEs.
+func FetchDBEvents(ctx context.Context, pool *pgxpool.Pool, groupTransactions bool) ([]*eventmodels.DBEvent, pgx.Tx, error) {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	tx, err := pool.Begin(ctx)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
-	cfg := config.ConfigFromContext(ctx)
-
 	// Construct the fully qualified table name using schema and table from config
 	tableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.EventLogTableName)
 
-	query := fmt.Sprintf(`
-		SELECT id, event_type, row_table_name, logged_at, retries, last_error, last_retry_at, process_after, old_row, new_row, metadata
-		FROM %s
-		WHERE process_after < $1
-		ORDER BY process_after
-		FOR UPDATE SKIP LOCKED
-		LIMIT $2
-	`, tableName)
+	query := fmt.Sprintf(`%[1]s
+		SELECT %[2]s, batch.tx_oversized
+		FROM %[3]s e
+			JOIN batch USING (id)
+		ORDER BY %[4]s
+	`, batchCTEs(cfg, tableName, groupTransactions), dbEventColumns, tableName, batchOrder(cfg, "due_at"))
 
 	rows, err := tx.Query(ctx, query, time.Now(), cfg.BatchSize)
 	if err != nil {
 		tx.Rollback(ctx)
 		return nil, nil, fmt.Errorf("failed to query events: %w", err)
 	}
+
+	events, err := scanDBEvents(rows)
+	if err != nil {
+		tx.Rollback(ctx)
+		return nil, nil, err
+	}
+
+	return events, tx, nil
+}
+
+// ClaimDBEvents leases a batch of events from the event_log table to the worker identified
+// by claimToken. The claim is committed immediately: the events are hidden from other agents by pushing process_after out
+// by the lease timeout, so no transaction is held while they are delivered. If the agent dies
+// the events become available again once the lease expires. With groupTransactions the
+// batch holds all of the transactions' changes, see batchCTEs.
+func ClaimDBEvents(ctx context.Context, pool *pgxpool.Pool, claimToken string, leaseTimeout time.Duration, groupTransactions bool) ([]*eventmodels.DBEvent, error) {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.EventLogTableName)
+
+	// Keep the original process_after order, the claimed rows all share the new lease expiry
+	query := fmt.Sprintf(`%[1]s, claimed AS (
+			UPDATE %[2]s AS e
+			SET process_after = $3, claimed_by = $4
+			FROM batch
+			WHERE e.id = batch.id
+			RETURNING e.*, batch.due_at, batch.tx_oversized
+		)
+		SELECT %[3]s, tx_oversized
+		FROM claimed
+		ORDER BY %[4]s
+	`, batchCTEs(cfg, tableName, groupTransactions), tableName, dbEventColumns, batchOrder(cfg, "due_at"))
+
+	now := time.Now()
+	rows, err := pool.Query(ctx, query, now, cfg.BatchSize, now.Add(leaseTimeout), claimToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim events: %w", err)
+	}
+
+	return scanDBEvents(rows)
+}
+
+// batchCTEs returns the WITH clause that locks the next batch of due events, $1 being the
+// current time and $2 the batch size. It ends with the batch CTE of the events' id, due_at
+// and tx_oversized.
+//
+// With groupTransactions the other changes of the transactions in the batch are added to it,
+// so it can go over the batch size, and a transaction is only in the batch if all of its
+// changes are, see completeTransactionsFilter. A transaction advisory lock keeps other
+// workers from locking part of a transaction that is being batched. Transactions with more
+// than MAX_TRANSACTION_SIZE changes are not added whole, their changes are batched like any
+// other events with tx_oversized set.
+func batchCTEs(cfg *config.AgentConfig, tableName string, groupTransactions bool) string {
+	if !groupTransactions {
+		return fmt.Sprintf(`
+		WITH due AS MATERIALIZED (
+			SELECT id, entity_key, process_after
+			FROM %[1]s e
+			WHERE process_after < $1%[2]s
+			ORDER BY process_after
+			FOR UPDATE SKIP LOCKED
+			LIMIT $2
+		), batch AS (
+			SELECT id, process_after AS due_at, FALSE AS tx_oversized
+			FROM due e
+			WHERE TRUE%[3]s
+		)`, tableName, entityDueFilter(cfg, tableName, false), entityOrderingFilter(cfg, tableName, false))
+	}
+
+	return fmt.Sprintf(`
+		WITH due AS MATERIALIZED (
+			SELECT id, txid
+			FROM %[1]s e
+			WHERE process_after < $1%[2]s
+				AND (e.txid IS NULL OR pg_try_advisory_xact_lock(hashtext('%[5]s' || e.txid)))
+			ORDER BY process_after
+			FOR UPDATE SKIP LOCKED
+			LIMIT $2
+		), grouped AS MATERIALIZED (
+			SELECT txid
+			FROM %[1]s
+			WHERE txid IN (SELECT txid FROM due)
+			GROUP BY txid
+			HAVING count(*) <= %[6]d
+		), locked AS MATERIALIZED (
+			SELECT id, txid, process_after
+			FROM %[1]s e
+			WHERE (e.id IN (SELECT id FROM due) OR e.txid IN (SELECT txid FROM grouped))
+				AND process_after < $1%[3]s
+			FOR UPDATE SKIP LOCKED
+		), batch AS (
+			SELECT id, process_after AS due_at, COALESCE(locked.txid NOT IN (SELECT txid FROM grouped), FALSE) AS tx_oversized
+			FROM locked
+			WHERE %[4]s
+		)`, tableName, entityDueFilter(cfg, tableName, true), entityOrderingFilter(cfg, tableName, true), completeTransactionsFilter(tableName), txLockKey, cfg.MaxTransactionSize)
+}
+
+// LockClaimedDBEvents locks the events in the transaction and returns the IDs of those still
+// claimed with claimToken. Events missing from the result had their lease expire and were
+// claimed by another worker, or were already removed.
+func LockClaimedDBEvents(ctx context.Context, tx pgx.Tx, eventIDs []int64, claimToken string) ([]int64, error) {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.EventLogTableName)
+
+	query := fmt.Sprintf(`
+		SELECT id FROM %s
+		WHERE id = ANY($1) AND claimed_by = $2
+		FOR UPDATE
+	`, tableName)
+
+	rows, err := tx.Query(ctx, query, eventIDs, claimToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock claimed events: %w", err)
+	}
+
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan claimed events: %w", err)
+	}
+	return ids, nil
+}
+
+// ReleaseDBEvents gives up the worker's claim on the events so they can be processed right away
+func ReleaseDBEvents(ctx context.Context, pool *pgxpool.Pool, eventIDs []int64, claimToken string) error {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	tableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.EventLogTableName)
+
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET process_after = $1, claimed_by = NULL
+		WHERE id = ANY($2) AND claimed_by = $3
+	`, tableName)
+
+	if _, err := pool.Exec(ctx, query, time.Now(), eventIDs, claimToken); err != nil {
+		return fmt.Errorf("failed to release claimed events: %w", err)
+	}
+	return nil
+}
+
+// txLockKey is hashed with the txid into the advisory lock key of a transaction being
+// batched, so it doesn't collide with advisory locks taken by the application
+const txLockKey = "pg_track_events.tx:"
+
+// entityDueFilter returns the condition, on the event log aliased as e, that keeps events out
+// of the due CTE when ORDERING=entity while an earlier event for the same row is not due,
+// e.g. waiting for a retry or leased to another agent. It keeps held back events from using
+// up the batch, entityOrderingFilter makes the final decision. With groupTransactions earlier
+// events of the same transaction are batched with the event, so they don't hold it back.
+func entityDueFilter(cfg *config.AgentConfig, tableName string, groupTransactions bool) string {
+	if cfg.Ordering != config.OrderingEntity {
+		return ""
+	}
+	return fmt.Sprintf(`
+				AND (e.entity_key IS NULL OR NOT EXISTS (
+					SELECT 1 FROM %s earlier
+					WHERE earlier.entity_key = e.entity_key AND earlier.id < e.id AND earlier.process_after >= $1%s
+				))`, tableName, sameTransactionFilter(groupTransactions))
+}
+
+// entityOrderingFilter returns the condition, on the event log aliased as e, that holds back
+// events when ORDERING=entity while an earlier event for the same row is still in the event
+// log and not in the due CTE of the batch. Earlier events in the batch are delivered first,
+// earlier events locked by another agent are still visible and hold back later events too.
+// With groupTransactions earlier events of the same transaction don't hold an event back,
+// the transaction is batched as a whole, see completeTransactionsFilter.
+func entityOrderingFilter(cfg *config.AgentConfig, tableName string, groupTransactions bool) string {
+	if cfg.Ordering != config.OrderingEntity {
+		return ""
+	}
+	return fmt.Sprintf(`
+			AND (e.entity_key IS NULL OR NOT EXISTS (
+				SELECT 1 FROM %s earlier
+				WHERE earlier.entity_key = e.entity_key AND earlier.id < e.id
+					AND earlier.id NOT IN (SELECT id FROM due)%s
+			))`, tableName, sameTransactionFilter(groupTransactions))
+}
+
+// sameTransactionFilter returns the condition of the entity ordering filters that leaves out
+// the earlier events of e's transaction when transactions are batched as a whole
+func sameTransactionFilter(groupTransactions bool) string {
+	if !groupTransactions {
+		return ""
+	}
+	return `
+					AND (e.txid IS NULL OR earlier.txid IS DISTINCT FROM e.txid)`
+}
+
+// completeTransactionsFilter returns the condition, on the locked CTE of a batch, that leaves
+// out the transactions with a change that is not in locked: one that is not due, or was held
+// back by ORDERING=entity. Transaction rules must see all of a transaction's changes, so the
+// rest of the transaction stays in the event log and is fetched again with it. The changes of
+// oversized transactions are not grouped, so they are never left out.
+func completeTransactionsFilter(tableName string) string {
+	return fmt.Sprintf(`locked.txid IS NULL OR locked.txid NOT IN (SELECT txid FROM grouped) OR NOT EXISTS (
+				SELECT 1 FROM %s other
+				WHERE other.txid = locked.txid AND other.id NOT IN (SELECT id FROM locked)
+			)`, tableName)
+}
+
+// batchOrder returns the ORDER BY of a batch. Events are delivered in the order they are due,
+// with ORDERING=entity in the order they were logged so a row's events in the batch stay in order.
+func batchOrder(cfg *config.AgentConfig, dueColumn string) string {
+	if cfg.Ordering == config.OrderingEntity {
+		return "id"
+	}
+	return dueColumn + ", id"
+}
+
+// scanDBEvents scans rows selected with dbEventColumns followed by tx_oversized and closes them
+func scanDBEvents(rows pgx.Rows) ([]*eventmodels.DBEvent, error) {
 	defer rows.Close()
 
 	var events []*eventmodels.DBEvent
 	for rows.Next() {
 		var event eventmodels.DBEvent
 		var eventTypeStr string
-		var oldRow, newRow, metadata pgtype.Text
+		var oldRow, newRow, metadata, txContext pgtype.Text
 
 		if err := rows.Scan(
 			&event.ID,
@@ -86,9 +315,13 @@ func FetchDBEvents(ctx context.Context, pool *pgxpool.Pool) ([]*eventmodels.DBEv
 			&oldRow,
 			&newRow,
 			&metadata,
+			&event.TxID,
+			&txContext,
+			&event.EntityKey,
+			&event.DeliveredTo,
+			&event.TxOversized,
 		); err != nil {
-			tx.Rollback(ctx)
-			return nil, nil, fmt.Errorf("failed to scan event: %w", err)
+			return nil, fmt.Errorf("failed to scan event: %w", err)
 		}
 
 		event.EventType = eventmodels.DBEventType(eventTypeStr)
@@ -105,15 +338,18 @@ func FetchDBEvents(ctx context.Context, pool *pgxpool.Pool) ([]*eventmodels.DBEv
 			event.Metadata = json.RawMessage(metadata.String)
 		}
 
+		if txContext.Valid {
+			event.TxContext = json.RawMessage(txContext.String)
+		}
+
 		events = append(events, &event)
 	}
 
 	if err := rows.Err(); err != nil {
-		tx.Rollback(ctx)
-		return nil, nil, fmt.Errorf("error iterating event rows: %w", err)
+		return nil, fmt.Errorf("error iterating event rows: %w", err)
 	}
 
-	return events, tx, nil
+	return events, nil
 }
 
 func UpdateDBEvents(ctx context.Context, tx pgx.Tx, updates []*eventmodels.DBEventUpdate) error {
@@ -121,23 +357,29 @@ func UpdateDBEvents(ctx context.Context, tx pgx.Tx, updates []*eventmodels.DBEve
 		return nil
 	}
 
-	cfg := config.ConfigFromContext(ctx)
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return err
+	}
 
 	tableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.EventLogTableName)
 
 	// Prepare batch for multiple updates
 	batch := &pgx.Batch{}
 
-	// Create query for each update
+	// Create query for each update, appending the attempt to the row's retry history
 	baseQuery := fmt.Sprintf(`
 		UPDATE %s
-		SET retries = $1, last_error = $2, last_retry_at = $3, process_after = $4
-		WHERE id = $5
+		SET retries = $1, last_error = $2, last_retry_at = $3, process_after = $4, delivered_to = COALESCE($5::text[], '{}'), claimed_by = NULL,
+			retry_history = retry_history || jsonb_build_array(jsonb_build_object(
+				'retry', $1::int, 'at', $3::timestamptz, 'error', $2::text, 'destinations', COALESCE($6::text[], '{}')
+			))
+		WHERE id = $7
 	`, tableName)
 
 	// Add each update to the batch
 	for _, update := range updates {
-		batch.Queue(baseQuery, update.Retries, update.LastError, update.LastRetryAt, update.ProcessAfter, update.ID)
+		batch.Queue(baseQuery, update.Retries, update.LastError, update.LastRetryAt, update.ProcessAfter, update.DeliveredTo, update.FailedDestinations, update.ID)
 	}
 
 	// Execute all updates as a batch
@@ -162,13 +404,17 @@ func FlushDBEvents(ctx context.Context, tx pgx.Tx, eventIDs []int64) error {
 		return tx.Commit(ctx)
 	}
 
-	cfg := config.ConfigFromContext(ctx)
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
 
 	// Construct the fully qualified table name using schema and table from config
 	tableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.EventLogTableName)
 
 	query := fmt.Sprintf("DELETE FROM %s WHERE id = ANY($1)", tableName)
-	_, err := tx.Exec(ctx, query, eventIDs)
+	_, err = tx.Exec(ctx, query, eventIDs)
 	if err != nil {
 		tx.Rollback(ctx)
 		return fmt.Errorf("failed to delete events: %w", err)
@@ -177,6 +423,166 @@ func FlushDBEvents(ctx context.Context, tx pgx.Tx, eventIDs []int64) error {
 	return nil
 }
 
+// DeadLetterDBEvents moves events from the event_log table into the dead letter table
+// using the transaction obtained from FetchDBEvents. The events should already carry
+// their final error and retry history (see UpdateDBEvents).
+func DeadLetterDBEvents(ctx context.Context, tx pgx.Tx, eventIDs []int64) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	tableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.EventLogTableName)
+	deadLetterTableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.DeadLetterTableName)
+
+	query := fmt.Sprintf(`
+		WITH moved AS (
+			DELETE FROM %s WHERE id = ANY($1)
+			RETURNING id, event_type, row_table_name, logged_at, retries, last_error, last_retry_at, old_row, new_row, metadata, txid, tx_context, entity_key, delivered_to, retry_history
+		)
+		INSERT INTO %s (
+			id, event_type, row_table_name, logged_at, retries, last_error, last_retry_at, old_row, new_row, metadata, txid, tx_context, entity_key, delivered_to, retry_history, failed_destinations
+		)
+		SELECT id, event_type, row_table_name, logged_at, retries, last_error, last_retry_at, old_row, new_row, metadata, txid, tx_context, entity_key, delivered_to, retry_history,
+			ARRAY(SELECT jsonb_array_elements_text(retry_history -> -1 -> 'destinations'))
+		FROM moved
+	`, tableName, deadLetterTableName)
+
+	if _, err := tx.Exec(ctx, query, eventIDs); err != nil {
+		return fmt.Errorf("failed to move events to dead letter table: %w", err)
+	}
+
+	return nil
+}
+
+// EnqueueDBEvents inserts events that were not read from the event_log table, e.g. from
+// logical replication, so that failed deliveries can be retried from the outbox.
+// It returns the ID assigned to each event, in order.
+func EnqueueDBEvents(ctx context.Context, tx pgx.Tx, events []*eventmodels.DBEvent) ([]int64, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.EventLogTableName)
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (event_type, row_table_name, logged_at, old_row, new_row, metadata, txid, tx_context, entity_key)
+		VALUES ($1, $2, $3, $4::jsonb, $5::jsonb, $6::jsonb, $7, $8::jsonb, $9)
+		RETURNING id
+	`, tableName)
+
+	batch := &pgx.Batch{}
+	for _, event := range events {
+		batch.Queue(query, string(event.EventType), event.RowTableName, event.LoggedAt, nullableJSON(event.OldRow), nullableJSON(event.NewRow), nullableJSON(event.Metadata), event.TxID, nullableJSON(event.TxContext), event.EntityKey)
+	}
+
+	results := tx.SendBatch(ctx, batch)
+	defer results.Close()
+
+	ids := make([]int64, len(events))
+	for i := range events {
+		if err := results.QueryRow().Scan(&ids[i]); err != nil {
+			return nil, fmt.Errorf("failed to enqueue event (index %d): %w", i, err)
+		}
+	}
+
+	return ids, nil
+}
+
+// nullableJSON returns nil for empty JSON so it is stored as NULL
+func nullableJSON(data json.RawMessage) *string {
+	if len(data) == 0 {
+		return nil
+	}
+	s := string(data)
+	return &s
+}
+
+// QueueStats summarizes the events waiting in the event_log table
+type QueueStats struct {
+	// Pending is the number of events in the event log, including those waiting for a retry
+	Pending int64 `json:"pending"`
+	// Due is the number of events ready to be processed now
+	Due int64 `json:"due"`
+	// Retrying is the number of events that have failed at least once
+	Retrying int64 `json:"retrying"`
+	// OldestLoggedAt is when the oldest pending event was logged, nil if the queue is empty
+	OldestLoggedAt *time.Time `json:"oldest_logged_at,omitempty"`
+}
+
+// GetQueueStats counts the events waiting in the event_log table
+func GetQueueStats(ctx context.Context, pool *pgxpool.Pool) (*QueueStats, error) {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.EventLogTableName)
+
+	query := fmt.Sprintf(`
+		SELECT count(*), count(*) FILTER (WHERE process_after < $1), count(*) FILTER (WHERE retries > 0), min(logged_at)
+		FROM %s
+	`, tableName)
+
+	var stats QueueStats
+	if err := pool.QueryRow(ctx, query, time.Now()).Scan(&stats.Pending, &stats.Due, &stats.Retrying, &stats.OldestLoggedAt); err != nil {
+		return nil, fmt.Errorf("failed to get queue stats: %w", err)
+	}
+	return &stats, nil
+}
+
+// ReplayDeadLetterFilter selects the dead-lettered events to replay. Empty fields match all events.
+type ReplayDeadLetterFilter struct {
+	EventIDs     []int64
+	RowTableName string
+}
+
+// ReplayDeadLetters moves dead-lettered events back into the event_log table so they are
+// processed again. Retries are reset, while destinations that already acknowledged an event
+// are kept so they don't receive it twice. It returns the number of replayed events.
+func ReplayDeadLetters(ctx context.Context, pool *pgxpool.Pool, filter ReplayDeadLetterFilter) (int64, error) {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	tableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.EventLogTableName)
+	deadLetterTableName := fmt.Sprintf("%s.%s", cfg.InternalSchemaName, cfg.DeadLetterTableName)
+
+	query := fmt.Sprintf(`
+		WITH replayed AS (
+			DELETE FROM %s
+			WHERE (cardinality($1::bigint[]) = 0 OR id = ANY($1))
+				AND ($2 = '' OR row_table_name = $2)
+			RETURNING id, event_type, row_table_name, logged_at, old_row, new_row, metadata, txid, tx_context, entity_key, delivered_to, retry_history
+		)
+		INSERT INTO %s (id, event_type, row_table_name, logged_at, old_row, new_row, metadata, txid, tx_context, entity_key, delivered_to, retry_history)
+		SELECT id, event_type, row_table_name, logged_at, old_row, new_row, metadata, txid, tx_context, entity_key, delivered_to, retry_history
+		FROM replayed
+	`, deadLetterTableName, tableName)
+
+	eventIDs := filter.EventIDs
+	if eventIDs == nil {
+		eventIDs = []int64{}
+	}
+
+	tag, err := pool.Exec(ctx, query, eventIDs, filter.RowTableName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay dead letter events: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
 // GetSchema retrieves the database schema using the provided SQL query
 func GetSchema(ctx context.Context, pool *pgxpool.Pool) (schemas.PostgresqlTableSchemaList, error) {
 	// Execute the query using the embedded SQL content
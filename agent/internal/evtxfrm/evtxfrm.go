@@ -1,9 +1,12 @@
 package evtxfrm
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"maps"
+	"math/big"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -15,6 +18,7 @@ import (
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 var (
@@ -42,12 +46,40 @@ var (
 	}
 )
 
-func ProcessEvent(dbEvent *eventmodels.DBEvent, cfg *config.EventStreamingConfig, pbPkgName *string, pbFd protoreflect.FileDescriptor) (*eventmodels.ProcessedEvent, error) {
+// SkipReason is why a change emitted no events
+type SkipReason string
+
+const (
+	// SkipReasonUntracked changes have no rules for their table and operation
+	SkipReasonUntracked SkipReason = "untracked"
+	// SkipReasonUnchanged updates didn't change the when_changed columns of any rule
+	SkipReasonUnchanged SkipReason = "unchanged"
+	// SkipReasonCondition changes had every rule's cond return null or false
+	SkipReasonCondition SkipReason = "condition"
+)
+
+// ProcessEvent evaluates every rule tracking the change and returns the events they emit,
+// in the order of the rules. If there are none, it returns why the change was skipped.
+func ProcessEvent(dbEvent *eventmodels.DBEvent, cfg *config.EventStreamingConfig, pbPkgName *string, pbFd protoreflect.FileDescriptor) ([]*eventmodels.ProcessedEvent, SkipReason, error) {
 	// Create the key for looking up tracking config
 	key := fmt.Sprintf("%s.%s", dbEvent.RowTableName, dbEvent.EventType)
-	trackingConfig, exists := cfg.Track[key]
+	rules, exists := cfg.Track[key]
 	if !exists {
-		return nil, nil // No tracking config for this event
+		return nil, SkipReasonUntracked, nil
+	}
+
+	// when_changed is checked before the rows are decoded, so updates that only touched
+	// other columns never reach CEL
+	var changed []string
+	if dbEvent.EventType == "update" {
+		var err error
+		changed, err = changedColumns(dbEvent.OldRow, dbEvent.NewRow)
+		if err != nil {
+			return nil, "", err
+		}
+		if !slices.ContainsFunc(rules, func(rule config.EventConfigUnmarshaler) bool { return rule.MatchesChanges(changed) }) {
+			return nil, SkipReasonUnchanged, nil
+		}
 	}
 
 	// Parse JSON data and convert to protobuf
@@ -59,11 +91,11 @@ func ProcessEvent(dbEvent *eventmodels.DBEvent, cfg *config.EventStreamingConfig
 			var err error
 			newPb, err = marshalToProtobuf(dbEvent.NewRow, dbEvent.RowTableName, pbFd)
 			if err != nil {
-				return nil, fmt.Errorf("failed to marshal new row to protobuf: %w", err)
+				return nil, "", fmt.Errorf("failed to marshal new row to protobuf: %w", err)
 			}
 		} else {
 			if err := json.Unmarshal(dbEvent.NewRow, &newData); err != nil {
-				return nil, fmt.Errorf("failed to parse new row data: %w", err)
+				return nil, "", fmt.Errorf("failed to parse new row data: %w", err)
 			}
 		}
 	}
@@ -73,11 +105,11 @@ func ProcessEvent(dbEvent *eventmodels.DBEvent, cfg *config.EventStreamingConfig
 			var err error
 			oldPb, err = marshalToProtobuf(dbEvent.OldRow, dbEvent.RowTableName, pbFd)
 			if err != nil {
-				return nil, fmt.Errorf("failed to marshal old row to protobuf: %w", err)
+				return nil, "", fmt.Errorf("failed to marshal old row to protobuf: %w", err)
 			}
 		} else {
 			if err := json.Unmarshal(dbEvent.OldRow, &oldData); err != nil {
-				return nil, fmt.Errorf("failed to parse old row data: %w", err)
+				return nil, "", fmt.Errorf("failed to parse old row data: %w", err)
 			}
 		}
 	}
@@ -90,8 +122,22 @@ func ProcessEvent(dbEvent *eventmodels.DBEvent, cfg *config.EventStreamingConfig
 		tableNamePb = oldPb
 	}
 
+	metadata, err := parseMetadata(dbEvent.Metadata)
+	if err != nil {
+		return nil, "", err
+	}
+	txContext, err := parseTxContext(dbEvent.TxContext)
+	if err != nil {
+		return nil, "", err
+	}
+
 	// Create input map for CEL evaluation
 	input := make(map[string]interface{})
+	input["meta"] = metadata
+	input["tx"] = celutils.NewTxContextPb(dbEvent.TxID, txContext)
+	if dbEvent.EventType == "update" {
+		input["changed_columns"] = changed
+	}
 	if pbPkgName != nil && pbFd != nil {
 		input[dbEvent.RowTableName] = tableNamePb
 		if newPb != nil {
@@ -110,57 +156,188 @@ func ProcessEvent(dbEvent *eventmodels.DBEvent, cfg *config.EventStreamingConfig
 		}
 	}
 
-	// TODO Implement conditional protobufs
-	// TODO Implement properties protobufs
-	switch ec := trackingConfig.EventConfig.(type) {
-	case *config.SimpleEvent:
-		// For simple events, just evaluate the properties
-		properties, err := evaluateProperties(ec.CompiledProperties, input)
+	var processedEvents []*eventmodels.ProcessedEvent
+	for i, rule := range rules {
+		if !rule.MatchesChanges(changed) {
+			continue
+		}
+		name, properties, err := evaluateEvent(rule.EventConfig, input)
 		if err != nil {
-			return nil, fmt.Errorf("failed to evaluate properties: %w", err)
+			if len(rules) > 1 {
+				return nil, "", fmt.Errorf("rule %d: %w", i, err)
+			}
+			return nil, "", err
 		}
+		if name == "" {
+			continue
+		}
+		addTxContextProperties(properties, dbEvent.TxID, txContext)
 
-		return &eventmodels.ProcessedEvent{
+		processedEvents = append(processedEvents, &eventmodels.ProcessedEvent{
 			DBEventID:    dbEvent.ID,
 			DBEventIDStr: strconv.FormatInt(dbEvent.ID, 10),
-			Name:         ec.Event,
+			ID:           eventmodels.ProcessedEventID(dbEvent.ID, name, len(rules)),
+			Key:          name,
+			Name:         name,
 			Properties:   properties,
 			Timestamp:    dbEvent.LoggedAt,
 			DistinctId:   pluckDistinctIdFromPropertiesIfExists(dbEvent.RowTableName, properties),
-		}, nil
+			Metadata:     dbEvent.Metadata,
+		})
+	}
+	if len(processedEvents) == 0 {
+		return nil, SkipReasonCondition, nil
+	}
+	return processedEvents, "", nil
+}
+
+// ProcessTransaction evaluates the transaction rules against the changes one transaction
+// made, ordered by ID. The events have their own IDs, see eventmodels.TransactionEventID, and
+// are recorded on the first change, which carries the transaction's metadata and context.
+func ProcessTransaction(dbEvents []*eventmodels.DBEvent, cfg *config.EventStreamingConfig) ([]*eventmodels.ProcessedEvent, error) {
+	rules := cfg.Track.TransactionRules()
+	if len(rules) == 0 || len(dbEvents) == 0 {
+		return nil, nil
+	}
+	first := dbEvents[0]
+
+	metadata, err := parseMetadata(first.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	txContext, err := parseTxContext(first.TxContext)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]interface{}, 0, len(dbEvents))
+	for _, dbEvent := range dbEvents {
+		change := map[string]interface{}{
+			"table": dbEvent.RowTableName,
+			"op":    string(dbEvent.EventType),
+		}
+		for key, row := range map[string][]byte{"new": dbEvent.NewRow, "old": dbEvent.OldRow} {
+			if len(row) == 0 {
+				continue
+			}
+			var data map[string]interface{}
+			if err := json.Unmarshal(row, &data); err != nil {
+				return nil, fmt.Errorf("failed to parse %s row data of event %d: %w", key, dbEvent.ID, err)
+			}
+			change[key] = data
+		}
+		changes = append(changes, change)
+	}
+
+	input := map[string]interface{}{
+		"meta":    metadata,
+		"tx":      celutils.NewTxContextPb(first.TxID, txContext),
+		"changes": changes,
+	}
+
+	var processedEvents []*eventmodels.ProcessedEvent
+	for _, key := range rules {
+		ruleName := strings.TrimPrefix(key, celutils.TransactionRuleTable+".")
+		for i, rule := range cfg.Track[key] {
+			name, properties, err := evaluateEvent(rule.EventConfig, input)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d]: %w", key, i, err)
+			}
+			if name == "" {
+				continue
+			}
+			addTxContextProperties(properties, first.TxID, txContext)
+
+			processedEvents = append(processedEvents, &eventmodels.ProcessedEvent{
+				DBEventID:    first.ID,
+				DBEventIDStr: strconv.FormatInt(first.ID, 10),
+				ID:           eventmodels.TransactionEventID(*first.TxID, ruleName, name, len(cfg.Track[key])),
+				Key:          eventmodels.TransactionEventKey(ruleName, name),
+				Name:         name,
+				Properties:   properties,
+				Timestamp:    first.LoggedAt,
+				DistinctId:   pluckDistinctIdFromPropertiesIfExists("", properties),
+				Metadata:     first.Metadata,
+			})
+		}
+	}
+	return processedEvents, nil
+}
+
+// evaluateEvent returns the name and properties of the event the config emits for the
+// input, the name is empty when a condition selected no event
+func evaluateEvent(eventConfig config.EventConfig, input map[string]interface{}) (string, map[string]interface{}, error) {
+	// TODO Implement conditional protobufs
+	// TODO Implement properties protobufs
+	switch ec := eventConfig.(type) {
+	case *config.SimpleEvent:
+		if ec.CompiledCond != nil {
+			emit, err := evaluateBoolCondition(ec.CompiledCond, input)
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to evaluate condition: %w", err)
+			}
+			if !emit {
+				return "", nil, nil
+			}
+		}
+
+		// For simple events, just evaluate the properties
+		properties, err := evaluateProperties(ec.CompiledProperties, input)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to evaluate properties: %w", err)
+		}
+		return ec.Event, properties, nil
 	case *config.ConditionalEvent:
 		// First evaluate the condition
 		selectedEventName, err := evaluateCondition(ec.CompiledCond, input, ec.CondEventsPbFd, ec.GetEventNames())
 		if err != nil {
-			return nil, fmt.Errorf("failed to evaluate condition: %w", err)
+			return "", nil, fmt.Errorf("failed to evaluate condition: %w", err)
 		}
 
 		if selectedEventName == nil {
-			return nil, nil // No event selected, skip this event
+			return "", nil, nil // No event selected, skip this event
 		}
 
 		// Find the matching event based on the condition
 		eventProperties, exists := ec.CompiledEvents[*selectedEventName]
 		if !exists {
-			return nil, fmt.Errorf("selected event %s not found in event configuration", *selectedEventName)
+			return "", nil, fmt.Errorf("selected event %s not found in event configuration", *selectedEventName)
 		}
 
 		properties, err := evaluateProperties(eventProperties, input)
 		if err != nil {
-			return nil, fmt.Errorf("failed to evaluate properties for conditional event %s: %w", *selectedEventName, err)
+			return "", nil, fmt.Errorf("failed to evaluate properties for conditional event %s: %w", *selectedEventName, err)
 		}
+		return *selectedEventName, properties, nil
+	}
 
-		return &eventmodels.ProcessedEvent{
-			DBEventID:    dbEvent.ID,
-			DBEventIDStr: strconv.FormatInt(dbEvent.ID, 10),
-			Name:         *selectedEventName,
-			Properties:   properties,
-			Timestamp:    dbEvent.LoggedAt,
-			DistinctId:   pluckDistinctIdFromPropertiesIfExists(dbEvent.RowTableName, properties),
-		}, nil
+	return "", nil, nil
+}
+
+// parseMetadata parses the session metadata, events logged without it get an empty map so
+// `has(meta.x)` works
+func parseMetadata(raw json.RawMessage) (map[string]interface{}, error) {
+	metadata := map[string]interface{}{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to parse metadata: %w", err)
+		}
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+		}
 	}
+	return metadata, nil
+}
 
-	return nil, nil
+// parseTxContext parses the transaction context, nil when it wasn't recorded
+func parseTxContext(raw json.RawMessage) (*eventmodels.TxContext, error) {
+	var txContext *eventmodels.TxContext
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &txContext); err != nil {
+			return nil, fmt.Errorf("failed to parse transaction context: %w", err)
+		}
+	}
+	return txContext, nil
 }
 
 // castValueToString converts various numeric and string types to a string pointer
@@ -188,6 +365,31 @@ func castValueToString(val interface{}) *string {
 	}
 }
 
+// addTxContextProperties adds the transaction context recorded by the trigger as standard
+// properties, the settings under their own names. Properties set by the config take precedence.
+func addTxContextProperties(properties map[string]interface{}, txID *int64, txContext *eventmodels.TxContext) {
+	standard := map[string]interface{}{}
+	if txID != nil {
+		standard["txid"] = *txID
+	}
+	if txContext != nil {
+		if txContext.ApplicationName != "" {
+			standard["application_name"] = txContext.ApplicationName
+		}
+		standard["current_user"] = txContext.CurrentUser
+		standard["session_user"] = txContext.SessionUser
+		for name, value := range txContext.Settings {
+			standard[name] = value
+		}
+	}
+
+	for key, value := range standard {
+		if _, exists := properties[key]; !exists {
+			properties[key] = value
+		}
+	}
+}
+
 func pluckDistinctIdFromPropertiesIfExists(tableName string, properties map[string]interface{}) *string {
 	if len(properties) == 0 {
 		return nil
@@ -252,6 +454,120 @@ func evaluateCondition(prg cel.Program, input map[string]interface{}, eventPbFd
 	return nil, fmt.Errorf("event condition must return a valid event reference or null, got %v", out.Type().TypeName())
 }
 
+// changedColumns returns the columns whose values differ between the old and new row,
+// sorted by name. Values are compared decoded, see jsonValuesEqual. A column missing from
+// either row counts as changed, so every column changed when the old row wasn't recorded.
+func changedColumns(oldRow, newRow json.RawMessage) ([]string, error) {
+	var oldValues, newValues map[string]json.RawMessage
+	if len(oldRow) > 0 {
+		if err := json.Unmarshal(oldRow, &oldValues); err != nil {
+			return nil, fmt.Errorf("failed to parse old row data: %w", err)
+		}
+	}
+	if len(newRow) > 0 {
+		if err := json.Unmarshal(newRow, &newValues); err != nil {
+			return nil, fmt.Errorf("failed to parse new row data: %w", err)
+		}
+	}
+
+	changed := []string{}
+	for column, newValue := range newValues {
+		if oldValue, ok := oldValues[column]; !ok || !jsonValuesEqual(oldValue, newValue) {
+			changed = append(changed, column)
+		}
+	}
+	for column := range oldValues {
+		if _, ok := newValues[column]; !ok {
+			changed = append(changed, column)
+		}
+	}
+	slices.Sort(changed)
+	return changed, nil
+}
+
+// jsonValuesEqual reports whether two JSON values are equal once decoded, so 1.0 equals 1 and
+// objects are equal whatever the order of their keys, as jsonb reorders them. Numbers are
+// compared exactly, so large bigints don't lose precision.
+func jsonValuesEqual(a, b json.RawMessage) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	aValue, aErr := decodeJSONValue(a)
+	bValue, bErr := decodeJSONValue(b)
+	if aErr != nil || bErr != nil {
+		return false
+	}
+	return decodedValuesEqual(aValue, bValue)
+}
+
+// decodeJSONValue decodes a JSON value keeping numbers as json.Number
+func decodeJSONValue(data json.RawMessage) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// decodedValuesEqual compares values decoded by decodeJSONValue
+func decodedValuesEqual(a, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		aRat, aOk := new(big.Rat).SetString(a.String())
+		bRat, bOk := new(big.Rat).SetString(b.String())
+		if !aOk || !bOk {
+			return a == b
+		}
+		return aRat.Cmp(bRat) == 0
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, aValue := range a {
+			bValue, ok := b[key]
+			if !ok || !decodedValuesEqual(aValue, bValue) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !decodedValuesEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+// evaluateBoolCondition returns whether a simple event's condition holds, null counts as false
+func evaluateBoolCondition(prg cel.Program, input map[string]interface{}) (bool, error) {
+	out, _, err := prg.Eval(input)
+	if err != nil {
+		return false, err
+	}
+	switch v := out.Value().(type) {
+	case bool:
+		return v, nil
+	case structpb.NullValue:
+		return false, nil
+	}
+	return false, fmt.Errorf("condition must return a bool, got %v", out.Type().TypeName())
+}
+
 func evaluateProperties(compiledProps map[string]cel.Program, input map[string]interface{}) (map[string]interface{}, error) {
 	properties := make(map[string]interface{})
 	for key, prg := range compiledProps {
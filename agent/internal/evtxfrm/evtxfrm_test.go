@@ -0,0 +1,299 @@
+package evtxfrm
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+func TestChangedColumns(t *testing.T) {
+	tests := []struct {
+		name   string
+		oldRow string
+		newRow string
+		want   []string
+	}{
+		{
+			name:   "changed values",
+			oldRow: `{"id": 1, "email": "a@example.com", "plan": "free"}`,
+			newRow: `{"id": 1, "email": "b@example.com", "plan": "pro"}`,
+			want:   []string{"email", "plan"},
+		},
+		{
+			name:   "nothing changed",
+			oldRow: `{"id": 1, "email": "a@example.com"}`,
+			newRow: `{"id": 1, "email": "a@example.com"}`,
+			want:   []string{},
+		},
+		{
+			name:   "numbers compare by value",
+			oldRow: `{"price": 1.0, "count": 100, "ratio": 0.5}`,
+			newRow: `{"price": 1, "count": 1e2, "ratio": 0.50}`,
+			want:   []string{},
+		},
+		{
+			name:   "large integers keep their precision",
+			oldRow: `{"id": 9007199254740993}`,
+			newRow: `{"id": 9007199254740992}`,
+			want:   []string{"id"},
+		},
+		{
+			name:   "jsonb key order is ignored",
+			oldRow: `{"settings": {"theme": "dark", "tags": ["a", "b"]}}`,
+			newRow: `{"settings": {"tags": ["a", "b"], "theme": "dark"}}`,
+			want:   []string{},
+		},
+		{
+			name:   "nested changes",
+			oldRow: `{"settings": {"theme": "dark", "tags": ["a", "b"]}}`,
+			newRow: `{"settings": {"theme": "dark", "tags": ["b", "a"]}}`,
+			want:   []string{"settings"},
+		},
+		{
+			name:   "null and type changes",
+			oldRow: `{"deleted_at": null, "code": "1"}`,
+			newRow: `{"deleted_at": "2024-01-01T00:00:00Z", "code": 1}`,
+			want:   []string{"code", "deleted_at"},
+		},
+		{
+			name:   "missing columns count as changed",
+			oldRow: `{"id": 1, "removed": true}`,
+			newRow: `{"id": 1, "added": true}`,
+			want:   []string{"added", "removed"},
+		},
+		{
+			name:   "every column changed without an old row",
+			newRow: `{"id": 1, "email": "a@example.com"}`,
+			want:   []string{"email", "id"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var oldRow, newRow json.RawMessage
+			if tt.oldRow != "" {
+				oldRow = json.RawMessage(tt.oldRow)
+			}
+			if tt.newRow != "" {
+				newRow = json.RawMessage(tt.newRow)
+			}
+			got, err := changedColumns(oldRow, newRow)
+			if err != nil {
+				t.Fatalf("changedColumns() error = %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("changedColumns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangedColumnsInvalidRow(t *testing.T) {
+	if _, err := changedColumns(json.RawMessage(`{"id": 1}`), json.RawMessage(`{`)); err == nil {
+		t.Error("changedColumns() error = nil, want an error for an invalid row")
+	}
+}
+
+func TestProcessEventWhenChanged(t *testing.T) {
+	cfg, err := config.ParseEventStreamingConfigBytes([]byte(`
+track:
+  users.update:
+    - event: USER_UPDATED
+      when_changed: [email, plan]
+      properties:
+        changed: changed_columns
+    - cond: 'changed("plan") ? events.PLAN_CHANGED : null'
+      when_changed: [plan]
+      PLAN_CHANGED:
+        plan: new.plan
+`))
+	if err != nil {
+		t.Fatalf("ParseEventStreamingConfigBytes() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		oldRow    string
+		newRow    string
+		wantNames []string
+		wantIDs   []string
+		wantSkip  SkipReason
+	}{
+		{
+			name:      "both rules match",
+			oldRow:    `{"id": 7, "email": "a@example.com", "plan": "free", "seen_at": 1}`,
+			newRow:    `{"id": 7, "email": "a@example.com", "plan": "pro", "seen_at": 2}`,
+			wantNames: []string{"USER_UPDATED", "PLAN_CHANGED"},
+			wantIDs:   []string{"42:USER_UPDATED", "42:PLAN_CHANGED"},
+		},
+		{
+			name:      "only the first rule matches",
+			oldRow:    `{"id": 7, "email": "a@example.com", "plan": "free"}`,
+			newRow:    `{"id": 7, "email": "b@example.com", "plan": "free"}`,
+			wantNames: []string{"USER_UPDATED"},
+			wantIDs:   []string{"42:USER_UPDATED"},
+		},
+		{
+			name:     "other columns changed",
+			oldRow:   `{"id": 7, "email": "a@example.com", "plan": "free", "seen_at": 1}`,
+			newRow:   `{"id": 7, "email": "a@example.com", "plan": "free", "seen_at": 2}`,
+			wantSkip: SkipReasonUnchanged,
+		},
+		{
+			name:     "numbers written differently",
+			oldRow:   `{"id": 7, "email": "a@example.com", "plan": 1.0}`,
+			newRow:   `{"id": 7, "email": "a@example.com", "plan": 1}`,
+			wantSkip: SkipReasonUnchanged,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbEvent := &eventmodels.DBEvent{
+				ID:           42,
+				EventType:    eventmodels.EventTypeUpdate,
+				RowTableName: "users",
+				OldRow:       json.RawMessage(tt.oldRow),
+				NewRow:       json.RawMessage(tt.newRow),
+			}
+			events, skipReason, err := ProcessEvent(dbEvent, cfg, nil, nil)
+			if err != nil {
+				t.Fatalf("ProcessEvent() error = %v", err)
+			}
+			if skipReason != tt.wantSkip {
+				t.Errorf("ProcessEvent() skip reason = %q, want %q", skipReason, tt.wantSkip)
+			}
+			var names, ids []string
+			for _, event := range events {
+				names = append(names, event.Name)
+				ids = append(ids, event.ID)
+				if event.DBEventID != 42 {
+					t.Errorf("event %s DBEventID = %d, want 42", event.Name, event.DBEventID)
+				}
+			}
+			if !slices.Equal(names, tt.wantNames) || !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("ProcessEvent() = %v %v, want %v %v", names, ids, tt.wantNames, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestProcessEventChangedColumnsProperty(t *testing.T) {
+	cfg, err := config.ParseEventStreamingConfigBytes([]byte(`
+track:
+  users.update:
+    event: USER_UPDATED
+    properties:
+      changed: changed_columns
+`))
+	if err != nil {
+		t.Fatalf("ParseEventStreamingConfigBytes() error = %v", err)
+	}
+	dbEvent := &eventmodels.DBEvent{
+		ID:           42,
+		EventType:    eventmodels.EventTypeUpdate,
+		RowTableName: "users",
+		OldRow:       json.RawMessage(`{"id": 7, "email": "a@example.com", "plan": "free"}`),
+		NewRow:       json.RawMessage(`{"id": 7, "email": "b@example.com", "plan": "pro"}`),
+	}
+	events, _, err := ProcessEvent(dbEvent, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("ProcessEvent() error = %v", err)
+	}
+	if len(events) != 1 || events[0].ID != "42" {
+		t.Fatalf("ProcessEvent() = %v, want one event with ID 42", events)
+	}
+	changed, err := json.Marshal(events[0].Properties["changed"])
+	if err != nil {
+		t.Fatalf("failed to marshal changed: %v", err)
+	}
+	if string(changed) != `["email","plan"]` {
+		t.Errorf("changed = %s, want [\"email\",\"plan\"]", changed)
+	}
+}
+
+func TestProcessTransaction(t *testing.T) {
+	cfg, err := config.ParseEventStreamingConfigBytes([]byte(`
+track:
+  tx.order_placed:
+    cond: 'changes.exists(c, c.table == "orders" && c.op == "insert") ? events.ORDER_PLACED : null'
+    ORDER_PLACED:
+      lines: changes.filter(c, c.table == "order_lines").size()
+`))
+	if err != nil {
+		t.Fatalf("ParseEventStreamingConfigBytes() error = %v", err)
+	}
+	txID := int64(900)
+	dbEvents := []*eventmodels.DBEvent{
+		{ID: 10, EventType: eventmodels.EventTypeInsert, RowTableName: "orders", NewRow: json.RawMessage(`{"id": 1}`), TxID: &txID},
+		{ID: 11, EventType: eventmodels.EventTypeInsert, RowTableName: "order_lines", NewRow: json.RawMessage(`{"id": 1}`), TxID: &txID},
+		{ID: 12, EventType: eventmodels.EventTypeInsert, RowTableName: "order_lines", NewRow: json.RawMessage(`{"id": 2}`), TxID: &txID},
+	}
+
+	events, err := ProcessTransaction(dbEvents, cfg)
+	if err != nil {
+		t.Fatalf("ProcessTransaction() error = %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("ProcessTransaction() returned %d events, want 1", len(events))
+	}
+	event := events[0]
+	if event.Name != "ORDER_PLACED" || event.ID != "tx:900:order_placed" || event.DBEventID != 10 {
+		t.Errorf("event = %s %s on %d, want ORDER_PLACED tx:900:order_placed on 10", event.Name, event.ID, event.DBEventID)
+	}
+	if want := "tx:order_placed:ORDER_PLACED"; event.Key != want {
+		t.Errorf("event key = %s, want %s", event.Key, want)
+	}
+	if lines, ok := event.Properties["lines"].(int64); !ok || lines != 2 {
+		t.Errorf("lines = %v (%T), want 2", event.Properties["lines"], event.Properties["lines"])
+	}
+}
+
+func TestProcessEventSkipReasons(t *testing.T) {
+	cfg, err := config.ParseEventStreamingConfigBytes([]byte(`
+track:
+  users.insert:
+    event: USER_SIGNUP
+    cond: new.verified
+`))
+	if err != nil {
+		t.Fatalf("ParseEventStreamingConfigBytes() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		event *eventmodels.DBEvent
+		want  SkipReason
+	}{
+		{
+			name:  "no rules for the table",
+			event: &eventmodels.DBEvent{ID: 1, EventType: eventmodels.EventTypeInsert, RowTableName: "orders", NewRow: json.RawMessage(`{"id": 1}`)},
+			want:  SkipReasonUntracked,
+		},
+		{
+			name:  "no rules for the operation",
+			event: &eventmodels.DBEvent{ID: 2, EventType: eventmodels.EventTypeDelete, RowTableName: "users", OldRow: json.RawMessage(`{"id": 1}`)},
+			want:  SkipReasonUntracked,
+		},
+		{
+			name:  "cond is false",
+			event: &eventmodels.DBEvent{ID: 3, EventType: eventmodels.EventTypeInsert, RowTableName: "users", NewRow: json.RawMessage(`{"id": 1, "verified": false}`)},
+			want:  SkipReasonCondition,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, skipReason, err := ProcessEvent(tt.event, cfg, nil, nil)
+			if err != nil {
+				t.Fatalf("ProcessEvent() error = %v", err)
+			}
+			if len(events) != 0 || skipReason != tt.want {
+				t.Errorf("ProcessEvent() = %v, %q, want no events, %q", events, skipReason, tt.want)
+			}
+		})
+	}
+}
@@ -1,15 +1,143 @@
 package logger
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"math/rand/v2"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/typeeng/pg_track_events/agent/internal/env"
+)
+
+const (
+	// text or json
+	logFormatEnvKey  = "LOG_FORMAT"
+	defaultLogFormat = "text"
+
+	// debug, info, warn or error
+	logLevelEnvKey  = "LOG_LEVEL"
+	defaultLogLevel = slog.LevelInfo
+
+	// Fraction of per-event log lines to keep, between 0 and 1
+	logEventSampleRateEnvKey  = "LOG_EVENT_SAMPLE_RATE"
+	defaultLogEventSampleRate = 1.0
 )
 
-var logger *slog.Logger
+var (
+	once        sync.Once
+	logger      *slog.Logger
+	eventLogger *slog.Logger
+)
 
+// Logger returns the logger configured by LOG_FORMAT and LOG_LEVEL. It is also installed as
+// the slog and log package default so output from other packages goes through it.
 func Logger() *slog.Logger {
-	if logger == nil {
-		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
-	}
+	once.Do(setup)
 	return logger
 }
+
+// EventLogger returns the logger for lines logged once per event. Below warn level only a
+// LOG_EVENT_SAMPLE_RATE fraction of them are kept so high volumes don't flood the logs.
+func EventLogger() *slog.Logger {
+	once.Do(setup)
+	return eventLogger
+}
+
+// Validate checks LOG_FORMAT, LOG_LEVEL and LOG_EVENT_SAMPLE_RATE. LoadAgentConfig calls it so
+// a bad value fails startup, the loggers themselves fall back to the defaults.
+func Validate() error {
+	_, err := loadSettings()
+	return err
+}
+
+type settings struct {
+	format     string
+	level      slog.Level
+	sampleRate float64
+}
+
+// loadSettings reads the logging env vars. Invalid values are reported in the error and left
+// at their default in the returned settings.
+func loadSettings() (settings, error) {
+	s := settings{format: defaultLogFormat, level: defaultLogLevel, sampleRate: defaultLogEventSampleRate}
+	var errs []error
+
+	if formatStr := env.First(logFormatEnvKey); formatStr != "" {
+		switch format := strings.ToLower(strings.TrimSpace(formatStr)); format {
+		case "text", "json":
+			s.format = format
+		default:
+			errs = append(errs, fmt.Errorf("%s must be text or json, got %q", logFormatEnvKey, formatStr))
+		}
+	}
+
+	if levelStr := env.First(logLevelEnvKey); levelStr != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(levelStr))); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %w", logLevelEnvKey, levelStr, err))
+		} else {
+			s.level = level
+		}
+	}
+
+	if rateStr := env.First(logEventSampleRateEnvKey); rateStr != "" {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			errs = append(errs, fmt.Errorf("%s must be a number between 0 and 1, got %q", logEventSampleRateEnvKey, rateStr))
+		} else {
+			s.sampleRate = rate
+		}
+	}
+
+	return s, errors.Join(errs...)
+}
+
+func setup() {
+	s, err := loadSettings()
+	handler := newHandler(os.Stdout, s)
+	logger = slog.New(handler)
+	slog.SetDefault(logger)
+	if err != nil {
+		logger.Warn("invalid logging config, using the defaults for it", "error", err)
+	}
+
+	eventLogger = logger
+	if s.sampleRate < 1 {
+		eventLogger = slog.New(&samplingHandler{Handler: handler, rate: s.sampleRate})
+	}
+}
+
+func newHandler(w io.Writer, s settings) slog.Handler {
+	opts := &slog.HandlerOptions{Level: s.level}
+	if s.format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// samplingHandler drops all but a rate fraction of the records below warn level
+type samplingHandler struct {
+	slog.Handler
+	rate float64
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelWarn && rand.Float64() >= h.rate {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), rate: h.rate}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), rate: h.rate}
+}
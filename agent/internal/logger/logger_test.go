@@ -0,0 +1,64 @@
+package logger
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestLoadSettings(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		level      string
+		sampleRate string
+		want       settings
+		wantErr    bool
+	}{
+		{
+			name: "defaults",
+			want: settings{format: "text", level: slog.LevelInfo, sampleRate: 1},
+		},
+		{
+			name:       "all set",
+			format:     " JSON ",
+			level:      "debug",
+			sampleRate: "0.01",
+			want:       settings{format: "json", level: slog.LevelDebug, sampleRate: 0.01},
+		},
+		{
+			name:    "invalid format",
+			format:  "logfmt",
+			level:   "warn",
+			want:    settings{format: "text", level: slog.LevelWarn, sampleRate: 1},
+			wantErr: true,
+		},
+		{
+			name:    "invalid level",
+			level:   "verbose",
+			want:    settings{format: "text", level: slog.LevelInfo, sampleRate: 1},
+			wantErr: true,
+		},
+		{
+			name:       "sample rate out of range",
+			sampleRate: "2",
+			want:       settings{format: "text", level: slog.LevelInfo, sampleRate: 1},
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(logFormatEnvKey, tt.format)
+			t.Setenv(logLevelEnvKey, tt.level)
+			t.Setenv(logEventSampleRateEnvKey, tt.sampleRate)
+
+			got, err := loadSettings()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadSettings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("loadSettings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+)
+
+const namespace = "pg_track_events"
+
+// Registry holds the agent's metrics along with the Go runtime and process collectors
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var (
+	EventsFetched = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_fetched_total",
+		Help:      "DB events fetched from a source.",
+	}, []string{"source"})
+
+	EventsProcessed = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_processed_total",
+		Help:      "Processed events emitted by the tracking rules, including transaction rules. A DB event can emit several.",
+	})
+
+	EventsSkipped = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_skipped_total",
+		Help:      "DB events that emitted no processed event, by reason: untracked (no tracking config), unchanged (no when_changed column changed) or condition (every cond returned null or false).",
+	}, []string{"reason"})
+
+	TransformFailures = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transform_failures_total",
+		Help:      "DB events that failed to transform.",
+	})
+
+	EventsFailed = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_failed_total",
+		Help:      "DB events that failed delivery, by whether they were retried or dead-lettered.",
+	}, []string{"source", "outcome"})
+
+	BatchDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "batch_duration_seconds",
+		Help:      "Time to fetch, deliver and commit a batch.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"source"})
+
+	DestinationSends = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "destination_sends_total",
+		Help:      "SendBatch calls to a destination.",
+	}, []string{"destination"})
+
+	DestinationEvents = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "destination_events_total",
+		Help:      "Events sent to a destination, by whether they were delivered or failed.",
+	}, []string{"destination", "result"})
+
+	DestinationErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "destination_errors_total",
+		Help:      "Events a destination failed to deliver, by error kind.",
+	}, []string{"destination", "kind"})
+
+	DestinationSendDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "destination_send_duration_seconds",
+		Help:      "Latency of SendBatch calls to a destination.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"destination"})
+
+	ConfigReloads = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Reloads of the events config file, by whether they were applied or failed.",
+	}, []string{"result"})
+
+	SchemaReloads = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "schema_reloads_total",
+		Help:      "Times the events config was recompiled after the database schema changed.",
+	})
+)
+
+// queueStatsTimeout bounds the query run on each scrape
+const queueStatsTimeout = 5 * time.Second
+
+// queueCollector reports the event log depth, queried when the metrics are scraped
+type queueCollector struct {
+	stats func(ctx context.Context) (*db.QueueStats, error)
+
+	pending   *prometheus.Desc
+	due       *prometheus.Desc
+	retrying  *prometheus.Desc
+	oldestAge *prometheus.Desc
+	up        *prometheus.Desc
+}
+
+// RegisterQueueCollector reports the event log depth and oldest pending event using stats.
+// Only the first collector registered is kept, later calls are no-ops.
+func RegisterQueueCollector(stats func(ctx context.Context) (*db.QueueStats, error)) {
+	queueCollectorOnce.Do(func() {
+		Registry.MustRegister(newQueueCollector(stats))
+	})
+}
+
+var queueCollectorOnce sync.Once
+
+func newQueueCollector(stats func(ctx context.Context) (*db.QueueStats, error)) *queueCollector {
+	return &queueCollector{
+		stats:     stats,
+		pending:   prometheus.NewDesc(namespace+"_queue_pending_events", "Events in the event log, including those waiting for a retry.", nil, nil),
+		due:       prometheus.NewDesc(namespace+"_queue_due_events", "Events in the event log ready to be processed.", nil, nil),
+		retrying:  prometheus.NewDesc(namespace+"_queue_retrying_events", "Events in the event log that have failed at least once.", nil, nil),
+		oldestAge: prometheus.NewDesc(namespace+"_queue_oldest_pending_age_seconds", "Age of the oldest event in the event log, 0 if it is empty.", nil, nil),
+		up:        prometheus.NewDesc(namespace+"_queue_stats_up", "Whether the event log could be queried.", nil, nil),
+	}
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.pending
+	ch <- c.due
+	ch <- c.retrying
+	ch <- c.oldestAge
+	ch <- c.up
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), queueStatsTimeout)
+	defer cancel()
+
+	stats, err := c.stats(ctx)
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return
+	}
+
+	var oldestAge float64
+	if stats.OldestLoggedAt != nil {
+		oldestAge = time.Since(*stats.OldestLoggedAt).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(stats.Pending))
+	ch <- prometheus.MustNewConstMetric(c.due, prometheus.GaugeValue, float64(stats.Due))
+	ch <- prometheus.MustNewConstMetric(c.retrying, prometheus.GaugeValue, float64(stats.Retrying))
+	ch <- prometheus.MustNewConstMetric(c.oldestAge, prometheus.GaugeValue, oldestAge)
+}
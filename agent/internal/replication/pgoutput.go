@@ -0,0 +1,228 @@
+package replication
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// pgoutput protocol version 1 message types, see
+// https://www.postgresql.org/docs/current/protocol-logicalrep-message-formats.html
+const (
+	messageBegin    = 'B'
+	messageCommit   = 'C'
+	messageOrigin   = 'O'
+	messageRelation = 'R'
+	messageType     = 'Y'
+	messageInsert   = 'I'
+	messageUpdate   = 'U'
+	messageDelete   = 'D'
+	messageTruncate = 'T'
+	messageLogical  = 'M'
+)
+
+// Tuple data column kinds
+const (
+	tupleNull      = 'n'
+	tupleUnchanged = 'u'
+	tupleText      = 't'
+)
+
+// postgresEpoch is the zero time of timestamps in the replication protocol
+var postgresEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type relationColumn struct {
+	name    string
+	typeOID uint32
+}
+
+type relation struct {
+	id        uint32
+	namespace string
+	name      string
+	columns   []relationColumn
+}
+
+// tupleColumn is a single column value in a tuple, value is in text format
+type tupleColumn struct {
+	kind  byte
+	value []byte
+}
+
+type beginMessage struct {
+	commitTime time.Time
+	xid        uint32
+}
+
+type commitMessage struct {
+	endLSN LSN
+}
+
+// changeMessage is an insert, update or delete. oldTuple is only set for updates and
+// deletes, and only contains the replica identity columns unless it is FULL.
+type changeMessage struct {
+	kind       byte
+	relationID uint32
+	oldTuple   []tupleColumn
+	newTuple   []tupleColumn
+}
+
+// decodeMessage decodes a single pgoutput message. It returns nil for messages we don't use.
+func decodeMessage(data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+	r := &messageReader{data: data[1:]}
+
+	var msg any
+	switch data[0] {
+	case messageBegin:
+		r.uint64() // final LSN of the transaction
+		msg = &beginMessage{commitTime: r.timestamp(), xid: r.uint32()}
+	case messageCommit:
+		r.uint8()  // flags
+		r.uint64() // commit LSN
+		msg = &commitMessage{endLSN: LSN(r.uint64())}
+	case messageRelation:
+		msg = r.relation()
+	case messageInsert:
+		change := &changeMessage{kind: messageInsert, relationID: r.uint32()}
+		if r.uint8() != 'N' {
+			return nil, fmt.Errorf("insert message is missing the new tuple")
+		}
+		change.newTuple = r.tuple()
+		msg = change
+	case messageUpdate:
+		change := &changeMessage{kind: messageUpdate, relationID: r.uint32()}
+		tupleKind := r.uint8()
+		if tupleKind == 'K' || tupleKind == 'O' {
+			change.oldTuple = r.tuple()
+			tupleKind = r.uint8()
+		}
+		if tupleKind != 'N' {
+			return nil, fmt.Errorf("update message is missing the new tuple")
+		}
+		change.newTuple = r.tuple()
+		msg = change
+	case messageDelete:
+		change := &changeMessage{kind: messageDelete, relationID: r.uint32()}
+		if tupleKind := r.uint8(); tupleKind != 'K' && tupleKind != 'O' {
+			return nil, fmt.Errorf("delete message is missing the old tuple")
+		}
+		change.oldTuple = r.tuple()
+		msg = change
+	case messageOrigin, messageType, messageTruncate, messageLogical:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown message type %q", data[0])
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to decode %q message: %w", data[0], r.err)
+	}
+	return msg, nil
+}
+
+// messageReader reads big endian values from a message, recording the first error
+type messageReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *messageReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = fmt.Errorf("message truncated at byte %d", r.pos)
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *messageReader) uint8() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *messageReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *messageReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *messageReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// timestamp reads microseconds since the Postgres epoch
+func (r *messageReader) timestamp() time.Time {
+	return postgresEpoch.Add(time.Duration(int64(r.uint64())) * time.Microsecond)
+}
+
+// string reads a null terminated string
+func (r *messageReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	for i := r.pos; i < len(r.data); i++ {
+		if r.data[i] == 0 {
+			s := string(r.data[r.pos:i])
+			r.pos = i + 1
+			return s
+		}
+	}
+	r.err = fmt.Errorf("unterminated string at byte %d", r.pos)
+	return ""
+}
+
+func (r *messageReader) relation() *relation {
+	rel := &relation{
+		id:        r.uint32(),
+		namespace: r.string(),
+		name:      r.string(),
+	}
+	r.uint8() // replica identity setting
+	numColumns := int(r.uint16())
+	rel.columns = make([]relationColumn, 0, numColumns)
+	for i := 0; i < numColumns && r.err == nil; i++ {
+		r.uint8() // flags, 1 marks the column as part of the key
+		column := relationColumn{name: r.string(), typeOID: r.uint32()}
+		r.uint32() // type modifier
+		rel.columns = append(rel.columns, column)
+	}
+	return rel
+}
+
+func (r *messageReader) tuple() []tupleColumn {
+	numColumns := int(r.uint16())
+	columns := make([]tupleColumn, 0, numColumns)
+	for i := 0; i < numColumns && r.err == nil; i++ {
+		column := tupleColumn{kind: r.uint8()}
+		switch column.kind {
+		case tupleNull, tupleUnchanged:
+		case tupleText:
+			column.value = r.next(int(r.uint32()))
+		default:
+			r.err = fmt.Errorf("unsupported tuple column kind %q", column.kind)
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
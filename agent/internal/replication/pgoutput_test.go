@@ -0,0 +1,411 @@
+package replication
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+// messageBuilder writes pgoutput messages the way Postgres sends them
+type messageBuilder struct {
+	data []byte
+}
+
+func newMessage(kind byte) *messageBuilder {
+	return &messageBuilder{data: []byte{kind}}
+}
+
+func (b *messageBuilder) uint8(v byte) *messageBuilder {
+	b.data = append(b.data, v)
+	return b
+}
+
+func (b *messageBuilder) uint16(v uint16) *messageBuilder {
+	b.data = binary.BigEndian.AppendUint16(b.data, v)
+	return b
+}
+
+func (b *messageBuilder) uint32(v uint32) *messageBuilder {
+	b.data = binary.BigEndian.AppendUint32(b.data, v)
+	return b
+}
+
+func (b *messageBuilder) uint64(v uint64) *messageBuilder {
+	b.data = binary.BigEndian.AppendUint64(b.data, v)
+	return b
+}
+
+func (b *messageBuilder) string(s string) *messageBuilder {
+	b.data = append(append(b.data, s...), 0)
+	return b
+}
+
+// tuple writes the columns, nil values are written as null
+func (b *messageBuilder) tuple(kind byte, values ...*string) *messageBuilder {
+	b.uint8(kind).uint16(uint16(len(values)))
+	for _, value := range values {
+		if value == nil {
+			b.uint8(tupleNull)
+			continue
+		}
+		b.uint8(tupleText).uint32(uint32(len(*value)))
+		b.data = append(b.data, *value...)
+	}
+	return b
+}
+
+// unchanged writes a tuple with an unchanged TOAST column after the values
+func (b *messageBuilder) unchanged(kind byte, values ...string) *messageBuilder {
+	b.uint8(kind).uint16(uint16(len(values) + 1))
+	for _, value := range values {
+		b.uint8(tupleText).uint32(uint32(len(value)))
+		b.data = append(b.data, value...)
+	}
+	return b.uint8(tupleUnchanged)
+}
+
+func text(s string) *string {
+	return &s
+}
+
+func relationMessage(id uint32, namespace, name string, columns ...relationColumn) []byte {
+	b := newMessage(messageRelation).uint32(id).string(namespace).string(name).uint8('d').uint16(uint16(len(columns)))
+	for _, column := range columns {
+		b.uint8(0).string(column.name).uint32(column.typeOID).uint32(0xFFFFFFFF)
+	}
+	return b.data
+}
+
+var usersColumns = []relationColumn{
+	{name: "id", typeOID: pgtype.Int8OID},
+	{name: "email", typeOID: pgtype.TextOID},
+	{name: "verified", typeOID: pgtype.BoolOID},
+	{name: "bio", typeOID: pgtype.TextOID},
+}
+
+func TestDecodeBeginAndCommit(t *testing.T) {
+	commitTime := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+	begin := newMessage(messageBegin).uint64(0x16B3748).uint64(uint64(commitTime.Sub(postgresEpoch).Microseconds())).uint32(742).data
+	msg, err := decodeMessage(begin)
+	if err != nil {
+		t.Fatalf("decodeMessage(begin) error = %v", err)
+	}
+	beginMsg, ok := msg.(*beginMessage)
+	if !ok {
+		t.Fatalf("decodeMessage(begin) = %T, want *beginMessage", msg)
+	}
+	if !beginMsg.commitTime.Equal(commitTime) || beginMsg.xid != 742 {
+		t.Errorf("begin = %+v, want commit time %s and xid 742", beginMsg, commitTime)
+	}
+
+	commit := newMessage(messageCommit).uint8(0).uint64(0x16B3748).uint64(0x16B3780).uint64(0).data
+	msg, err = decodeMessage(commit)
+	if err != nil {
+		t.Fatalf("decodeMessage(commit) error = %v", err)
+	}
+	if commitMsg, ok := msg.(*commitMessage); !ok || commitMsg.endLSN != 0x16B3780 {
+		t.Errorf("decodeMessage(commit) = %+v, want end LSN 0/16B3780", msg)
+	}
+}
+
+func TestDecodeRelation(t *testing.T) {
+	msg, err := decodeMessage(relationMessage(16384, "public", "users", usersColumns...))
+	if err != nil {
+		t.Fatalf("decodeMessage() error = %v", err)
+	}
+	rel, ok := msg.(*relation)
+	if !ok {
+		t.Fatalf("decodeMessage() = %T, want *relation", msg)
+	}
+	if rel.id != 16384 || rel.namespace != "public" || rel.name != "users" {
+		t.Errorf("relation = %d %s.%s, want 16384 public.users", rel.id, rel.namespace, rel.name)
+	}
+	if len(rel.columns) != len(usersColumns) {
+		t.Fatalf("relation has %d columns, want %d", len(rel.columns), len(usersColumns))
+	}
+	for i, column := range usersColumns {
+		if rel.columns[i] != column {
+			t.Errorf("column %d = %+v, want %+v", i, rel.columns[i], column)
+		}
+	}
+}
+
+func TestDecodeChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    byte
+		wantOld int
+		wantNew int
+	}{
+		{
+			name:    "insert",
+			data:    newMessage(messageInsert).uint32(16384).tuple('N', text("1"), text("a@example.com"), text("t"), nil).data,
+			want:    messageInsert,
+			wantNew: 4,
+		},
+		{
+			name:    "update without the old row",
+			data:    newMessage(messageUpdate).uint32(16384).tuple('N', text("1"), text("b@example.com"), text("t"), nil).data,
+			want:    messageUpdate,
+			wantNew: 4,
+		},
+		{
+			name:    "update with the full old row",
+			data:    newMessage(messageUpdate).uint32(16384).tuple('O', text("1"), text("a@example.com"), text("f"), nil).tuple('N', text("1"), text("a@example.com"), text("t"), nil).data,
+			want:    messageUpdate,
+			wantOld: 4,
+			wantNew: 4,
+		},
+		{
+			name:    "update with a changed key",
+			data:    newMessage(messageUpdate).uint32(16384).tuple('K', text("1")).tuple('N', text("2"), text("a@example.com"), text("t"), nil).data,
+			want:    messageUpdate,
+			wantOld: 1,
+			wantNew: 4,
+		},
+		{
+			name:    "delete",
+			data:    newMessage(messageDelete).uint32(16384).tuple('K', text("1")).data,
+			want:    messageDelete,
+			wantOld: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := decodeMessage(tt.data)
+			if err != nil {
+				t.Fatalf("decodeMessage() error = %v", err)
+			}
+			change, ok := msg.(*changeMessage)
+			if !ok {
+				t.Fatalf("decodeMessage() = %T, want *changeMessage", msg)
+			}
+			if change.kind != tt.want || change.relationID != 16384 {
+				t.Errorf("change = %q on %d, want %q on 16384", change.kind, change.relationID, tt.want)
+			}
+			if len(change.oldTuple) != tt.wantOld || len(change.newTuple) != tt.wantNew {
+				t.Errorf("change has %d old and %d new columns, want %d and %d", len(change.oldTuple), len(change.newTuple), tt.wantOld, tt.wantNew)
+			}
+		})
+	}
+}
+
+func TestDecodeTupleColumns(t *testing.T) {
+	msg, err := decodeMessage(newMessage(messageInsert).uint32(1).tuple('N', text("1"), nil, text("")).data)
+	if err != nil {
+		t.Fatalf("decodeMessage() error = %v", err)
+	}
+	tuple := msg.(*changeMessage).newTuple
+	if tuple[0].kind != tupleText || string(tuple[0].value) != "1" {
+		t.Errorf("column 0 = %+v, want text 1", tuple[0])
+	}
+	if tuple[1].kind != tupleNull {
+		t.Errorf("column 1 = %+v, want null", tuple[1])
+	}
+	if tuple[2].kind != tupleText || len(tuple[2].value) != 0 {
+		t.Errorf("column 2 = %+v, want an empty text value", tuple[2])
+	}
+
+	msg, err = decodeMessage(newMessage(messageUpdate).uint32(1).unchanged('N', "1").data)
+	if err != nil {
+		t.Fatalf("decodeMessage() error = %v", err)
+	}
+	if column := msg.(*changeMessage).newTuple[1]; column.kind != tupleUnchanged {
+		t.Errorf("column 1 = %+v, want unchanged", column)
+	}
+}
+
+func TestDecodeIgnoredMessages(t *testing.T) {
+	for _, kind := range []byte{messageOrigin, messageType, messageTruncate, messageLogical} {
+		msg, err := decodeMessage([]byte{kind, 0, 0})
+		if err != nil || msg != nil {
+			t.Errorf("decodeMessage(%q) = %v, %v, want nil, nil", kind, msg, err)
+		}
+	}
+}
+
+func TestDecodeInvalidMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "unknown type", data: []byte{'Z'}},
+		{name: "truncated begin", data: newMessage(messageBegin).uint64(1).data},
+		{name: "unterminated string", data: newMessage(messageRelation).uint32(1).uint8('p').data},
+		{name: "truncated column value", data: newMessage(messageInsert).uint32(1).uint8('N').uint16(1).uint8(tupleText).uint32(10).uint8('x').data},
+		{name: "unsupported column kind", data: newMessage(messageInsert).uint32(1).uint8('N').uint16(1).uint8('b').data},
+		{name: "insert without new tuple", data: newMessage(messageInsert).uint32(1).uint8('K').data},
+		{name: "update without new tuple", data: newMessage(messageUpdate).uint32(1).tuple('O', text("1")).uint8('X').data},
+		{name: "delete without old tuple", data: newMessage(messageDelete).uint32(1).uint8('N').data},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg, err := decodeMessage(tt.data); err == nil {
+				t.Errorf("decodeMessage() = %v, want an error", msg)
+			}
+		})
+	}
+}
+
+func newTestDecoder(cfg *config.EventStreamingConfig) *changeDecoder {
+	return &changeDecoder{
+		typeMap:     pgtype.NewMap(),
+		relations:   make(map[uint32]*relation),
+		schemaName:  "public",
+		cfg:         cfg,
+		primaryKeys: make(map[uint32][]string),
+		lookupPrimaryKey: func(relationID uint32) ([]string, error) {
+			return []string{"id"}, nil
+		},
+	}
+}
+
+func TestChangeDecoder(t *testing.T) {
+	cfg := &config.EventStreamingConfig{
+		Replication: &config.ReplicationConfig{Tables: []string{"users"}},
+		Ignore:      config.IgnoreConfig{"users": {Columns: []string{"verified"}}},
+		TxContext:   &config.TxContextConfig{},
+	}
+	decoder := newTestDecoder(cfg)
+	decoder.nextTxID = 5<<32 | 1000
+	commitTime := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+
+	messages := [][]byte{
+		relationMessage(16384, "public", "users", usersColumns...),
+		relationMessage(16385, "public", "audit_log", relationColumn{name: "id", typeOID: pgtype.Int8OID}),
+		newMessage(messageBegin).uint64(0).uint64(uint64(commitTime.Sub(postgresEpoch).Microseconds())).uint32(742).data,
+		newMessage(messageInsert).uint32(16384).tuple('N', text("1"), text("a@example.com"), text("t"), text("hello")).data,
+		newMessage(messageInsert).uint32(16385).tuple('N', text("9")).data,
+		newMessage(messageUpdate).uint32(16384).tuple('O', text("1"), text("a@example.com"), text("t"), text("hello")).unchanged('N', "1", "b@example.com", "t").data,
+		newMessage(messageDelete).uint32(16384).tuple('K', text("1"), nil, nil, nil).data,
+	}
+
+	batch := &Batch{}
+	for i, data := range messages {
+		if err := decoder.handleMessage(LSN(100+i), data, batch); err != nil {
+			t.Fatalf("handleMessage(%d) error = %v", i, err)
+		}
+	}
+	if len(batch.Events) != 0 {
+		t.Fatalf("batch has %d events before the commit, want 0", len(batch.Events))
+	}
+
+	commit := newMessage(messageCommit).uint8(0).uint64(0).uint64(0x200).uint64(0).data
+	if err := decoder.handleMessage(200, commit, batch); err != nil {
+		t.Fatalf("handleMessage(commit) error = %v", err)
+	}
+	if batch.EndLSN != 0x200 {
+		t.Errorf("batch end LSN = %s, want 0/200", batch.EndLSN)
+	}
+	if len(batch.Events) != 3 {
+		t.Fatalf("batch has %d events, want 3", len(batch.Events))
+	}
+
+	insert, update, del := batch.Events[0], batch.Events[1], batch.Events[2]
+	assertEvent(t, insert, eventmodels.EventTypeInsert, "", `{"bio":"hello","email":"a@example.com","id":1}`)
+	// The unchanged bio is filled in from the old row
+	assertEvent(t, update, eventmodels.EventTypeUpdate, `{"bio":"hello","email":"a@example.com","id":1}`, `{"bio":"hello","email":"b@example.com","id":1}`)
+	assertEvent(t, del, eventmodels.EventTypeDelete, `{"bio":null,"email":null,"id":1}`, "")
+
+	for _, event := range batch.Events {
+		if event.RowTableName != "users" || !event.LoggedAt.Equal(commitTime) {
+			t.Errorf("event %d is on %s logged at %s, want users at %s", event.ID, event.RowTableName, event.LoggedAt, commitTime)
+		}
+		if event.EntityKey == nil || *event.EntityKey != `["users", 1]` {
+			t.Errorf("event %d entity key = %v, want [\"users\", 1]", event.ID, event.EntityKey)
+		}
+		if event.TxID == nil || *event.TxID != 5<<32|742 {
+			t.Errorf("event %d txid = %v, want %d", event.ID, event.TxID, int64(5<<32|742))
+		}
+	}
+}
+
+func TestChangeDecoderWithoutTxContext(t *testing.T) {
+	decoder := newTestDecoder(&config.EventStreamingConfig{Replication: &config.ReplicationConfig{Tables: []string{"users"}}})
+	decoder.nextTxID = 1000
+	messages := [][]byte{
+		relationMessage(16384, "public", "users", relationColumn{name: "id", typeOID: pgtype.Int8OID}),
+		newMessage(messageBegin).uint64(0).uint64(0).uint32(742).data,
+		newMessage(messageInsert).uint32(16384).tuple('N', text("1")).data,
+		newMessage(messageCommit).uint8(0).uint64(0).uint64(0x200).uint64(0).data,
+	}
+
+	batch := &Batch{}
+	for i, data := range messages {
+		if err := decoder.handleMessage(LSN(100+i), data, batch); err != nil {
+			t.Fatalf("handleMessage(%d) error = %v", i, err)
+		}
+	}
+	if len(batch.Events) != 1 || batch.Events[0].TxID != nil {
+		t.Errorf("batch events = %v, want one event without a txid", batch.Events)
+	}
+}
+
+func TestFullTxID(t *testing.T) {
+	tests := []struct {
+		name     string
+		xid      uint32
+		nextTxID int64
+		want     int64
+	}{
+		{name: "first epoch", xid: 742, nextTxID: 1000, want: 742},
+		{name: "same epoch", xid: 742, nextTxID: 5<<32 | 1000, want: 5<<32 | 742},
+		{name: "previous epoch", xid: 0xFFFFFF00, nextTxID: 5<<32 | 1000, want: 4<<32 | 0xFFFFFF00},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fullTxID(tt.xid, tt.nextTxID); got != tt.want {
+				t.Errorf("fullTxID(%d, %d) = %d, want %d", tt.xid, tt.nextTxID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangeDecoderUnknownRelation(t *testing.T) {
+	decoder := newTestDecoder(&config.EventStreamingConfig{Replication: &config.ReplicationConfig{Tables: []string{"users"}}})
+	data := newMessage(messageInsert).uint32(16384).tuple('N', text("1")).data
+	if err := decoder.handleMessage(1, data, &Batch{}); err == nil {
+		t.Error("handleMessage() error = nil, want an error for a change to an unknown relation")
+	}
+}
+
+func assertEvent(t *testing.T, event *eventmodels.DBEvent, eventType eventmodels.DBEventType, oldRow, newRow string) {
+	t.Helper()
+	if event.EventType != eventType {
+		t.Errorf("event %d type = %s, want %s", event.ID, event.EventType, eventType)
+	}
+	assertJSON(t, "old row", event.OldRow, oldRow)
+	assertJSON(t, "new row", event.NewRow, newRow)
+}
+
+func assertJSON(t *testing.T, name string, got json.RawMessage, want string) {
+	t.Helper()
+	if want == "" {
+		if got != nil {
+			t.Errorf("%s = %s, want none", name, got)
+		}
+		return
+	}
+	var gotValue, wantValue any
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("%s %s is not valid JSON: %v", name, got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("invalid expected JSON %s: %v", want, err)
+	}
+	gotJSON, _ := json.Marshal(gotValue)
+	wantJSON, _ := json.Marshal(wantValue)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("%s = %s, want %s", name, gotJSON, wantJSON)
+	}
+}
@@ -0,0 +1,332 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/internal/logger"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+// LSN is a position in the write-ahead log
+type LSN uint64
+
+func (lsn LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
+
+// ParseLSN parses the textual form of an LSN, e.g. 16/B374D848
+func ParseLSN(s string) (LSN, error) {
+	var hi, lo uint32
+	if _, err := fmt.Sscanf(s, "%X/%X", &hi, &lo); err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+	return LSN(uint64(hi)<<32 | uint64(lo)), nil
+}
+
+// Batch is a set of complete transactions read from the replication slot
+type Batch struct {
+	// Events are the changes to replicated tables, their IDs are the LSN of the change
+	Events []*eventmodels.DBEvent
+	// EndLSN is the end of the last transaction in the batch, the slot is advanced to it
+	// once the batch has been handled. Zero if the batch is empty.
+	EndLSN LSN
+	// Full is true if the slot had more changes than the requested batch size
+	Full bool
+}
+
+// EnsureSlot creates the pgoutput logical replication slot if it doesn't exist yet
+func EnsureSlot(ctx context.Context, pool *pgxpool.Pool) error {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	slot := cfg.EventStreamingConfig.Replication.Slot
+
+	var exists bool
+	if err := pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`, slot).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check for replication slot: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	if _, err := pool.Exec(ctx, `SELECT pg_create_logical_replication_slot($1, 'pgoutput')`, slot); err != nil {
+		return fmt.Errorf("failed to create replication slot %s: %w", slot, err)
+	}
+	logger.Logger().Info("created replication slot", "slot", slot)
+	return nil
+}
+
+// slotLockKey is hashed into the advisory lock key of the slot, so it doesn't collide with
+// advisory locks taken by the application
+const slotLockKey = "pg_track_events.replication_slot."
+
+// LockSlot takes a session advisory lock on the slot on conn. Peeking and advancing the slot
+// are separate steps, so agents hold the lock from FetchChanges until AdvanceSlot to not read
+// the same changes. It returns false if another session holds the lock.
+func LockSlot(ctx context.Context, conn *pgxpool.Conn) (bool, error) {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, slotLockKey+cfg.EventStreamingConfig.Replication.Slot).Scan(&locked); err != nil {
+		return false, fmt.Errorf("failed to lock replication slot: %w", err)
+	}
+	return locked, nil
+}
+
+// UnlockSlot releases the lock taken by LockSlot on conn
+func UnlockSlot(ctx context.Context, conn *pgxpool.Conn) error {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_unlock(hashtext($1))`, slotLockKey+cfg.EventStreamingConfig.Replication.Slot); err != nil {
+		return fmt.Errorf("failed to unlock replication slot: %w", err)
+	}
+	return nil
+}
+
+// FetchChanges reads up to batchSize messages from the replication slot without consuming them.
+// Call AdvanceSlot with the batch's EndLSN once the events have been handled, holding the
+// LockSlot lock in between.
+// Postgres always returns whole transactions, so a batch can hold more changes than batchSize.
+func FetchChanges(ctx context.Context, pool *pgxpool.Pool, batchSize int) (*Batch, error) {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replicationCfg := cfg.EventStreamingConfig.Replication
+
+	// pgoutput sends 32 bit transaction IDs, the next 64 bit one turns them into the
+	// txid_current() values the triggers record
+	var nextTxID int64
+	if err := pool.QueryRow(ctx, `SELECT txid_snapshot_xmax(txid_current_snapshot())`).Scan(&nextTxID); err != nil {
+		return nil, fmt.Errorf("failed to get the next transaction id: %w", err)
+	}
+
+	rows, err := pool.Query(ctx, `
+		SELECT lsn::text, data
+		FROM pg_logical_slot_peek_binary_changes($1, NULL, $2, 'proto_version', '1', 'publication_names', $3)
+	`, replicationCfg.Slot, batchSize, replicationCfg.Publication)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replication slot: %w", err)
+	}
+	defer rows.Close()
+
+	d := &changeDecoder{
+		typeMap:     pgtype.NewMap(),
+		relations:   make(map[uint32]*relation),
+		schemaName:  cfg.DefaultSchemaName,
+		cfg:         cfg.EventStreamingConfig,
+		primaryKeys: make(map[uint32][]string),
+		lookupPrimaryKey: func(relationID uint32) ([]string, error) {
+			return lookupPrimaryKey(ctx, pool, relationID)
+		},
+		nextTxID: nextTxID,
+	}
+	batch := &Batch{}
+	messageCount := 0
+	for rows.Next() {
+		var lsnStr string
+		var data []byte
+		if err := rows.Scan(&lsnStr, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan replication message: %w", err)
+		}
+		messageCount++
+
+		lsn, err := ParseLSN(lsnStr)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.handleMessage(lsn, data, batch); err != nil {
+			return nil, fmt.Errorf("failed to decode replication message at %s: %w", lsn, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating replication messages: %w", err)
+	}
+
+	batch.Full = messageCount >= batchSize
+	return batch, nil
+}
+
+// AdvanceSlot confirms that everything up to lsn has been handled so Postgres can recycle the WAL
+func AdvanceSlot(ctx context.Context, pool *pgxpool.Pool, lsn LSN) error {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := pool.Exec(ctx, `SELECT pg_replication_slot_advance($1, $2::text::pg_lsn)`, cfg.EventStreamingConfig.Replication.Slot, lsn.String()); err != nil {
+		return fmt.Errorf("failed to advance replication slot to %s: %w", lsn, err)
+	}
+	return nil
+}
+
+// lookupPrimaryKey returns the primary key columns of the table with the OID, in key order.
+// pgoutput can't be used for this, it marks every column as a key column with REPLICA IDENTITY FULL.
+func lookupPrimaryKey(ctx context.Context, pool *pgxpool.Pool, relationID uint32) ([]string, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT a.attname
+		FROM pg_index i
+			JOIN LATERAL UNNEST(i.indkey) WITH ORDINALITY AS k(attnum, ord) ON TRUE
+			JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+		WHERE i.indrelid = $1::oid AND i.indisprimary
+		ORDER BY k.ord
+	`, relationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up primary key of relation %d: %w", relationID, err)
+	}
+	columns, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan primary key of relation %d: %w", relationID, err)
+	}
+	return columns, nil
+}
+
+// changeDecoder turns the pgoutput messages of a batch into DB events
+type changeDecoder struct {
+	typeMap    *pgtype.Map
+	relations  map[uint32]*relation
+	schemaName string
+	cfg        *config.EventStreamingConfig
+
+	// Primary key columns by relation, looked up once per batch for the entity keys
+	primaryKeys      map[uint32][]string
+	lookupPrimaryKey func(relationID uint32) ([]string, error)
+
+	// nextTxID is the 64 bit ID of the next transaction when the batch was read, see fullTxID
+	nextTxID int64
+
+	// Events of the current transaction, only added to the batch once it commits
+	pending    []*eventmodels.DBEvent
+	commitTime time.Time
+	txID       int64
+}
+
+// fullTxID returns the 64 bit transaction ID, as returned by txid_current(), of the 32 bit xid
+// of a transaction that started before nextTxID. The xid wrapped around if it is not below
+// the low bits of nextTxID.
+func fullTxID(xid uint32, nextTxID int64) int64 {
+	txID := nextTxID&^0xFFFFFFFF | int64(xid)
+	if txID >= nextTxID {
+		txID -= 1 << 32
+	}
+	return txID
+}
+
+func (d *changeDecoder) handleMessage(lsn LSN, data []byte, batch *Batch) error {
+	msg, err := decodeMessage(data)
+	if err != nil {
+		return err
+	}
+
+	switch msg := msg.(type) {
+	case *relation:
+		d.relations[msg.id] = msg
+	case *beginMessage:
+		d.pending = d.pending[:0]
+		d.commitTime = msg.commitTime
+		d.txID = fullTxID(msg.xid, d.nextTxID)
+	case *commitMessage:
+		batch.Events = append(batch.Events, d.pending...)
+		batch.EndLSN = msg.endLSN
+		d.pending = nil
+	case *changeMessage:
+		event, err := d.changeToEvent(lsn, msg)
+		if err != nil {
+			return err
+		}
+		if event != nil {
+			d.pending = append(d.pending, event)
+		}
+	}
+	return nil
+}
+
+// changeToEvent converts a change to a DB event, returning nil for tables that are not replicated
+func (d *changeDecoder) changeToEvent(lsn LSN, change *changeMessage) (*eventmodels.DBEvent, error) {
+	rel, ok := d.relations[change.relationID]
+	if !ok {
+		return nil, fmt.Errorf("change for unknown relation %d", change.relationID)
+	}
+	if rel.namespace != d.schemaName || !d.cfg.Replication.HasTable(rel.name) {
+		return nil, nil
+	}
+
+	ignoreCfg, hasIgnore := d.cfg.Ignore[rel.name]
+	if hasIgnore && ignoreCfg.AllColumns {
+		return nil, nil
+	}
+	ignored := make(map[string]struct{}, len(ignoreCfg.Columns))
+	for _, column := range ignoreCfg.Columns {
+		ignored[column] = struct{}{}
+	}
+
+	event := &eventmodels.DBEvent{
+		ID:           int64(lsn),
+		RowTableName: rel.name,
+		LoggedAt:     d.commitTime,
+	}
+	// Like the triggers, the transaction is only recorded with tx_context. The WAL doesn't
+	// have the connection of the change, so tx only has the txid.
+	if d.cfg.TxContext != nil {
+		txID := d.txID
+		event.TxID = &txID
+	}
+
+	var oldValues map[string]json.RawMessage
+	if change.oldTuple != nil {
+		var err error
+		event.OldRow, oldValues, err = rowToJSON(d.typeMap, rel, change.oldTuple, ignored, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert old row of %s: %w", rel.name, err)
+		}
+	}
+	if change.newTuple != nil {
+		var err error
+		event.NewRow, _, err = rowToJSON(d.typeMap, rel, change.newTuple, ignored, oldValues)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert new row of %s: %w", rel.name, err)
+		}
+	}
+
+	switch change.kind {
+	case messageInsert:
+		event.EventType = eventmodels.EventTypeInsert
+	case messageUpdate:
+		event.EventType = eventmodels.EventTypeUpdate
+		// Without REPLICA IDENTITY FULL the old row is only sent when the key changes
+		if event.OldRow == nil {
+			event.OldRow = json.RawMessage("{}")
+		}
+	case messageDelete:
+		event.EventType = eventmodels.EventTypeDelete
+	}
+
+	// The key identifies the row the way the triggers do, from the old row for deletes
+	primaryKey, ok := d.primaryKeys[rel.id]
+	if !ok {
+		var err error
+		if primaryKey, err = d.lookupPrimaryKey(rel.id); err != nil {
+			return nil, err
+		}
+		d.primaryKeys[rel.id] = primaryKey
+	}
+	keyTuple := change.newTuple
+	if keyTuple == nil {
+		keyTuple = change.oldTuple
+	}
+	event.EntityKey = entityKey(d.typeMap, rel, primaryKey, keyTuple)
+	return event, nil
+}
@@ -0,0 +1,124 @@
+package replication
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// rowToJSON converts a tuple into the same JSON object the triggers build with json_build_object,
+// dropping ignored columns. Unchanged TOAST columns are filled in from fallback when it has them,
+// and omitted otherwise since their value is not in the WAL.
+func rowToJSON(typeMap *pgtype.Map, rel *relation, tuple []tupleColumn, ignored map[string]struct{}, fallback map[string]json.RawMessage) (json.RawMessage, map[string]json.RawMessage, error) {
+	values := make(map[string]json.RawMessage, len(tuple))
+	for i, column := range tuple {
+		if i >= len(rel.columns) {
+			break
+		}
+		relColumn := rel.columns[i]
+		if _, ok := ignored[relColumn.name]; ok {
+			continue
+		}
+
+		switch column.kind {
+		case tupleNull:
+			values[relColumn.name] = json.RawMessage("null")
+		case tupleUnchanged:
+			if value, ok := fallback[relColumn.name]; ok {
+				values[relColumn.name] = value
+			}
+		default:
+			values[relColumn.name] = textValueToJSON(typeMap, relColumn.typeOID, column.value)
+		}
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, values, nil
+}
+
+// entityKey builds the entity_key the triggers record for ORDERING=entity, the text of
+// json_build_array of the table name and primary key values. It is nil for tables without a
+// primary key or when a key value is not in the tuple.
+func entityKey(typeMap *pgtype.Map, rel *relation, primaryKey []string, tuple []tupleColumn) *string {
+	if len(primaryKey) == 0 {
+		return nil
+	}
+
+	elements := []string{string(jsonString(rel.name))}
+	for _, name := range primaryKey {
+		i := slices.IndexFunc(rel.columns, func(column relationColumn) bool { return column.name == name })
+		if i < 0 || i >= len(tuple) {
+			return nil
+		}
+		switch tuple[i].kind {
+		case tupleNull:
+			elements = append(elements, "null")
+		case tupleText:
+			elements = append(elements, string(textValueToJSON(typeMap, rel.columns[i].typeOID, tuple[i].value)))
+		default:
+			return nil
+		}
+	}
+
+	key := "[" + strings.Join(elements, ", ") + "]"
+	return &key
+}
+
+// textValueToJSON converts a column in text format to the JSON Postgres' to_json would produce
+func textValueToJSON(typeMap *pgtype.Map, typeOID uint32, value []byte) json.RawMessage {
+	switch typeOID {
+	case pgtype.BoolOID:
+		if bytes.Equal(value, []byte("t")) {
+			return json.RawMessage("true")
+		}
+		return json.RawMessage("false")
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
+		return json.RawMessage(value)
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		// NaN and Infinity are not valid JSON numbers, to_json returns them as strings
+		if _, err := strconv.ParseFloat(string(value), 64); err != nil || !json.Valid(value) {
+			return jsonString(string(value))
+		}
+		return json.RawMessage(value)
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		if json.Valid(value) {
+			return json.RawMessage(value)
+		}
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		return jsonString(isoTimestamp(string(value)))
+	case pgtype.TextOID, pgtype.VarcharOID, pgtype.BPCharOID, pgtype.UUIDOID, pgtype.DateOID:
+		return jsonString(string(value))
+	}
+
+	// Decode anything else, e.g. arrays, with pgx and fall back to the text representation
+	if t, ok := typeMap.TypeForOID(typeOID); ok {
+		if decoded, err := t.Codec.DecodeValue(typeMap, typeOID, pgtype.TextFormatCode, value); err == nil {
+			if data, err := json.Marshal(decoded); err == nil {
+				return data
+			}
+		}
+	}
+	return jsonString(string(value))
+}
+
+// isoTimestamp converts a timestamp in the ISO DateStyle ("2024-01-02 03:04:05.123456+00")
+// to the format to_json uses ("2024-01-02T03:04:05.123456+00:00")
+func isoTimestamp(value string) string {
+	value = strings.Replace(value, " ", "T", 1)
+	if n := len(value); n > 3 && (value[n-3] == '+' || value[n-3] == '-') {
+		value += ":00"
+	}
+	return value
+}
+
+func jsonString(value string) json.RawMessage {
+	data, _ := json.Marshal(value)
+	return data
+}
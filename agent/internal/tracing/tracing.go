@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/typeeng/pg_track_events/agent"
+	defaultServiceName  = "pg_track_events_agent"
+)
+
+// Attribute keys shared by the agent's spans
+const (
+	EventIDKey     = attribute.Key("pg_track_events.event_id")
+	EventIDsKey    = attribute.Key("pg_track_events.event_ids")
+	TableKey       = attribute.Key("pg_track_events.table")
+	EventTypeKey   = attribute.Key("pg_track_events.event_type")
+	SourceKey      = attribute.Key("pg_track_events.source")
+	DestinationKey = attribute.Key("pg_track_events.destination")
+	CountKey       = attribute.Key("pg_track_events.count")
+	TxIDKey        = attribute.Key("pg_track_events.txid")
+)
+
+// Tracer returns the agent's tracer. Spans are dropped unless Setup installed an exporter.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup exports spans over OTLP/HTTP to the collector configured with the standard
+// OTEL_EXPORTER_OTLP_* environment variables. The returned function flushes and stops
+// the exporter and must be called before the process exits.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default service name
+	res, err := resource.Merge(
+		resource.NewSchemaless(attribute.String("service.name", defaultServiceName)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// RecordError marks the span as failed with err
+func RecordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
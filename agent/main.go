@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/typeeng/pg_track_events/agent/internal/config"
 	"github.com/typeeng/pg_track_events/agent/internal/db"
 	"github.com/typeeng/pg_track_events/agent/internal/logger"
+	"github.com/typeeng/pg_track_events/agent/internal/tracing"
 	"github.com/typeeng/pg_track_events/agent/pkg/agent"
 
 	_ "github.com/joho/godotenv/autoload"
@@ -27,32 +33,111 @@ func main() {
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigCh
-		log.Println("Shutting down gracefully...")
+		logger.Logger().Info("shutting down gracefully")
 		cancel()
+		// A second signal skips waiting for in-flight batches and destination flushes
+		<-sigCh
+		logger.Logger().Warn("forcing shutdown")
+		os.Exit(1)
 	}()
 
 	// Load configuration
-	cfg := config.ConfigFromContext(ctx)
+	cfg, err := config.LoadAgentConfig()
+	if err != nil {
+		fatal("failed to load config", err)
+	}
+	ctx = config.WithConfig(ctx, cfg)
 
 	logger.Logger().Info("loaded config", "track", len(cfg.EventStreamingConfig.Track), "destinations", len(cfg.EventStreamingConfig.Destinations), "ignore", len(cfg.EventStreamingConfig.Ignore))
 
 	// Connect to database
 	dbPool, err := db.NewDB(ctx)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("failed to connect to database", err)
 	}
 	defer dbPool.Close()
 
+	// Replay dead-lettered events back into the queue instead of running the agent
+	if len(os.Args) > 1 && os.Args[1] == "replay-dead-letters" {
+		if err := replayDeadLetters(ctx, dbPool, cfg, os.Args[2:]); err != nil {
+			fatal("failed to replay dead letters", err)
+		}
+		return
+	}
+
+	if cfg.TracingEnabled {
+		shutdownTracing, err := tracing.Setup(ctx)
+		if err != nil {
+			fatal("failed to set up tracing", err)
+		}
+		defer func() {
+			// ctx is cancelled by now, give the exporter a moment to send the last spans
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(flushCtx); err != nil {
+				logger.Logger().Error("failed to flush traces", "error", err)
+			}
+		}()
+		logger.Logger().Info("exporting traces over OTLP")
+	}
+
 	// Configure and start the agent
-	eventAgent, err := agent.NewAgent(ctx, dbPool)
+	eventAgent, err := agent.NewAgent(ctx, dbPool, cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize agent: %v", err)
+		fatal("failed to initialize agent", err)
 	}
 
-	log.Println("Starting tightdb-agent...")
+	// SIGHUP reloads the events config without restarting
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			eventAgent.Reload(ctx)
+		}
+	}()
+
 	if err := eventAgent.Start(ctx); err != nil && err != context.Canceled {
-		log.Fatalf("Agent error: %v", err)
+		fatal("agent error", err)
+	}
+
+	logger.Logger().Info("agent has shut down")
+}
+
+// fatal logs the error and exits, like log.Fatal but through the configured logger
+func fatal(msg string, err error) {
+	logger.Logger().Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// replayDeadLetters handles the replay-dead-letters command:
+//
+//	agent replay-dead-letters [-table users] [-ids 1,2,3]
+func replayDeadLetters(ctx context.Context, dbPool *pgxpool.Pool, cfg *config.AgentConfig, args []string) error {
+	flags := flag.NewFlagSet("replay-dead-letters", flag.ExitOnError)
+	table := flags.String("table", "", "only replay events for this table")
+	ids := flags.String("ids", "", "comma separated event IDs to replay")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var eventIDs []int64
+	for _, idStr := range strings.Split(*ids, ",") {
+		idStr = strings.TrimSpace(idStr)
+		if idStr == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid event ID %q: %w", idStr, err)
+		}
+		eventIDs = append(eventIDs, id)
+	}
+
+	replayed, err := agent.ReplayDeadLetters(ctx, dbPool, cfg, eventIDs, *table)
+	if err != nil {
+		return err
 	}
 
-	log.Println("Agent has shut down")
+	logger.Logger().Info("replayed dead letter events", "count", replayed)
+	return nil
 }
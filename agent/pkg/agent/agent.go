@@ -5,31 +5,38 @@ import (
 	"fmt"
 	"log/slog"
 	"path/filepath"
+	"sync"
 	"time"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/typeeng/pg_track_events/agent/internal/config"
-	"github.com/typeeng/pg_track_events/agent/internal/db"
 	"github.com/typeeng/pg_track_events/agent/internal/evtxfrm"
 	"github.com/typeeng/pg_track_events/agent/internal/logger"
+	"github.com/typeeng/pg_track_events/agent/internal/metrics"
+	"github.com/typeeng/pg_track_events/agent/internal/tracing"
 	"github.com/typeeng/pg_track_events/agent/pkg/destinations"
 	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
-	"github.com/typeeng/pg_track_events/agent/pkg/schemas"
+	"github.com/typeeng/pg_track_events/agent/pkg/sources"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/proto"
-	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 type Agent struct {
-	db                         *pgxpool.Pool
-	cfg                        *config.AgentConfig
-	logger                     *slog.Logger
-	schema                     schemas.PostgresqlTableSchemaList
-	schemaPbDescriptor         protoreflect.FileDescriptor
-	schemaPbPkgName            *string
-	strictSchema               bool
-	processedEventDestinations []config.InitializedProcessedEventDestination
-	dbEventDestinations        []config.InitializedDBEventDestination
+	db              *pgxpool.Pool
+	cfg             *config.AgentConfig
+	logger          *slog.Logger
+	eventLogger     *slog.Logger
+	schemaPbPkgName *string
+	strictSchema    bool
+	sources         []sources.Source
+	status          *agentStatus
+	queueStats      *queueStatsCache
+	// pipeline is replaced when the config is reloaded or the schema changes, see swapPipeline
+	pipelineMu sync.RWMutex
+	pipeline   *pipeline
+	// reloadMu serializes building the next pipeline
+	reloadMu sync.Mutex
 }
 
 type AgentOption func(*Agent)
@@ -46,17 +53,33 @@ func WithE2EDBEventChan(ch chan<- *eventmodels.DBEvent) AgentOption {
 	}
 }
 
-func NewAgent(ctx context.Context, db *pgxpool.Pool, opts ...AgentOption) (*Agent, error) {
-	cfg := config.ConfigFromContext(ctx)
+// WithSources replaces the default sources (the event log, and the replication slot if
+// replication is configured) that the agent reads events from
+func WithSources(srcs ...sources.Source) AgentOption {
+	return func(a *Agent) {
+		a.sources = srcs
+	}
+}
+
+// NewAgent creates an agent that processes the events in db with the configuration, see LoadAgentConfig
+func NewAgent(ctx context.Context, db *pgxpool.Pool, cfg *Config, opts ...AgentOption) (*Agent, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config is required")
+	}
+	ctx = config.WithConfig(ctx, cfg)
+	eventLogger := logger.EventLogger()
 	logger := logger.Logger()
 
 	a := &Agent{
 		db:              db,
 		cfg:             cfg,
 		logger:          logger,
+		eventLogger:     eventLogger,
 		schemaPbPkgName: proto.String("db"),
 		strictSchema:    true,
+		status:          newAgentStatus(),
 	}
+	a.queueStats = &queueStatsCache{fetch: a.fetchQueueStats}
 
 	for _, opt := range opts {
 		opt(a)
@@ -66,316 +89,679 @@ func NewAgent(ctx context.Context, db *pgxpool.Pool, opts ...AgentOption) (*Agen
 	if err != nil {
 		return nil, err
 	}
-	a.processedEventDestinations = initializedDestinations
-	a.dbEventDestinations = initializedDBDestinations
+	a.pipeline = &pipeline{
+		processedEventDestinations: initializedDestinations,
+		dbEventDestinations:        initializedDBDestinations,
+	}
+
+	if a.sources == nil {
+		// Replicated changes are read first, failed ones are retried from the event log
+		if a.cfg.EventStreamingConfig.Replication != nil {
+			replicationSource, err := sources.NewReplicationSource(ctx, db, a.cfg.BatchSize, logger)
+			if err != nil {
+				return nil, fmt.Errorf("failed to set up replication source: %w", err)
+			}
+			a.sources = append(a.sources, replicationSource)
+		}
+		a.sources = append(a.sources, sources.NewOutboxSource(db, logger))
+	}
 	return a, nil
 }
 
 // Start begins the event processing loop
 func (a *Agent) Start(ctx context.Context) error {
+	// Sources and queries read the config from the context
+	ctx = config.WithConfig(ctx, a.cfg)
+
 	ticker := time.NewTicker(a.cfg.FetchInterval)
 	defer ticker.Stop()
 
+	if a.cfg.HTTPAddr != "" {
+		// The server outlives ctx so /healthz keeps answering while in-flight batches drain
+		httpCtx, stopHTTP := context.WithCancel(context.WithoutCancel(ctx))
+		defer stopHTTP()
+		if err := a.serveHTTP(httpCtx, a.cfg.HTTPAddr); err != nil {
+			return fmt.Errorf("failed to start HTTP server: %w", err)
+		}
+	}
+
 	a.logger.Info("starting event processing agent",
 		"batch_size", a.cfg.BatchSize,
+		"workers", a.cfg.Workers,
+		"claim_mode", a.cfg.ClaimMode,
 		"interval", a.cfg.FetchInterval,
+		"notify_channel", a.cfg.EventStreamingConfig.NotifyChannel,
 		"schema_name", a.cfg.InternalSchemaName,
 		"strict_schema", a.strictSchema,
 	)
 
-	// TODO Monitor for schema changes
+	// Without the schema, rows are passed to CEL as plain JSON
+	compiled := &compiledSchema{streaming: a.cfg.EventStreamingConfig}
 	if a.strictSchema {
 		a.logger.Info("fetching schema")
-		if a.schemaPbPkgName == nil {
-			return fmt.Errorf("schema package name not set")
-		}
 		var err error
-		a.schema, err = db.GetSchema(ctx, a.db)
+		compiled, err = a.loadSchema(ctx, a.cfg.EventStreamingConfig)
 		if err != nil {
-			a.logger.Error("failed to get schema", "error", err)
+			a.logger.Error("failed to load schema", "error", err)
 			return err
 		}
+		a.logger.Info("validated event streaming config against schema", "tables", len(compiled.schema))
+	}
+	a.swapPipeline(a.currentPipeline().withSchema(compiled))
 
-		a.logger.Info("loaded schema", "tables", len(a.schema))
+	a.status.setReady(true)
 
-		a.schema = a.schema.ApplyIgnoresToSchema(a.cfg.EventStreamingConfig.Ignore)
-		a.logger.Info("applied ignores to schema", "tables", len(a.schema))
+	// Triggers notify on commit so events are processed right away, the ticker still
+	// picks up retries and anything written while the notify connection is down
+	wake := make(chan struct{}, 1)
+	if channel := a.cfg.EventStreamingConfig.NotifyChannel; channel != "" {
+		go a.listenForNotifications(ctx, channel, wake)
+	}
 
-		a.schemaPbDescriptor, err = a.schema.GeneratePbDescriptorForTables(*a.schemaPbPkgName, fmt.Sprintf("%s.*", a.cfg.DefaultSchemaName))
-		if err != nil {
-			a.logger.Error("failed to generate protobuf descriptor", "error", err)
-			return err
-		}
+	// Migrations are picked up by re-reading the schema, a config that no longer compiles stops the agent
+	schemaFailed := make(chan error, 1)
+	if a.strictSchema && a.cfg.SchemaCheckInterval > 0 {
+		go a.watchSchema(ctx, a.cfg.SchemaCheckInterval, schemaFailed)
+	}
 
-		a.logger.Info("generated protobuf descriptor for schema")
+	if a.cfg.EventStreamingConfigPath != "" && a.cfg.ConfigWatchInterval > 0 {
+		go a.watchConfig(ctx, a.cfg.ConfigWatchInterval)
+	}
 
-		if err := a.cfg.EventStreamingConfig.Validate(a.schemaPbPkgName, a.schemaPbDescriptor); err != nil {
-			a.logger.Error("failed to validate event streaming config against schema", "error", err)
-			return err
-		}
-		a.logger.Info("validated event streaming config against schema")
+	go a.monitorQueue(ctx)
+
+	// Batches run on their own context so an in-flight batch can finish after ctx is
+	// cancelled, it is only cancelled if the shutdown timeout runs out
+	batchCtx, cancelBatches := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelBatches()
+
+	// Each worker processes batches until its sources are drained, with SKIP LOCKED
+	// claims keeping them from fetching the same events
+	triggers := make([]chan struct{}, a.cfg.Workers)
+	var wg sync.WaitGroup
+	for i := range triggers {
+		triggers[i] = make(chan struct{}, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.runWorker(ctx, batchCtx, i, triggers[i])
+		}()
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
+			a.shutdown(&wg, cancelBatches)
 			return ctx.Err()
+		case err := <-schemaFailed:
+			a.logger.Error("event streaming config no longer validates against the schema, stopping", "error", err)
+			a.shutdown(&wg, cancelBatches)
+			return err
 		case <-ticker.C:
-			// Process events until we don't get a full batch
-			for {
-				fullBatch, err := a.processEventBatch(ctx)
-				if err != nil {
-					a.logger.Error("error processing event batch", "error", err)
-					break
-				}
-				if !fullBatch {
-					break
-				}
-				// If we got a full batch, continue processing immediately
-				a.logger.Info("processed full batch, checking for more events")
+			triggerWorkers(triggers)
+		case <-wake:
+			triggerWorkers(triggers)
+			// The workers are about to process everything available, no need to poll right after
+			ticker.Reset(a.cfg.FetchInterval)
+		}
+	}
+}
+
+// shutdown waits for the workers to finish their in-flight batches, cancelling them if they
+// take longer than SHUTDOWN_TIMEOUT, then closes the destinations so buffered events are flushed
+func (a *Agent) shutdown(workers *sync.WaitGroup, cancelBatches context.CancelFunc) {
+	a.status.setReady(false)
+	a.logger.Info("shutting down, waiting for in-flight batches", "timeout", a.cfg.ShutdownTimeout)
+	deadline := time.Now().Add(a.cfg.ShutdownTimeout)
+
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Until(deadline)):
+		a.logger.Warn("in-flight batches did not finish before the shutdown timeout, cancelling them")
+		cancelBatches()
+		<-stopped
+	}
+
+	// Destinations get the rest of the timeout, or a moment to flush if the batches used it up
+	closeTimeout := max(time.Until(deadline), minDestinationCloseTimeout)
+	closeCtx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	a.closeDestinations(closeCtx)
+	a.logger.Info("agent shut down")
+}
+
+// minDestinationCloseTimeout is the time destinations get to flush when the in-flight batches
+// used up the whole shutdown timeout
+const minDestinationCloseTimeout = 5 * time.Second
+
+// closeDestinations calls Close on every destination that implements destinations.Closer
+func (a *Agent) closeDestinations(ctx context.Context) {
+	a.closeClosers(ctx, a.currentPipeline().closers())
+}
+
+// closeClosers closes the destinations concurrently
+func (a *Agent) closeClosers(ctx context.Context, closers map[string]destinations.Closer) {
+	var wg sync.WaitGroup
+	for name, closer := range closers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := closer.Close(ctx); err != nil {
+				a.logger.Error("failed to close destination", "destination", name, "error", err)
+				return
 			}
+			a.logger.Info("closed destination", "destination", name)
+		}()
+	}
+	wg.Wait()
+}
+
+// triggerWorkers asks every worker to process available events. Workers that are busy
+// already have a pending trigger or will pick up the events when they check for more.
+func triggerWorkers(triggers []chan struct{}) {
+	for _, trigger := range triggers {
+		select {
+		case trigger <- struct{}{}:
+		default:
 		}
 	}
 }
 
-// processEventBatch fetches, processes, and deletes a batch of events
+// runWorker processes available events every time it is triggered until ctx is done. Batches
+// are processed with batchCtx so the one in flight when ctx is done can finish.
+func (a *Agent) runWorker(ctx, batchCtx context.Context, worker int, trigger <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-trigger:
+			a.processAvailableEvents(ctx, batchCtx, worker)
+		}
+	}
+}
+
+// processAvailableEvents processes the events available from each source until ctx is done.
+// Sources that only support one batch at a time are left to the first worker.
+func (a *Agent) processAvailableEvents(ctx, batchCtx context.Context, worker int) {
+	for _, source := range a.sources {
+		if ctx.Err() != nil {
+			return
+		}
+		if worker > 0 && sources.IsSerial(source) {
+			continue
+		}
+		a.drainBatches(ctx, func() (bool, error) {
+			return a.processBatch(sources.WithWorker(batchCtx, worker), source)
+		})
+	}
+}
+
+// drainBatches processes batches until we don't get a full batch or ctx is done
+func (a *Agent) drainBatches(ctx context.Context, processBatch func() (bool, error)) {
+	for {
+		fullBatch, err := processBatch()
+		if err != nil {
+			a.logger.Error("error processing event batch", "error", err)
+			return
+		}
+		if !fullBatch {
+			return
+		}
+		if ctx.Err() != nil {
+			a.logger.Info("stopping after full batch, agent is shutting down")
+			return
+		}
+		// If we got a full batch, continue processing immediately
+		a.logger.Info("processed full batch, checking for more events")
+	}
+}
+
+// processBatch fetches, delivers, and acks or nacks a batch of events from the source
 // Returns true if a full batch was processed (indicating there might be more events)
-func (a *Agent) processEventBatch(ctx context.Context) (bool, error) {
-	a.logger.Info("checking for events to process")
-	// Fetch db events with lock
-	dbEvents, tx, err := db.FetchDBEvents(ctx, a.db)
+func (a *Agent) processBatch(ctx context.Context, source sources.Source) (bool, error) {
+	// Reloads take effect from the next batch
+	p := a.acquirePipeline()
+	defer p.batches.Done()
+
+	a.logger.Info("checking for events to process", "source", source.Name())
+	batch, err := a.fetchBatch(sources.WithTransactionGrouping(ctx, p.groupsTransactions()), source)
 	if err != nil {
-		a.logger.Error("failed to fetch events", "error", err)
 		return false, err
 	}
+	if batch == nil {
+		a.logger.Info("no events to process", "source", source.Name())
+		return false, nil
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.BatchDuration.WithLabelValues(source.Name()).Observe(time.Since(start).Seconds())
+	}()
 
-	if len(dbEvents) == 0 {
-		a.logger.Info("no events to process")
-		// No events to process, commit or rollback the empty transaction
-		if tx != nil {
-			tx.Rollback(ctx)
+	dbEvents := batch.Events()
+	ctx, span := tracing.Tracer().Start(ctx, "process_batch", trace.WithAttributes(
+		tracing.SourceKey.String(source.Name()),
+		tracing.CountKey.Int(len(dbEvents)),
+	))
+	defer span.End()
+
+	metrics.EventsFetched.WithLabelValues(source.Name()).Add(float64(len(dbEvents)))
+	a.logger.Info("fetched events for processing", "source", source.Name(), "count", len(dbEvents))
+
+	var failedEventUpdates []*eventmodels.DBEventUpdate
+	if len(dbEvents) > 0 {
+		failedEventUpdates = a.deliverDBEvents(ctx, p, dbEvents)
+	}
+
+	failedIDs := make(map[int64]bool, len(failedEventUpdates))
+	for _, update := range failedEventUpdates {
+		failedIDs[update.ID] = true
+	}
+	successfulIDs := make([]int64, 0, len(dbEvents)-len(failedIDs))
+	for _, dbEvent := range dbEvents {
+		if !failedIDs[dbEvent.ID] {
+			successfulIDs = append(successfulIDs, dbEvent.ID)
 		}
-		return false, nil
 	}
 
-	a.logger.Info("fetched events for processing", "count", len(dbEvents))
+	if err := a.finishBatch(ctx, batch, successfulIDs, failedEventUpdates); err != nil {
+		tracing.RecordError(span, err)
+		batch.Abort(ctx)
+		return false, err
+	}
+	a.status.recordBatch(source.Name())
+	for _, update := range failedEventUpdates {
+		outcome := "retried"
+		if update.DeadLetter {
+			outcome = "dead_lettered"
+		}
+		metrics.EventsFailed.WithLabelValues(source.Name(), outcome).Inc()
+	}
+	a.logger.Info("completed event batch", "source", source.Name(), "successful", len(successfulIDs), "failed", len(failedEventUpdates))
+
+	return batch.Full(), nil
+}
+
+// fetchBatch fetches the next batch from the source in its own span
+func (a *Agent) fetchBatch(ctx context.Context, source sources.Source) (sources.Batch, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "fetch_batch", trace.WithAttributes(tracing.SourceKey.String(source.Name())))
+	defer span.End()
+
+	batch, err := source.FetchBatch(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	if batch != nil {
+		eventIDs := make([]int64, len(batch.Events()))
+		for i, dbEvent := range batch.Events() {
+			eventIDs[i] = dbEvent.ID
+		}
+		span.SetAttributes(tracing.CountKey.Int(len(eventIDs)), tracing.EventIDsKey.Int64Slice(eventIDs))
+	}
+	return batch, nil
+}
+
+// finishBatch nacks the failed events, acks the rest and commits the batch
+func (a *Agent) finishBatch(ctx context.Context, batch sources.Batch, successfulIDs []int64, failedEventUpdates []*eventmodels.DBEventUpdate) error {
+	ctx, span := tracing.Tracer().Start(ctx, "commit_batch", trace.WithAttributes(
+		attribute.Int("pg_track_events.successful", len(successfulIDs)),
+		attribute.Int("pg_track_events.failed", len(failedEventUpdates)),
+	))
+	defer span.End()
+
+	if len(failedEventUpdates) > 0 {
+		if err := batch.Nack(ctx, failedEventUpdates); err != nil {
+			return err
+		}
+	}
+	if err := batch.Ack(ctx, successfulIDs); err != nil {
+		return err
+	}
+	return batch.Commit(ctx)
+}
 
-	// Track events to send to API and events to flush from DB
-	eventIds := make([]int64, len(dbEvents))
+// deliverDBEvents transforms the events and sends them to every destination that has not
+// received them yet. It returns one merged update per event that failed to be delivered.
+func (a *Agent) deliverDBEvents(ctx context.Context, p *pipeline, dbEvents []*eventmodels.DBEvent) []*eventmodels.DBEventUpdate {
+	// Track events to send to API and events that failed
 	eventRetriesMap := make(map[int64]int)
 	var processedEvents []*eventmodels.ProcessedEvent
 	var failedEventUpdates []*eventmodels.DBEventUpdate
 
-	// Build ID list and retries map for error handling
-	for i, dbEvent := range dbEvents {
-		eventIds[i] = dbEvent.ID
+	// Build retries map for error handling
+	for _, dbEvent := range dbEvents {
 		eventRetriesMap[dbEvent.ID] = dbEvent.Retries
 	}
 
+	// Deliveries recorded by previous attempts are skipped so retries only hit failed destinations
+	tracker := newDeliveryTracker(dbEvents)
+
 	// Process events into transformed events
 	for _, dbEvent := range dbEvents {
-		// Process event with protobuf support
-		processedEvent, err := evtxfrm.ProcessEvent(dbEvent, a.cfg.EventStreamingConfig, a.schemaPbPkgName, a.schemaPbDescriptor)
+		events, err := a.transformDBEvent(ctx, p.compiledSchema, dbEvent)
 		if err != nil {
-			a.logger.Error("failed to process event", "error", err, "event_id", dbEvent.ID)
-			// Add to failed events list
-			failedEventUpdates = append(failedEventUpdates, GenerateEventErrorUpdate(dbEvent.ID, dbEvent.Retries, err))
+			// Transform errors come from the event config and will fail the same way on retry
+			failedEventUpdates = append(failedEventUpdates, GenerateEventErrorUpdate(dbEvent.ID, dbEvent.Retries, destinations.NewPermanentError(err)))
 			continue
 		}
+		// Add to send list
+		processedEvents = append(processedEvents, events...)
+	}
 
-		if processedEvent != nil {
-			a.logger.Info("processed event", "event_id", dbEvent.ID, "event_type", dbEvent.EventType, "table", dbEvent.RowTableName)
-			// Add to send list
-			processedEvents = append(processedEvents, processedEvent)
-		} else {
-			a.logger.Info("skipping event", "event_id", dbEvent.ID, "event_type", dbEvent.EventType, "table", dbEvent.RowTableName)
-		}
+	// The batch holds every due change of its transactions, see db.FetchDBEvents
+	groupTransactions := p.groupsTransactions()
+	if groupTransactions {
+		txEvents, txFailedUpdates := a.transformTransactions(ctx, p.compiledSchema, dbEvents)
+		processedEvents = append(processedEvents, txEvents...)
+		failedEventUpdates = append(failedEventUpdates, txFailedUpdates...)
 	}
 
-	// Only send processed events if there are any to send
+	// Every destination is sent to concurrently, processed event destinations only if there are events to send
+	var sends []destinationSend
 	if len(processedEvents) > 0 {
-		a.logger.Info("sending processed events to destinations", "count", len(processedEvents))
-		eventErrors, err := a.sendProcessedEvents(ctx, processedEvents)
-		if err != nil {
-			// Handle top-level error for all processed events
-			return a.handleBatchError(ctx, tx, eventIds, eventRetriesMap, err)
-		} else if len(eventErrors) > 0 {
-			// Handle individual event errors
-			a.logger.Info("some events failed to send", "error_count", len(eventErrors))
-			failedEventUpdates = append(failedEventUpdates, a.generateUpdatesFromErrors(eventErrors, eventRetriesMap)...)
-		} else {
-			a.logger.Info("successfully sent processed events to destinations", "count", len(processedEvents))
-		}
+		sends = append(sends, a.processedEventSends(p.processedEventDestinations, processedEvents, tracker)...)
 	} else {
 		a.logger.Info("no processed events to send to destinations")
 	}
+	sends = append(sends, a.dbEventSends(p.dbEventDestinations, dbEvents, tracker)...)
 
-	// Send DB events to destinations
-	a.logger.Info("sending db events to destinations", "count", len(dbEvents))
-	dbEventErrors, err := a.sendDBEvents(ctx, dbEvents)
-	if err != nil {
-		// Handle top-level error for all db events
-		return a.handleBatchError(ctx, tx, eventIds, eventRetriesMap, err)
-	} else if len(dbEventErrors) > 0 {
-		// Handle individual event errors
-		a.logger.Info("some db events failed to send", "error_count", len(dbEventErrors))
-		failedEventUpdates = append(failedEventUpdates, a.generateUpdatesFromErrors(dbEventErrors, eventRetriesMap)...)
+	a.logger.Info("sending events to destinations", "processed_count", len(processedEvents), "db_count", len(dbEvents), "destinations", len(sends))
+	eventErrors := a.sendToDestinations(ctx, sends, tracker)
+	if len(eventErrors) > 0 {
+		a.logger.Info("some events failed to send", "error_count", len(eventErrors))
+		failedEventUpdates = append(failedEventUpdates, a.generateUpdatesFromErrors(eventErrors, eventRetriesMap)...)
 	} else {
-		a.logger.Info("successfully sent db events to destinations", "count", len(dbEvents))
+		a.logger.Info("successfully sent events to destinations")
 	}
 
-	// Handle failed events and commit successful ones
-	return a.finalizeEventBatch(ctx, tx, eventIds, failedEventUpdates)
+	if len(failedEventUpdates) == 0 {
+		return nil
+	}
+
+	// Merge updates for the same event ID to handle multiple failures for the same event
+	mergedFailedUpdates := MergeEventErrorUpdates(failedEventUpdates)
+	if groupTransactions {
+		mergedFailedUpdates = holdTransactions(dbEvents, mergedFailedUpdates)
+	}
+	a.logger.Info("merged failed event updates",
+		"original_count", len(failedEventUpdates),
+		"unique_events", len(mergedFailedUpdates))
+
+	// Persist the destinations that did acknowledge the event so they are skipped on retry
+	for _, update := range mergedFailedUpdates {
+		update.DeliveredTo = tracker.deliveredTo(update.ID)
+		switch {
+		case a.cfg.MaxRetries == 0:
+			// Dead-lettering is disabled, permanent failures are retried with backoff like the rest
+			update.DeadLetter = false
+		case update.Retries >= a.cfg.MaxRetries:
+			update.DeadLetter = true
+		}
+	}
+	return mergedFailedUpdates
 }
 
-// handleBatchError handles top-level errors that affect all events in a batch
-func (a *Agent) handleBatchError(ctx context.Context, tx pgx.Tx, eventIds []int64, eventRetriesMap map[int64]int, err error) (bool, error) {
-	a.logger.Error("top-level error sending events to destinations", "error", err)
+// transformDBEvent turns the DB event into the processed events of its rules, none if it is not tracked
+func (a *Agent) transformDBEvent(ctx context.Context, compiled *compiledSchema, dbEvent *eventmodels.DBEvent) ([]*eventmodels.ProcessedEvent, error) {
+	_, span := tracing.Tracer().Start(ctx, "transform_event", trace.WithAttributes(
+		tracing.EventIDKey.Int64(dbEvent.ID),
+		tracing.TableKey.String(dbEvent.RowTableName),
+		tracing.EventTypeKey.String(string(dbEvent.EventType)),
+	))
+	defer span.End()
+
+	// Process event with protobuf support
+	processedEvents, skipReason, err := evtxfrm.ProcessEvent(dbEvent, compiled.streaming, a.schemaPbPkgName, compiled.pbDescriptor)
+	if err != nil {
+		a.eventLogger.Error("failed to process event", "error", err, "event_id", dbEvent.ID)
+		metrics.TransformFailures.Inc()
+		tracing.RecordError(span, err)
+		return nil, err
+	}
 
-	// Generate and merge updates for all failed events
-	failedUpdates := GenerateEventErrorUpdates(eventIds, eventRetriesMap, err)
-	mergedUpdates := MergeEventErrorUpdates(failedUpdates)
-	if updateErr := db.UpdateDBEvents(ctx, tx, mergedUpdates); updateErr != nil {
-		tx.Rollback(ctx)
-		a.logger.Error("failed to update event errors", "error", updateErr)
-		return false, updateErr
+	if len(processedEvents) == 0 {
+		a.eventLogger.Info("skipping event", "event_id", dbEvent.ID, "event_type", dbEvent.EventType, "table", dbEvent.RowTableName, "reason", skipReason)
+		metrics.EventsSkipped.WithLabelValues(string(skipReason)).Inc()
+		span.SetAttributes(attribute.Bool("pg_track_events.skipped", true), attribute.String("pg_track_events.skip_reason", string(skipReason)))
+		return nil, nil
 	}
 
-	if err := tx.Commit(ctx); err != nil {
-		a.logger.Error("failed to commit transaction with only failed events", "error", err)
-		return false, err
+	names := make([]string, 0, len(processedEvents))
+	for _, processedEvent := range processedEvents {
+		a.eventLogger.Info("processed event", "event_id", dbEvent.ID, "event_type", dbEvent.EventType, "table", dbEvent.RowTableName, "event", processedEvent.Name)
+		metrics.EventsProcessed.Inc()
+		names = append(names, processedEvent.Name)
 	}
-	return false, err
+	span.SetAttributes(attribute.StringSlice("pg_track_events.event_names", names))
+	return processedEvents, nil
 }
 
 // generateUpdatesFromErrors converts destination event errors to DB event updates
 func (a *Agent) generateUpdatesFromErrors(eventErrors []*destinations.DestinationEventError, eventRetriesMap map[int64]int) []*eventmodels.DBEventUpdate {
 	updates := make([]*eventmodels.DBEventUpdate, 0, len(eventErrors))
 	for _, eventError := range eventErrors {
-		updates = append(updates,
-			GenerateEventErrorUpdate(eventError.EventID, eventRetriesMap[eventError.EventID], eventError.Error))
+		update := GenerateEventErrorUpdate(eventError.EventID, eventRetriesMap[eventError.EventID], eventError.Error)
+		if eventError.Destination != "" {
+			update.FailedDestinations = []string{eventError.Destination}
+		}
+		updates = append(updates, update)
 	}
 	return updates
 }
 
-// finalizeEventBatch handles failed event updates and flushes successful events
-func (a *Agent) finalizeEventBatch(ctx context.Context, tx pgx.Tx, eventIds []int64, failedEventUpdates []*eventmodels.DBEventUpdate) (bool, error) {
-	// Update any failed events with error information
-	if len(failedEventUpdates) > 0 {
-		// Merge updates for the same event ID to handle multiple failures for the same event
-		mergedFailedUpdates := MergeEventErrorUpdates(failedEventUpdates)
-
-		a.logger.Info("updating failed events",
-			"original_count", len(failedEventUpdates),
-			"merged_count", len(mergedFailedUpdates),
-			"unique_events", len(mergedFailedUpdates))
-
-		if err := db.UpdateDBEvents(ctx, tx, mergedFailedUpdates); err != nil {
-			tx.Rollback(ctx)
-			a.logger.Error("failed to update failed events", "error", err)
-			return false, err
-		}
-
-		// Remove failed event IDs from the list to flush
-		failedIDs := make(map[int64]bool)
-		for _, update := range mergedFailedUpdates {
-			failedIDs[update.ID] = true
-		}
-
-		successfulIDs := make([]int64, 0, len(eventIds)-len(failedIDs))
-		for _, id := range eventIds {
-			if !failedIDs[id] {
-				successfulIDs = append(successfulIDs, id)
-			}
-		}
-
-		eventIds = successfulIDs
-	}
+// destinationSend is a SendBatch call to one destination
+type destinationSend struct {
+	destination string
+	deliveries  []eventDelivery
+	send        func(ctx context.Context) ([]*destinations.DestinationEventError, error)
+}
 
-	// Flush successful events
-	if len(eventIds) > 0 {
-		a.logger.Info("flushing successful events", "count", len(eventIds))
-		if err := db.FlushDBEvents(ctx, tx, eventIds); err != nil {
-			tx.Rollback(ctx)
-			a.logger.Error("failed to delete processed events", "error", err)
-			return false, err
-		}
-		if err := tx.Commit(ctx); err != nil {
-			a.logger.Error("failed to commit transaction with successful events", "error", err)
-			return false, err
-		}
-		a.logger.Info("flushed successful events", "count", len(eventIds))
-	} else if len(failedEventUpdates) > 0 {
-		// If we have failed events but no successful ones, commit the transaction to save the updates
-		if err := tx.Commit(ctx); err != nil {
-			a.logger.Error("failed to commit transaction with only failed events", "error", err)
-			return false, err
+// dbEventIDs returns the IDs of the DB events the send delivers, in order
+func (s destinationSend) dbEventIDs() []int64 {
+	ids := make([]int64, 0, len(s.deliveries))
+	for _, delivery := range s.deliveries {
+		if len(ids) == 0 || ids[len(ids)-1] != delivery.dbEventID {
+			ids = append(ids, delivery.dbEventID)
 		}
-		a.logger.Info("committed transaction with updates for failed events")
 	}
-
-	// Return true if we processed a full batch (indicating there might be more events)
-	return len(eventIds) == a.cfg.BatchSize, nil
+	return ids
 }
 
-func (a *Agent) sendProcessedEvents(ctx context.Context, events []*eventmodels.ProcessedEvent) ([]*destinations.DestinationEventError, error) {
-	var allEventErrors []*destinations.DestinationEventError
+// processedEventSends plans a send to each processed event destination with the events it
+// matches and has not received yet
+func (a *Agent) processedEventSends(processedEventDestinations []config.InitializedProcessedEventDestination, events []*eventmodels.ProcessedEvent, tracker *deliveryTracker) []destinationSend {
+	var sends []destinationSend
 
-	for _, destination := range a.processedEventDestinations {
+	for _, destination := range processedEventDestinations {
 		filteredEvents := events
 		if destination.Filter != "*" {
 			filteredEvents = a.filterProcessedEvents(events, destination.Filter)
 		}
+		filteredEvents = undeliveredEvents(filteredEvents, destination.Name, tracker, processedEventDelivery)
 		if len(filteredEvents) == 0 {
-			a.logger.Info("after applying filter, no events to send to destination", "destination", destination.Destination)
+			a.logger.Info("after applying filter and previous deliveries, no events to send to destination", "destination", destination.Name)
 			continue
 		}
-		a.logger.Info("sending events to destination", "destination", destination.Kind, "count", len(filteredEvents))
-		eventErrors, err := destination.Destination.SendBatch(ctx, filteredEvents)
-		if err != nil {
-			a.logger.Error("failed to send events to destination", "error", err)
-			return nil, err
-		}
 
-		if len(eventErrors) > 0 {
-			a.logger.Info("some events failed to send to destination", "destination", destination.Kind, "error_count", len(eventErrors))
-			allEventErrors = append(allEventErrors, eventErrors...)
-		} else {
-			a.logger.Info("successfully sent events to destination", "destination", destination.Kind, "count", len(filteredEvents))
+		deliveries := make([]eventDelivery, len(filteredEvents))
+		for i, event := range filteredEvents {
+			deliveries[i] = processedEventDelivery(event)
 		}
+		sends = append(sends, destinationSend{
+			destination: destination.Name,
+			deliveries:  deliveries,
+			send: func(ctx context.Context) ([]*destinations.DestinationEventError, error) {
+				return destination.Destination.SendBatch(ctx, filteredEvents)
+			},
+		})
 	}
 
-	return allEventErrors, nil
+	return sends
 }
 
-func (a *Agent) sendDBEvents(ctx context.Context, events []*eventmodels.DBEvent) ([]*destinations.DestinationEventError, error) {
-	var allEventErrors []*destinations.DestinationEventError
+// dbEventSends plans a send to each DB event destination with the events it matches and
+// has not received yet
+func (a *Agent) dbEventSends(dbEventDestinations []config.InitializedDBEventDestination, events []*eventmodels.DBEvent, tracker *deliveryTracker) []destinationSend {
+	var sends []destinationSend
 
-	for _, destination := range a.dbEventDestinations {
+	for _, destination := range dbEventDestinations {
 		filteredEvents := events
 		if destination.Filter != "*" {
 			filteredEvents = a.filterDBEvents(events, destination.Filter)
 		}
+		filteredEvents = undeliveredEvents(filteredEvents, destination.Name, tracker, dbEventDelivery)
 		if len(filteredEvents) == 0 {
-			a.logger.Info("after applying filter, no events to send to destination", "destination", destination.Destination)
+			a.logger.Info("after applying filter and previous deliveries, no events to send to destination", "destination", destination.Name)
 			continue
 		}
-		a.logger.Info("sending events to destination", "destination", destination.Kind, "count", len(filteredEvents))
-		eventErrors, err := destination.Destination.SendBatch(ctx, filteredEvents)
-		if err != nil {
-			a.logger.Error("failed to send events to destination", "error", err)
-			return nil, err
+
+		deliveries := make([]eventDelivery, len(filteredEvents))
+		for i, event := range filteredEvents {
+			deliveries[i] = dbEventDelivery(event)
 		}
+		sends = append(sends, destinationSend{
+			destination: destination.Name,
+			deliveries:  deliveries,
+			send: func(ctx context.Context) ([]*destinations.DestinationEventError, error) {
+				return destination.Destination.SendBatch(ctx, filteredEvents)
+			},
+		})
+	}
+
+	return sends
+}
+
+// sendToDestinations runs the sends concurrently, at most DESTINATION_CONCURRENCY at a time,
+// each cancelled after DESTINATION_TIMEOUT. A slow or failing destination only fails its own
+// events. The errors are returned in the order of the sends.
+func (a *Agent) sendToDestinations(ctx context.Context, sends []destinationSend, tracker *deliveryTracker) []*destinations.DestinationEventError {
+	limit := a.cfg.DestinationConcurrency
+	if limit <= 0 {
+		limit = len(sends)
+	}
+	sem := make(chan struct{}, limit)
+
+	results := make([][]*destinations.DestinationEventError, len(sends))
+	var wg sync.WaitGroup
+	for i, send := range sends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			ctx, span := tracing.Tracer().Start(ctx, "send_batch", trace.WithAttributes(
+				tracing.DestinationKey.String(send.destination),
+				tracing.CountKey.Int(len(send.deliveries)),
+				tracing.EventIDsKey.Int64Slice(send.dbEventIDs()),
+			))
+			defer span.End()
+
+			sendCtx := ctx
+			if a.cfg.DestinationTimeout > 0 {
+				var cancel context.CancelFunc
+				sendCtx, cancel = context.WithTimeout(ctx, a.cfg.DestinationTimeout)
+				defer cancel()
+			}
 
-		if len(eventErrors) > 0 {
-			a.logger.Info("some events failed to send to destination", "destination", destination.Kind, "error_count", len(eventErrors))
-			allEventErrors = append(allEventErrors, eventErrors...)
-		} else {
-			a.logger.Info("successfully sent events to destination", "destination", destination.Kind, "count", len(filteredEvents))
+			a.logger.Info("sending events to destination", "destination", send.destination, "count", len(send.deliveries))
+			start := time.Now()
+			eventErrors, err := send.send(sendCtx)
+			metrics.DestinationSends.WithLabelValues(send.destination).Inc()
+			metrics.DestinationSendDuration.WithLabelValues(send.destination).Observe(time.Since(start).Seconds())
+			if err != nil && sendCtx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("timed out after %s: %w", time.Since(start).Round(time.Millisecond), err)
+			}
+			results[i] = a.recordDeliveries(send.destination, send.deliveries, eventErrors, err, tracker)
+			if len(results[i]) > 0 {
+				failedIDs := make([]int64, len(results[i]))
+				for j, eventError := range results[i] {
+					failedIDs[j] = eventError.EventID
+				}
+				span.SetAttributes(attribute.Int64Slice("pg_track_events.failed_event_ids", failedIDs))
+				if err != nil {
+					tracing.RecordError(span, err)
+				} else {
+					tracing.RecordError(span, results[i][0].Error)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var allEventErrors []*destinations.DestinationEventError
+	for _, eventErrors := range results {
+		allEventErrors = append(allEventErrors, eventErrors...)
+	}
+	return allEventErrors
+}
+
+// recordDeliveries marks every event sent to the destination as delivered unless it failed.
+// A top-level error from SendBatch fails all of the events sent to that destination only,
+// so the remaining destinations still receive the batch and are not retried later.
+func (a *Agent) recordDeliveries(destinationName string, deliveries []eventDelivery, eventErrors []*destinations.DestinationEventError, err error, tracker *deliveryTracker) []*destinations.DestinationEventError {
+	if err != nil {
+		a.logger.Error("failed to send events to destination", "destination", destinationName, "error", err)
+		eventErrors = make([]*destinations.DestinationEventError, len(deliveries))
+		for i, delivery := range deliveries {
+			eventErrors[i] = &destinations.DestinationEventError{EventID: delivery.dbEventID, ProcessedEventKey: delivery.processedEventKey, Error: err}
 		}
 	}
 
-	return allEventErrors, nil
+	failed := make(map[eventDelivery]struct{}, len(eventErrors))
+	for _, eventError := range eventErrors {
+		failed[eventDelivery{dbEventID: eventError.EventID, processedEventKey: eventError.ProcessedEventKey}] = struct{}{}
+		kind, _ := destinations.ClassifyError(eventError.Error)
+		metrics.DestinationErrors.WithLabelValues(destinationName, kind.String()).Inc()
+		eventError.Destination = destinationName
+		eventError.Error = fmt.Errorf("%s: %w", destinationName, eventError.Error)
+	}
+	for _, delivery := range deliveries {
+		if _, ok := failed[delivery]; !ok {
+			tracker.markDelivered(delivery, destinationName)
+		}
+	}
+
+	metrics.DestinationEvents.WithLabelValues(destinationName, "delivered").Add(float64(len(deliveries) - len(failed)))
+	metrics.DestinationEvents.WithLabelValues(destinationName, "failed").Add(float64(len(failed)))
+
+	if len(eventErrors) > 0 {
+		a.status.recordSend(destinationName, eventErrors[0].Error)
+		a.logger.Info("some events failed to send to destination", "destination", destinationName, "error_count", len(eventErrors))
+	} else {
+		a.status.recordSend(destinationName, nil)
+		a.logger.Info("successfully sent events to destination", "destination", destinationName, "count", len(deliveries))
+	}
+
+	return eventErrors
+}
+
+// processedEventDelivery returns the delivery of a processed event, tracked on its DB event
+func processedEventDelivery(event *eventmodels.ProcessedEvent) eventDelivery {
+	return eventDelivery{dbEventID: event.DBEventID, processedEventKey: event.Key}
+}
+
+// dbEventDelivery returns the delivery of a DB event
+func dbEventDelivery(event *eventmodels.DBEvent) eventDelivery {
+	return eventDelivery{dbEventID: event.ID}
+}
+
+// undeliveredEvents drops the events that the destination has already acknowledged
+func undeliveredEvents[T any](events []T, destinationName string, tracker *deliveryTracker, delivery func(T) eventDelivery) []T {
+	pending := make([]T, 0, len(events))
+	for _, event := range events {
+		if !tracker.isDelivered(delivery(event), destinationName) {
+			pending = append(pending, event)
+		}
+	}
+	return pending
 }
 
 func (a *Agent) filterProcessedEvents(events []*eventmodels.ProcessedEvent, filter string) []*eventmodels.ProcessedEvent {
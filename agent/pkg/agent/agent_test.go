@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/pkg/destinations"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+	"github.com/typeeng/pg_track_events/agent/pkg/sources"
+)
+
+const testEventsConfig = `
+track:
+  users.insert:
+    event: USER_SIGNUP
+    properties:
+      email: new.email
+  users.update:
+    - event: USER_UPDATED
+    - event: PLAN_CHANGED
+      cond: old.plan != new.plan
+`
+
+// fakeDestination records the processed events it receives and rejects the ones in reject
+type fakeDestination struct {
+	mu      sync.Mutex
+	batches [][]string
+	reject  map[string]error
+}
+
+func (d *fakeDestination) SendBatch(ctx context.Context, processedEvents []*eventmodels.ProcessedEvent) ([]*destinations.DestinationEventError, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var ids []string
+	var eventErrors []*destinations.DestinationEventError
+	for _, event := range processedEvents {
+		ids = append(ids, event.ID)
+		if err, ok := d.reject[event.ID]; ok {
+			eventErrors = append(eventErrors, destinations.NewProcessedEventError(event, err))
+		}
+	}
+	d.batches = append(d.batches, ids)
+	return eventErrors, nil
+}
+
+func newTestAgent(t *testing.T, destination *fakeDestination, events ...*eventmodels.DBEvent) (*Agent, *sources.MemorySource, context.Context) {
+	t.Helper()
+	cfg, err := LoadAgentConfig(WithDatabaseURL("postgres://localhost/test"), WithConfigBytes([]byte(testEventsConfig)))
+	if err != nil {
+		t.Fatalf("LoadAgentConfig() error = %v", err)
+	}
+
+	ctx := context.Background()
+	source := sources.NewMemorySource(10, events...)
+	a, err := NewAgent(ctx, nil, cfg, WithSources(source))
+	if err != nil {
+		t.Fatalf("NewAgent() error = %v", err)
+	}
+	a.swapPipeline(&pipeline{
+		compiledSchema: &compiledSchema{streaming: cfg.EventStreamingConfig},
+		processedEventDestinations: []config.InitializedProcessedEventDestination{
+			{Name: "test", Filter: "*", Destination: destination},
+		},
+	})
+	return a, source, config.WithConfig(ctx, cfg)
+}
+
+func testDBEvents() []*eventmodels.DBEvent {
+	return []*eventmodels.DBEvent{
+		{
+			ID:           1,
+			EventType:    eventmodels.EventTypeInsert,
+			RowTableName: "users",
+			NewRow:       json.RawMessage(`{"id": 7, "email": "a@example.com", "plan": "free"}`),
+		},
+		{
+			ID:           2,
+			EventType:    eventmodels.EventTypeUpdate,
+			RowTableName: "users",
+			OldRow:       json.RawMessage(`{"id": 7, "email": "a@example.com", "plan": "free"}`),
+			NewRow:       json.RawMessage(`{"id": 7, "email": "a@example.com", "plan": "pro"}`),
+		},
+	}
+}
+
+func processBatch(t *testing.T, ctx context.Context, a *Agent, source *sources.MemorySource) {
+	t.Helper()
+	if _, err := a.processBatch(ctx, source); err != nil {
+		t.Fatalf("processBatch() error = %v", err)
+	}
+}
+
+func TestProcessBatch(t *testing.T) {
+	destination := &fakeDestination{}
+	a, source, ctx := newTestAgent(t, destination, testDBEvents()...)
+
+	processBatch(t, ctx, a, source)
+
+	if len(destination.batches) != 1 || !slices.Equal(destination.batches[0], []string{"1", "2:USER_UPDATED", "2:PLAN_CHANGED"}) {
+		t.Errorf("destination received %v, want [[1 2:USER_UPDATED 2:PLAN_CHANGED]]", destination.batches)
+	}
+	if acked := source.Acked(); !slices.Equal(acked, []int64{1, 2}) {
+		t.Errorf("Acked() = %v, want [1 2]", acked)
+	}
+	if source.Pending() != 0 {
+		t.Errorf("Pending() = %d, want 0", source.Pending())
+	}
+}
+
+func TestProcessBatchRetriesRejectedEvents(t *testing.T) {
+	destination := &fakeDestination{
+		reject: map[string]error{"2:USER_UPDATED": destinations.NewRetryableError(errors.New("timeout"))},
+	}
+	dbEvents := testDBEvents()
+	a, source, ctx := newTestAgent(t, destination, dbEvents...)
+
+	processBatch(t, ctx, a, source)
+
+	if acked := source.Acked(); !slices.Equal(acked, []int64{1}) {
+		t.Errorf("Acked() = %v, want [1]", acked)
+	}
+	failed := dbEvents[1]
+	if failed.Retries != 1 || failed.ProcessAfter == nil {
+		t.Fatalf("failed event has %d retries and ProcessAfter %v, want it scheduled for a retry", failed.Retries, failed.ProcessAfter)
+	}
+	if !slices.Equal(failed.DeliveredTo, []string{"test:PLAN_CHANGED"}) {
+		t.Errorf("DeliveredTo = %v, want [test:PLAN_CHANGED]", failed.DeliveredTo)
+	}
+
+	// Retry right away, only the rejected event is sent again
+	delete(destination.reject, "2:USER_UPDATED")
+	failed.ProcessAfter = nil
+	processBatch(t, ctx, a, source)
+
+	if len(destination.batches) != 2 || !slices.Equal(destination.batches[1], []string{"2:USER_UPDATED"}) {
+		t.Errorf("destination received %v on retry, want [2:USER_UPDATED]", destination.batches[1:])
+	}
+	if acked := source.Acked(); !slices.Equal(acked, []int64{1, 2}) {
+		t.Errorf("Acked() = %v, want [1 2]", acked)
+	}
+}
+
+func TestProcessBatchRetriesReenqueuedReplicatedEvents(t *testing.T) {
+	destination := &fakeDestination{
+		reject: map[string]error{"7000:USER_UPDATED": destinations.NewRetryableError(errors.New("timeout"))},
+	}
+	// Replicated events are identified by their LSN
+	replicated := testDBEvents()[1]
+	replicated.ID = 7000
+	a, source, ctx := newTestAgent(t, destination, replicated)
+
+	processBatch(t, ctx, a, source)
+
+	// The replication batch moves the failed event to the event log, where it gets a new ID
+	// and keeps the destinations it was delivered to
+	requeued := *replicated
+	requeued.ID = 3
+	requeued.ProcessAfter = nil
+	source = sources.NewMemorySource(10, &requeued)
+	processBatch(t, ctx, a, source)
+
+	if len(destination.batches) != 2 || !slices.Equal(destination.batches[1], []string{"3:USER_UPDATED"}) {
+		t.Errorf("destination received %v on retry, want [3:USER_UPDATED]", destination.batches[1:])
+	}
+	if acked := source.Acked(); !slices.Equal(acked, []int64{3}) {
+		t.Errorf("Acked() = %v, want [3]", acked)
+	}
+}
+
+func TestProcessBatchDeadLettersPermanentErrors(t *testing.T) {
+	destination := &fakeDestination{
+		reject: map[string]error{"1": destinations.NewPermanentError(errors.New("invalid event"))},
+	}
+	a, source, ctx := newTestAgent(t, destination, testDBEvents()...)
+	a.cfg.MaxRetries = 5
+
+	processBatch(t, ctx, a, source)
+
+	deadLettered := source.DeadLettered()
+	if len(deadLettered) != 1 || deadLettered[0].ID != 1 {
+		t.Fatalf("DeadLettered() = %v, want event 1", deadLettered)
+	}
+	if want := "test: invalid event"; deadLettered[0].LastError == nil || *deadLettered[0].LastError != want {
+		t.Errorf("LastError = %v, want %q", deadLettered[0].LastError, want)
+	}
+	if acked := source.Acked(); !slices.Equal(acked, []int64{2}) {
+		t.Errorf("Acked() = %v, want [2]", acked)
+	}
+	if source.Pending() != 0 {
+		t.Errorf("Pending() = %d, want 0", source.Pending())
+	}
+}
+
+func TestProcessBatchRetriesPermanentErrorsWithoutMaxRetries(t *testing.T) {
+	destination := &fakeDestination{
+		reject: map[string]error{"1": destinations.NewPermanentError(errors.New("invalid event"))},
+	}
+	dbEvents := testDBEvents()
+	a, source, ctx := newTestAgent(t, destination, dbEvents...)
+
+	processBatch(t, ctx, a, source)
+
+	if deadLettered := source.DeadLettered(); len(deadLettered) != 0 {
+		t.Errorf("DeadLettered() = %v, want none with dead-lettering disabled", deadLettered)
+	}
+	if source.Pending() != 1 || dbEvents[0].Retries != 1 || dbEvents[0].ProcessAfter == nil {
+		t.Errorf("event 1 has %d retries and ProcessAfter %v, want it scheduled for a retry", dbEvents[0].Retries, dbEvents[0].ProcessAfter)
+	}
+}
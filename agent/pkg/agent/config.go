@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"io"
+
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+)
+
+// Config is the agent's configuration, load it with LoadAgentConfig
+type Config = config.AgentConfig
+
+// EventStreamingConfig is the events config, usually read from pg_track_events.config.yaml
+type EventStreamingConfig = config.EventStreamingConfig
+
+// LoadOption changes where LoadAgentConfig reads the configuration from
+type LoadOption = config.LoadOption
+
+// LoadAgentConfig reads the agent configuration from the environment and the events config
+// from the file at EVENTS_CONFIG_PATH, unless options provide them. Unlike the agent binary it
+// returns an error instead of exiting when the configuration is invalid.
+func LoadAgentConfig(opts ...LoadOption) (*Config, error) {
+	return config.LoadAgentConfig(opts...)
+}
+
+// WithDatabaseURL sets the database URL instead of reading DATABASE_URL
+func WithDatabaseURL(databaseURL string) LoadOption {
+	return config.WithDatabaseURL(databaseURL)
+}
+
+// WithConfigPath reads the events config from the file instead of EVENTS_CONFIG_PATH
+func WithConfigPath(path string) LoadOption {
+	return config.WithEventStreamingConfigPath(path)
+}
+
+// WithConfigBytes parses the events config from the YAML
+func WithConfigBytes(data []byte) LoadOption {
+	return config.WithEventStreamingConfigBytes(data)
+}
+
+// WithConfigReader parses the events config from the YAML read from r
+func WithConfigReader(r io.Reader) LoadOption {
+	return config.WithEventStreamingConfigReader(r)
+}
+
+// WithEventStreamingConfig uses the events config as is, after validating it
+func WithEventStreamingConfig(esc *EventStreamingConfig) LoadOption {
+	return config.WithEventStreamingConfig(esc)
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+// eventDelivery is one event sent to a destination. Deliveries are recorded on the DB event,
+// for a processed event together with its key since a DB event can generate several.
+type eventDelivery struct {
+	dbEventID int64
+	// processedEventKey is empty for DB events
+	processedEventKey string
+}
+
+// deliveredToEntry returns how the destination's delivery of the event is recorded in
+// event_log.delivered_to: the destination name for DB events and "<destination>:<processed
+// event key>" for processed events. The entries don't hold the DB event ID, so they still
+// apply when a failed replicated event gets a new one in the event log.
+func (d eventDelivery) deliveredToEntry(destination string) string {
+	if d.processedEventKey == "" {
+		return destination
+	}
+	return destination + ":" + d.processedEventKey
+}
+
+// deliveryTracker records which destinations have acknowledged each event in a batch.
+// It is seeded with the deliveries persisted in event_log.delivered_to so that retries
+// only go to the destinations that previously failed. Destinations are sent to concurrently
+// so it is safe for concurrent use.
+type deliveryTracker struct {
+	mu sync.Mutex
+	// delivered holds the delivered_to entries of each DB event
+	delivered map[int64]map[string]struct{}
+}
+
+func newDeliveryTracker(dbEvents []*eventmodels.DBEvent) *deliveryTracker {
+	t := &deliveryTracker{
+		delivered: make(map[int64]map[string]struct{}, len(dbEvents)),
+	}
+	for _, dbEvent := range dbEvents {
+		entries := make(map[string]struct{}, len(dbEvent.DeliveredTo))
+		for _, entry := range dbEvent.DeliveredTo {
+			entries[entry] = struct{}{}
+		}
+		t.delivered[dbEvent.ID] = entries
+	}
+	return t
+}
+
+// isDelivered reports whether the destination already acknowledged the event. A processed
+// event destination recorded by name alone, as older versions did, received all of the DB
+// event's processed events.
+func (t *deliveryTracker) isDelivered(delivery eventDelivery, destination string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := t.delivered[delivery.dbEventID]
+	if _, ok := entries[delivery.deliveredToEntry(destination)]; ok {
+		return true
+	}
+	_, ok := entries[destination]
+	return ok
+}
+
+// markDelivered records that the destination acknowledged the event
+func (t *deliveryTracker) markDelivered(delivery eventDelivery, destination string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries, ok := t.delivered[delivery.dbEventID]
+	if !ok {
+		entries = make(map[string]struct{})
+		t.delivered[delivery.dbEventID] = entries
+	}
+	entries[delivery.deliveredToEntry(destination)] = struct{}{}
+}
+
+// deliveredTo returns the sorted delivered_to entries of the DB event
+func (t *deliveryTracker) deliveredTo(eventID int64) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := make([]string, 0, len(t.delivered[eventID]))
+	for entry := range t.delivered[eventID] {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	return entries
+}
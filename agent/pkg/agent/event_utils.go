@@ -1,16 +1,26 @@
 package agent
 
 import (
+	"context"
+	"slices"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+	"github.com/typeeng/pg_track_events/agent/pkg/destinations"
 	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
 )
 
 // GenerateEventErrorUpdate creates a DBEventUpdate for a failed event
 // It increments retries, sets the error, last retry time, and calculates next retry time
+// based on the error classification: permanent errors are dead-lettered immediately if dead-lettering
+// is enabled (see MAX_RETRIES), rate limited errors honor the destination's Retry-After, and
+// everything else backs off exponentially
 func GenerateEventErrorUpdate(eventID int64, currentRetries int, err error) *eventmodels.DBEventUpdate {
 	now := time.Now()
 	errStr := err.Error()
+	kind, retryAfter := destinations.ClassifyError(err)
 
 	// Calculate next retry time with exponential backoff
 	// Base delay is 1 minute, doubled for each retry up to a reasonable maximum
@@ -21,12 +31,18 @@ func GenerateEventErrorUpdate(eventID int64, currentRetries int, err error) *eve
 	}
 	processAfter = now.Add(time.Duration(delayMinutes) * time.Minute)
 
+	// Destinations that are rate limiting us tell us when to come back
+	if kind == destinations.ErrorKindRateLimited && retryAfter > 0 {
+		processAfter = now.Add(retryAfter)
+	}
+
 	return &eventmodels.DBEventUpdate{
 		ID:           eventID,
 		Retries:      currentRetries + 1,
 		LastError:    &errStr,
 		LastRetryAt:  &now,
 		ProcessAfter: &processAfter,
+		DeadLetter:   kind == destinations.ErrorKindPermanent,
 	}
 }
 
@@ -79,6 +95,16 @@ func MergeEventErrorUpdates(updates []*eventmodels.DBEventUpdate) []*eventmodels
 				existingUpdate.ProcessAfter = update.ProcessAfter
 			}
 
+			// Collect every destination that rejected the event
+			for _, destination := range update.FailedDestinations {
+				if !slices.Contains(existingUpdate.FailedDestinations, destination) {
+					existingUpdate.FailedDestinations = append(existingUpdate.FailedDestinations, destination)
+				}
+			}
+
+			// Only dead-letter if every failure was permanent, a retryable failure should still be retried
+			existingUpdate.DeadLetter = existingUpdate.DeadLetter && update.DeadLetter
+
 			// Keep the latest retry attempt time
 			if update.LastRetryAt != nil &&
 				(existingUpdate.LastRetryAt == nil ||
@@ -99,3 +125,12 @@ func MergeEventErrorUpdates(updates []*eventmodels.DBEventUpdate) []*eventmodels
 
 	return result
 }
+
+// ReplayDeadLetters moves dead-lettered events back into the event queue so they are retried.
+// Only events matching the given IDs and table are replayed; empty values match all events.
+func ReplayDeadLetters(ctx context.Context, pool *pgxpool.Pool, cfg *Config, eventIDs []int64, tableName string) (int64, error) {
+	return db.ReplayDeadLetters(config.WithConfig(ctx, cfg), pool, db.ReplayDeadLetterFilter{
+		EventIDs:     eventIDs,
+		RowTableName: tableName,
+	})
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/typeeng/pg_track_events/agent/pkg/destinations"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+func TestGenerateEventErrorUpdate(t *testing.T) {
+	tests := []struct {
+		name           string
+		retries        int
+		err            error
+		wantDelay      time.Duration
+		wantDeadLetter bool
+	}{
+		{name: "first failure", retries: 0, err: errors.New("timeout"), wantDelay: time.Minute},
+		{name: "backs off exponentially", retries: 3, err: errors.New("timeout"), wantDelay: 8 * time.Minute},
+		{name: "backoff is capped", retries: 10, err: errors.New("timeout"), wantDelay: time.Hour},
+		{
+			name:           "permanent errors are dead-lettered",
+			retries:        0,
+			err:            destinations.NewPermanentError(errors.New("invalid event")),
+			wantDelay:      time.Minute,
+			wantDeadLetter: true,
+		},
+		{
+			name:      "rate limited errors honor Retry-After",
+			retries:   0,
+			err:       destinations.NewRateLimitedError(errors.New("slow down"), 30*time.Second),
+			wantDelay: 30 * time.Second,
+		},
+		{
+			name:      "rate limited errors without Retry-After back off",
+			retries:   2,
+			err:       destinations.NewRateLimitedError(errors.New("slow down"), 0),
+			wantDelay: 4 * time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := GenerateEventErrorUpdate(7, tt.retries, tt.err)
+
+			if update.ID != 7 || update.Retries != tt.retries+1 {
+				t.Errorf("update = %d with %d retries, want 7 with %d", update.ID, update.Retries, tt.retries+1)
+			}
+			if update.LastError == nil || *update.LastError != tt.err.Error() {
+				t.Errorf("LastError = %v, want %q", update.LastError, tt.err.Error())
+			}
+			if delay := update.ProcessAfter.Sub(*update.LastRetryAt); delay != tt.wantDelay {
+				t.Errorf("retry delay = %v, want %v", delay, tt.wantDelay)
+			}
+			if update.DeadLetter != tt.wantDeadLetter {
+				t.Errorf("DeadLetter = %v, want %v", update.DeadLetter, tt.wantDeadLetter)
+			}
+		})
+	}
+}
+
+func TestMergeEventErrorUpdates(t *testing.T) {
+	now := time.Now()
+	soon := now.Add(time.Minute)
+	later := now.Add(time.Hour)
+	update := func(id int64, retries int, lastError string, processAfter time.Time, deadLetter bool, failed ...string) *eventmodels.DBEventUpdate {
+		return &eventmodels.DBEventUpdate{
+			ID:                 id,
+			Retries:            retries,
+			LastError:          &lastError,
+			LastRetryAt:        &now,
+			ProcessAfter:       &processAfter,
+			FailedDestinations: failed,
+			DeadLetter:         deadLetter,
+		}
+	}
+
+	t.Run("updates for the same event are combined", func(t *testing.T) {
+		merged := MergeEventErrorUpdates([]*eventmodels.DBEventUpdate{
+			update(1, 1, "timeout", later, false, "mixpanel"),
+			update(1, 2, "invalid event", soon, true, "amplitude", "mixpanel"),
+			update(2, 1, "timeout", later, false, "mixpanel"),
+		})
+		slices.SortFunc(merged, func(a, b *eventmodels.DBEventUpdate) int { return int(a.ID - b.ID) })
+
+		if len(merged) != 2 {
+			t.Fatalf("MergeEventErrorUpdates() returned %d updates, want 2", len(merged))
+		}
+		first := merged[0]
+		if first.Retries != 2 {
+			t.Errorf("Retries = %d, want 2", first.Retries)
+		}
+		if *first.LastError != "timeout; invalid event" {
+			t.Errorf("LastError = %q, want both errors", *first.LastError)
+		}
+		if !first.ProcessAfter.Equal(soon) {
+			t.Errorf("ProcessAfter = %v, want the earliest %v", first.ProcessAfter, soon)
+		}
+		if !slices.Equal(first.FailedDestinations, []string{"mixpanel", "amplitude"}) {
+			t.Errorf("FailedDestinations = %v, want [mixpanel amplitude]", first.FailedDestinations)
+		}
+		if first.DeadLetter {
+			t.Error("DeadLetter = true, want false since one failure is retryable")
+		}
+		if merged[1].ID != 2 || *merged[1].LastError != "timeout" {
+			t.Errorf("second update = %+v, want event 2 unchanged", merged[1])
+		}
+	})
+
+	t.Run("dead-lettered when every failure is permanent", func(t *testing.T) {
+		merged := MergeEventErrorUpdates([]*eventmodels.DBEventUpdate{
+			update(1, 1, "invalid event", soon, true, "mixpanel"),
+			update(1, 1, "invalid event", soon, true, "amplitude"),
+		})
+		if len(merged) != 1 || !merged[0].DeadLetter || *merged[0].LastError != "invalid event" {
+			t.Errorf("MergeEventErrorUpdates() = %+v, want one dead-lettered update", merged)
+		}
+	})
+}
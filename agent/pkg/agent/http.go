@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+	"github.com/typeeng/pg_track_events/agent/internal/metrics"
+)
+
+// readyzTimeout bounds the database ping done by /readyz
+const readyzTimeout = 2 * time.Second
+
+// statusResponse is the body of the /status endpoint
+type statusResponse struct {
+	Ready        bool                         `json:"ready"`
+	AgentID      string                       `json:"agent_id"`
+	StartedAt    time.Time                    `json:"started_at"`
+	LastBatchAt  map[string]time.Time         `json:"last_batch_at"`
+	Queue        *db.QueueStats               `json:"queue,omitempty"`
+	QueueError   string                       `json:"queue_error,omitempty"`
+	Destinations map[string]destinationStatus `json:"destinations"`
+}
+
+// httpHandler serves the health, readiness and status endpoints
+func (a *Agent) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// The process is up and serving requests
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+
+	// The schema is loaded, the config validated against it and the database is reachable.
+	// Destinations are initialized before the server starts.
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !a.status.isReady() {
+			http.Error(w, "not ready: schema not loaded or agent shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), readyzTimeout)
+		defer cancel()
+		if err := a.db.Ping(ctx); err != nil {
+			http.Error(w, "not ready: database unreachable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		ready, startedAt, lastBatchAt, destinations := a.status.snapshot()
+		response := statusResponse{
+			Ready:        ready,
+			AgentID:      a.cfg.AgentID,
+			StartedAt:    startedAt,
+			LastBatchAt:  lastBatchAt,
+			Destinations: destinations,
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readyzTimeout)
+		defer cancel()
+		queue, err := a.queueStats.get(ctx)
+		if err != nil {
+			response.QueueError = err.Error()
+		} else {
+			response.Queue = queue
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+
+	metrics.RegisterQueueCollector(a.queueStats.get)
+	mux.Handle("GET /metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+
+	return mux
+}
+
+// fetchQueueStats queries the event log stats, use queueStats to share them between callers
+func (a *Agent) fetchQueueStats(ctx context.Context) (*db.QueueStats, error) {
+	return db.GetQueueStats(config.WithConfig(ctx, a.cfg), a.db)
+}
+
+// serveHTTP serves the HTTP endpoints on addr until ctx is done
+func (a *Agent) serveHTTP(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           a.httpHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		// Requests get the agent's config from ctx
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	a.logger.Info("serving HTTP endpoints", "addr", listener.Addr().String())
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.logger.Error("HTTP server stopped", "error", err)
+		}
+	}()
+	return nil
+}
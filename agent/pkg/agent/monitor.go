@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+)
+
+// webhookTimeout bounds each call to the monitoring webhook
+const webhookTimeout = 10 * time.Second
+
+// monitorInterval returns how often to check the event log for the monitoring config
+func monitorInterval(monitoring *config.MonitoringConfig) time.Duration {
+	if monitoring == nil {
+		return idleMonitorInterval
+	}
+	return monitoring.Interval
+}
+
+// thresholdBreach is a monitoring threshold the queue is over
+type thresholdBreach struct {
+	Threshold string `json:"threshold"`
+	Limit     string `json:"limit"`
+	Value     string `json:"value"`
+}
+
+// queueAlert is the body posted to the monitoring webhook
+type queueAlert struct {
+	// Status is "firing" when a threshold is exceeded and "resolved" once none are
+	Status   string            `json:"status"`
+	AgentID  string            `json:"agent_id"`
+	At       time.Time         `json:"at"`
+	Queue    *db.QueueStats    `json:"queue"`
+	Breaches []thresholdBreach `json:"breaches"`
+}
+
+// idleMonitorInterval is how often the monitor checks whether a reload turned monitoring on
+const idleMonitorInterval = time.Minute
+
+// monitorQueue checks the event log until ctx is done, logging the queue stats and alerting
+// when they go over the thresholds. The monitoring config is read from the current pipeline
+// on every check, so a reload applies the new thresholds, webhook and interval.
+func (a *Agent) monitorQueue(ctx context.Context) {
+	monitoring := a.currentPipeline().streaming.Monitoring
+	interval := monitorInterval(monitoring)
+	if monitoring != nil {
+		a.logger.Info("monitoring event log", "interval", interval, "webhook", monitoring.WebhookURL != "")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	firing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		next := a.currentPipeline().streaming.Monitoring
+		if next == nil {
+			if monitoring != nil {
+				a.logger.Info("event log monitoring turned off")
+			}
+			monitoring, firing = nil, false
+			if interval != idleMonitorInterval {
+				interval = idleMonitorInterval
+				ticker.Reset(interval)
+			}
+			continue
+		}
+		if monitoring == nil || *next != *monitoring {
+			a.logger.Info("monitoring event log", "interval", next.Interval, "webhook", next.WebhookURL != "")
+		}
+		monitoring = next
+		if interval != monitoring.Interval {
+			interval = monitoring.Interval
+			ticker.Reset(interval)
+		}
+
+		stats, err := a.queueStats.get(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				a.logger.Error("failed to check event log", "error", err)
+			}
+			continue
+		}
+
+		var oldestAge time.Duration
+		if stats.OldestLoggedAt != nil {
+			oldestAge = time.Since(*stats.OldestLoggedAt)
+		}
+		a.logger.Info("event log stats", "pending", stats.Pending, "due", stats.Due, "retrying", stats.Retrying, "oldest_age", oldestAge)
+
+		breaches := checkThresholds(monitoring, stats, oldestAge)
+		if len(breaches) > 0 {
+			for _, breach := range breaches {
+				a.logger.Warn("event log is over a monitoring threshold", "threshold", breach.Threshold, "limit", breach.Limit, "value", breach.Value)
+			}
+		} else if firing {
+			a.logger.Info("event log is back under the monitoring thresholds")
+		}
+
+		// The webhook is only called when the queue goes over or back under the thresholds
+		if nowFiring := len(breaches) > 0; nowFiring != firing && monitoring.WebhookURL != "" {
+			alert := &queueAlert{
+				Status:   "resolved",
+				AgentID:  a.cfg.AgentID,
+				At:       time.Now(),
+				Queue:    stats,
+				Breaches: breaches,
+			}
+			if nowFiring {
+				alert.Status = "firing"
+			}
+			if err := postAlert(ctx, monitoring.WebhookURL, alert); err != nil {
+				// Try again on the next check
+				a.logger.Error("failed to call monitoring webhook", "error", err)
+				continue
+			}
+		}
+		firing = len(breaches) > 0
+	}
+}
+
+// checkThresholds returns the thresholds the queue is over, thresholds that are zero are not checked
+func checkThresholds(monitoring *config.MonitoringConfig, stats *db.QueueStats, oldestAge time.Duration) []thresholdBreach {
+	breaches := []thresholdBreach{}
+	if monitoring.MaxPending > 0 && stats.Pending > monitoring.MaxPending {
+		breaches = append(breaches, thresholdBreach{
+			Threshold: "max_pending",
+			Limit:     fmt.Sprint(monitoring.MaxPending),
+			Value:     fmt.Sprint(stats.Pending),
+		})
+	}
+	if monitoring.MaxRetrying > 0 && stats.Retrying > monitoring.MaxRetrying {
+		breaches = append(breaches, thresholdBreach{
+			Threshold: "max_retrying",
+			Limit:     fmt.Sprint(monitoring.MaxRetrying),
+			Value:     fmt.Sprint(stats.Retrying),
+		})
+	}
+	if monitoring.MaxOldestAge > 0 && oldestAge > monitoring.MaxOldestAge {
+		breaches = append(breaches, thresholdBreach{
+			Threshold: "max_oldest_age",
+			Limit:     monitoring.MaxOldestAge.String(),
+			Value:     oldestAge.Round(time.Second).String(),
+		})
+	}
+	return breaches
+}
+
+// postAlert posts the alert as JSON to the webhook
+func postAlert(ctx context.Context, webhookURL string, alert *queueAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
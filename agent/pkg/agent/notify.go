@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	listenMinBackoff = time.Second
+	listenMaxBackoff = 30 * time.Second
+)
+
+// listenForNotifications holds a dedicated connection that LISTENs on the notify channel
+// and signals wake whenever the triggers write to the event log. The connection is
+// re-established with backoff if it drops; the fetch ticker keeps processing events meanwhile.
+func (a *Agent) listenForNotifications(ctx context.Context, channel string, wake chan<- struct{}) {
+	backoff := listenMinBackoff
+	for {
+		err := a.listen(ctx, channel, wake, func() { backoff = listenMinBackoff })
+		if ctx.Err() != nil {
+			return
+		}
+		a.logger.Warn("lost notify connection, falling back to polling until reconnected",
+			"channel", channel,
+			"error", err,
+			"retry_in", backoff,
+		)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, listenMaxBackoff)
+	}
+}
+
+// listen connects, LISTENs on the channel and blocks until the connection fails or ctx is done.
+// onListening is called once the LISTEN succeeds.
+func (a *Agent) listen(ctx context.Context, channel string, wake chan<- struct{}, onListening func()) error {
+	conn, err := pgx.ConnectConfig(ctx, a.db.Config().ConnConfig.Copy())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+	a.logger.Info("listening for event log notifications", "channel", channel)
+	onListening()
+
+	// Events may have been written while we were not listening
+	signalWake(wake)
+
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		signalWake(wake)
+	}
+}
+
+// signalWake does not block, a pending wake-up already covers any new events
+func signalWake(wake chan<- struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
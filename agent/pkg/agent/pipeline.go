@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"sync"
+
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/pkg/destinations"
+)
+
+// pipeline is what a batch is processed with: the compiled tracking config and the
+// destinations. A config reload or schema change replaces it as a whole, batches acquire it
+// once so the change takes effect between batches.
+type pipeline struct {
+	*compiledSchema
+	processedEventDestinations []config.InitializedProcessedEventDestination
+	dbEventDestinations        []config.InitializedDBEventDestination
+	// batches counts the batches processed with the pipeline, its retired destinations are
+	// only closed once they are done
+	batches sync.WaitGroup
+}
+
+// withSchema returns a pipeline with the same destinations and the newly compiled schema
+func (p *pipeline) withSchema(compiled *compiledSchema) *pipeline {
+	return &pipeline{
+		compiledSchema:             compiled,
+		processedEventDestinations: p.processedEventDestinations,
+		dbEventDestinations:        p.dbEventDestinations,
+	}
+}
+
+// groupsTransactions reports whether the pipeline has transaction rules, which need batches
+// with all of a transaction's changes
+func (p *pipeline) groupsTransactions() bool {
+	return len(p.streaming.Track.TransactionRules()) > 0
+}
+
+// closers returns the destinations that implement destinations.Closer by name
+func (p *pipeline) closers() map[string]destinations.Closer {
+	closers := make(map[string]destinations.Closer)
+	for _, destination := range p.processedEventDestinations {
+		if closer, ok := destination.Destination.(destinations.Closer); ok {
+			closers[destination.Name] = closer
+		}
+	}
+	for _, destination := range p.dbEventDestinations {
+		if closer, ok := destination.Destination.(destinations.Closer); ok {
+			closers[destination.Name] = closer
+		}
+	}
+	return closers
+}
+
+// acquirePipeline returns the current pipeline for a batch, which must call
+// batches.Done on it when it is finished
+func (a *Agent) acquirePipeline() *pipeline {
+	a.pipelineMu.RLock()
+	defer a.pipelineMu.RUnlock()
+	a.pipeline.batches.Add(1)
+	return a.pipeline
+}
+
+// currentPipeline returns the current pipeline without holding it for a batch
+func (a *Agent) currentPipeline() *pipeline {
+	a.pipelineMu.RLock()
+	defer a.pipelineMu.RUnlock()
+	return a.pipeline
+}
+
+// swapPipeline makes next the pipeline of the following batches. The destinations of the
+// previous pipeline that next doesn't use are closed once its batches are done.
+func (a *Agent) swapPipeline(next *pipeline) {
+	a.pipelineMu.Lock()
+	previous := a.pipeline
+	a.pipeline = next
+	a.pipelineMu.Unlock()
+
+	if previous == nil {
+		return
+	}
+
+	// A destination that was re-initialized keeps its name, so the instances are compared
+	retired := previous.closers()
+	for name, closer := range next.closers() {
+		if retired[name] == closer {
+			delete(retired, name)
+		}
+	}
+	if len(retired) == 0 {
+		return
+	}
+
+	go func() {
+		previous.batches.Wait()
+		// Closing flushes buffered events, give it as long as a shutdown would
+		ctx, cancel := context.WithTimeout(context.Background(), a.cfg.ShutdownTimeout)
+		defer cancel()
+		a.closeClosers(ctx, retired)
+	}()
+}
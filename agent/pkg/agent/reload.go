@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/internal/metrics"
+)
+
+// Reload re-reads the events config file, compiles it against the current schema and swaps
+// it in between batches. Only the destinations that were added or changed are initialized,
+// removed and changed ones are closed once the batches using them are done. If the new
+// config is invalid the agent keeps running with the previous one.
+func (a *Agent) Reload(ctx context.Context) error {
+	if err := a.reload(config.WithConfig(ctx, a.cfg)); err != nil {
+		metrics.ConfigReloads.WithLabelValues("failed").Inc()
+		a.logger.Error("failed to reload events config, keeping the previous config", "error", err)
+		return err
+	}
+	metrics.ConfigReloads.WithLabelValues("applied").Inc()
+	return nil
+}
+
+func (a *Agent) reload(ctx context.Context) error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	path := a.cfg.EventStreamingConfigPath
+	if path == "" {
+		return fmt.Errorf("the events config was not read from a file")
+	}
+	current := a.currentPipeline()
+	if current.compiledSchema == nil {
+		return fmt.Errorf("the agent has not started")
+	}
+
+	a.logger.Info("reloading events config", "path", path)
+	streaming, err := config.ParseEventStreamingConfig(path)
+	if err != nil {
+		return err
+	}
+	// The test destinations' channels are set by agent options, not the file
+	streaming.E2eProcessedEventChan = a.cfg.EventStreamingConfig.E2eProcessedEventChan
+	streaming.E2eDBEventChan = a.cfg.EventStreamingConfig.E2eDBEventChan
+	a.warnRestartRequired(streaming)
+
+	compiled := &compiledSchema{streaming: streaming}
+	if a.strictSchema {
+		if compiled, err = a.loadSchema(ctx, streaming); err != nil {
+			return err
+		}
+	}
+
+	changed := streaming.ChangedDestinations(current.streaming)
+	processedEventDestinations, dbEventDestinations, err := changed.GetInitializedDestinations(a.logger)
+	if err != nil {
+		return err
+	}
+
+	// Keep the destinations that are still configured the same way
+	names := streaming.DestinationNames()
+	initialized := changed.DestinationNames()
+	for _, destination := range current.processedEventDestinations {
+		if names[destination.Name] && !initialized[destination.Name] {
+			processedEventDestinations = append(processedEventDestinations, destination)
+		}
+	}
+	for _, destination := range current.dbEventDestinations {
+		if names[destination.Name] && !initialized[destination.Name] {
+			dbEventDestinations = append(dbEventDestinations, destination)
+		}
+	}
+
+	a.swapPipeline(&pipeline{
+		compiledSchema:             compiled,
+		processedEventDestinations: processedEventDestinations,
+		dbEventDestinations:        dbEventDestinations,
+	})
+	a.logger.Info("reloaded events config",
+		"track", len(streaming.Track),
+		"destinations", len(processedEventDestinations)+len(dbEventDestinations),
+		"initialized", len(initialized),
+	)
+	return nil
+}
+
+// warnRestartRequired logs the settings that changed in the file but are only read at startup
+func (a *Agent) warnRestartRequired(streaming *config.EventStreamingConfig) {
+	started := a.cfg.EventStreamingConfig
+	if streaming.NotifyChannel != started.NotifyChannel {
+		a.logger.Warn("notify_channel changed, restart the agent to apply it")
+	}
+	if !reflect.DeepEqual(streaming.Replication, started.Replication) {
+		a.logger.Warn("replication changed, restart the agent to apply it")
+	}
+}
+
+// watchConfig reloads the events config whenever the file's contents change, checking every
+// interval until ctx is done
+func (a *Agent) watchConfig(ctx context.Context, interval time.Duration) {
+	path := a.cfg.EventStreamingConfigPath
+	last, err := os.ReadFile(path)
+	if err != nil {
+		a.logger.Error("failed to read events config, not watching it for changes", "path", path, "error", err)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			// The file may be in the middle of being replaced
+			a.logger.Warn("failed to read events config", "path", path, "error", err)
+			continue
+		}
+		if bytes.Equal(contents, last) {
+			continue
+		}
+		// An invalid config isn't retried until the file changes again
+		last = contents
+		a.Reload(ctx)
+	}
+}
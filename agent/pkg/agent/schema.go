@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+	"github.com/typeeng/pg_track_events/agent/internal/metrics"
+	"github.com/typeeng/pg_track_events/agent/pkg/schemas"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// compiledSchema is the database schema and the tracking config compiled against it. It is
+// replaced as a whole when the schema changes so an event never sees a mismatched pair.
+type compiledSchema struct {
+	schema       schemas.PostgresqlTableSchemaList
+	pbDescriptor protoreflect.FileDescriptor
+	streaming    *config.EventStreamingConfig
+}
+
+// loadSchema reads the database schema and compiles the tracking config of streaming against
+// it. The config is left untouched, the compiled programs are built on a copy.
+func (a *Agent) loadSchema(ctx context.Context, streaming *config.EventStreamingConfig) (*compiledSchema, error) {
+	if a.schemaPbPkgName == nil {
+		return nil, fmt.Errorf("schema package name not set")
+	}
+
+	schema, err := db.GetSchema(ctx, a.db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema: %w", err)
+	}
+	schema = schema.ApplyIgnoresToSchema(streaming.Ignore)
+
+	pbDescriptor, err := a.generatePbDescriptor(schema)
+	if err != nil {
+		return nil, err
+	}
+	return compileSchema(streaming, a.schemaPbPkgName, schema, pbDescriptor)
+}
+
+func (a *Agent) generatePbDescriptor(schema schemas.PostgresqlTableSchemaList) (protoreflect.FileDescriptor, error) {
+	pbDescriptor, err := schema.GeneratePbDescriptorForTables(*a.schemaPbPkgName, fmt.Sprintf("%s.*", a.cfg.DefaultSchemaName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate protobuf descriptor: %w", err)
+	}
+	return pbDescriptor, nil
+}
+
+// compileSchema compiles a copy of the tracking config with the schema's protobuf descriptor
+func compileSchema(streaming *config.EventStreamingConfig, pbPkgName *string, schema schemas.PostgresqlTableSchemaList, pbDescriptor protoreflect.FileDescriptor) (*compiledSchema, error) {
+	compiled := *streaming
+	compiled.Track = compiled.Track.Clone()
+	if err := compiled.Track.Compile(pbPkgName, pbDescriptor); err != nil {
+		return nil, fmt.Errorf("failed to validate event streaming config against schema: %w", err)
+	}
+
+	return &compiledSchema{
+		schema:       schema,
+		pbDescriptor: pbDescriptor,
+		streaming:    &compiled,
+	}, nil
+}
+
+// watchSchema re-reads the database schema every interval until ctx is done. When a
+// migration changed it, the descriptor and CEL programs are rebuilt and swapped in. If the
+// config no longer compiles against the new schema the error is sent on failed and the
+// watch stops, processing events with the stale programs would silently drop or mangle fields.
+func (a *Agent) watchSchema(ctx context.Context, interval time.Duration, failed chan<- error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := a.checkSchema(ctx); err != nil {
+			failed <- err
+			return
+		}
+	}
+}
+
+// checkSchema re-reads the database schema and swaps in a pipeline compiled against it if it
+// changed. Failing to read the schema is only logged, the error is for a config that no longer compiles.
+func (a *Agent) checkSchema(ctx context.Context) error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	current := a.currentPipeline()
+	schema, err := db.GetSchema(ctx, a.db)
+	if err != nil {
+		if ctx.Err() == nil {
+			a.logger.Error("failed to check schema for changes", "error", err)
+		}
+		return nil
+	}
+	schema = schema.ApplyIgnoresToSchema(current.streaming.Ignore)
+
+	// Only the tables and columns the descriptor is built from matter to the CEL programs
+	pbDescriptor, err := a.generatePbDescriptor(schema)
+	if err != nil {
+		return err
+	}
+	if proto.Equal(protodesc.ToFileDescriptorProto(pbDescriptor), protodesc.ToFileDescriptorProto(current.pbDescriptor)) {
+		return nil
+	}
+
+	a.logger.Info("schema changed, recompiling event streaming config", "tables", len(schema))
+	compiled, err := compileSchema(current.streaming, a.schemaPbPkgName, schema, pbDescriptor)
+	if err != nil {
+		return err
+	}
+	a.swapPipeline(current.withSchema(compiled))
+	metrics.SchemaReloads.Inc()
+	a.logger.Info("reloaded schema")
+	return nil
+}
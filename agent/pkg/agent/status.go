@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+)
+
+// agentStatus tracks what the agent has been doing for the readiness and status endpoints.
+// It is updated by every worker so it is safe for concurrent use.
+type agentStatus struct {
+	mu           sync.Mutex
+	ready        bool
+	startedAt    time.Time
+	lastBatchAt  map[string]time.Time
+	destinations map[string]*destinationStatus
+}
+
+// destinationStatus is the outcome of the latest sends to a destination
+type destinationStatus struct {
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+func newAgentStatus() *agentStatus {
+	return &agentStatus{
+		startedAt:    time.Now(),
+		lastBatchAt:  make(map[string]time.Time),
+		destinations: make(map[string]*destinationStatus),
+	}
+}
+
+// setReady marks the schema as loaded and the config as validated
+func (s *agentStatus) setReady(ready bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready = ready
+}
+
+func (s *agentStatus) isReady() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+// recordBatch records that a batch from the source was committed
+func (s *agentStatus) recordBatch(source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastBatchAt[source] = time.Now()
+}
+
+// recordSend records the outcome of a send to the destination, err is nil if every event was delivered
+func (s *agentStatus) recordSend(destination string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, ok := s.destinations[destination]
+	if !ok {
+		status = &destinationStatus{}
+		s.destinations[destination] = status
+	}
+	now := time.Now()
+	if err != nil {
+		status.LastErrorAt = &now
+		status.LastError = err.Error()
+	} else {
+		status.LastSuccessAt = &now
+	}
+}
+
+// snapshot copies the status so it can be serialized without holding the lock
+func (s *agentStatus) snapshot() (ready bool, startedAt time.Time, lastBatchAt map[string]time.Time, destinations map[string]destinationStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastBatchAt = make(map[string]time.Time, len(s.lastBatchAt))
+	for source, at := range s.lastBatchAt {
+		lastBatchAt[source] = at
+	}
+	destinations = make(map[string]destinationStatus, len(s.destinations))
+	for name, status := range s.destinations {
+		destinations[name] = *status
+	}
+	return s.ready, s.startedAt, lastBatchAt, destinations
+}
+
+// queueStatsMaxAge is how long the event log stats are reused. Counting the event log scans
+// the whole table, so the /metrics scrapes, /status and the monitor share one query per interval.
+const queueStatsMaxAge = 15 * time.Second
+
+// queueStatsCache caches the event log stats, see queueStatsMaxAge
+type queueStatsCache struct {
+	mu        sync.Mutex
+	fetch     func(ctx context.Context) (*db.QueueStats, error)
+	stats     *db.QueueStats
+	fetchedAt time.Time
+}
+
+// get returns the stats, querying them again once they are older than queueStatsMaxAge.
+// Concurrent callers wait for the same query. Errors are not cached.
+func (c *queueStatsCache) get(ctx context.Context) (*db.QueueStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stats != nil && time.Since(c.fetchedAt) < queueStatsMaxAge {
+		return c.stats, nil
+	}
+	stats, err := c.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.stats = stats
+	c.fetchedAt = time.Now()
+	return stats, nil
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+)
+
+func TestQueueStatsCache(t *testing.T) {
+	queries := 0
+	var fetchErr error
+	cache := &queueStatsCache{fetch: func(ctx context.Context) (*db.QueueStats, error) {
+		queries++
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return &db.QueueStats{Pending: int64(queries)}, nil
+	}}
+	ctx := context.Background()
+
+	for range 3 {
+		stats, err := cache.get(ctx)
+		if err != nil {
+			t.Fatalf("get() error = %v", err)
+		}
+		if stats.Pending != 1 {
+			t.Errorf("get() pending = %d, want the cached 1", stats.Pending)
+		}
+	}
+	if queries != 1 {
+		t.Errorf("fetched %d times, want 1", queries)
+	}
+
+	// Stale stats are queried again, and errors are not cached
+	cache.fetchedAt = time.Now().Add(-queueStatsMaxAge)
+	fetchErr = errors.New("connection refused")
+	if _, err := cache.get(ctx); err == nil {
+		t.Fatal("get() error = nil, want the fetch error")
+	}
+	fetchErr = nil
+	stats, err := cache.get(ctx)
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if stats.Pending != 3 {
+		t.Errorf("get() pending = %d, want 3", stats.Pending)
+	}
+}
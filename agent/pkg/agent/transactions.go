@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/typeeng/pg_track_events/agent/internal/evtxfrm"
+	"github.com/typeeng/pg_track_events/agent/internal/metrics"
+	"github.com/typeeng/pg_track_events/agent/internal/tracing"
+	"github.com/typeeng/pg_track_events/agent/pkg/destinations"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// groupTransactions groups the events by the transaction that logged them, ordered by ID.
+// Events logged without a transaction id or of an oversized transaction are left out.
+func groupTransactions(dbEvents []*eventmodels.DBEvent) [][]*eventmodels.DBEvent {
+	var groups [][]*eventmodels.DBEvent
+	index := make(map[int64]int)
+	for _, dbEvent := range dbEvents {
+		if dbEvent.TxID == nil || dbEvent.TxOversized {
+			continue
+		}
+		i, ok := index[*dbEvent.TxID]
+		if !ok {
+			i = len(groups)
+			index[*dbEvent.TxID] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], dbEvent)
+	}
+
+	for _, group := range groups {
+		slices.SortFunc(group, func(a, b *eventmodels.DBEvent) int {
+			return cmp.Compare(a.ID, b.ID)
+		})
+	}
+	slices.SortFunc(groups, func(a, b []*eventmodels.DBEvent) int {
+		return cmp.Compare(a[0].ID, b[0].ID)
+	})
+	return groups
+}
+
+// transformTransactions evaluates the transaction rules for every transaction in the batch.
+// A rule that fails to evaluate fails the transaction's first event, which its events are
+// recorded on. The failure is permanent, so the rest of the transaction is not held back.
+func (a *Agent) transformTransactions(ctx context.Context, compiled *compiledSchema, dbEvents []*eventmodels.DBEvent) ([]*eventmodels.ProcessedEvent, []*eventmodels.DBEventUpdate) {
+	var processedEvents []*eventmodels.ProcessedEvent
+	var failedEventUpdates []*eventmodels.DBEventUpdate
+
+	oversized := make(map[int64]bool)
+	for _, dbEvent := range dbEvents {
+		if dbEvent.TxOversized && !oversized[*dbEvent.TxID] {
+			oversized[*dbEvent.TxID] = true
+			a.logger.Warn("transaction has more than MAX_TRANSACTION_SIZE changes, not evaluating transaction rules for it", "txid", *dbEvent.TxID, "max_transaction_size", a.cfg.MaxTransactionSize)
+		}
+	}
+
+	for _, group := range groupTransactions(dbEvents) {
+		first := group[0]
+		_, span := tracing.Tracer().Start(ctx, "transform_transaction", trace.WithAttributes(
+			tracing.EventIDKey.Int64(first.ID),
+			tracing.TxIDKey.Int64(*first.TxID),
+			tracing.CountKey.Int(len(group)),
+		))
+
+		txEvents, err := evtxfrm.ProcessTransaction(group, compiled.streaming)
+		if err != nil {
+			a.eventLogger.Error("failed to process transaction", "error", err, "txid", *first.TxID, "event_id", first.ID)
+			metrics.TransformFailures.Inc()
+			tracing.RecordError(span, err)
+			span.End()
+			// Rule errors come from the event config and will fail the same way on retry
+			failedEventUpdates = append(failedEventUpdates, GenerateEventErrorUpdate(first.ID, first.Retries, destinations.NewPermanentError(err)))
+			continue
+		}
+
+		for _, processedEvent := range txEvents {
+			a.eventLogger.Info("processed transaction", "txid", *first.TxID, "event_id", first.ID, "event", processedEvent.Name, "changes", len(group))
+			metrics.EventsProcessed.Inc()
+		}
+		span.End()
+		processedEvents = append(processedEvents, txEvents...)
+	}
+	return processedEvents, failedEventUpdates
+}
+
+// holdTransactions holds back every event of a transaction with a failed event that will be
+// retried, so the transaction is retried as a whole and transaction rules see all of its
+// changes again. The events share the latest retry time of the retried failures. Held events
+// that did not fail keep their retry count, so MAX_RETRIES only counts their own failures.
+// Permanent failures are still dead-lettered on their own, and transactions whose failures
+// are all permanent are not held. Destinations that acknowledged an event are still skipped
+// on retry.
+func holdTransactions(dbEvents []*eventmodels.DBEvent, updates []*eventmodels.DBEventUpdate) []*eventmodels.DBEventUpdate {
+	updatesByID := make(map[int64]*eventmodels.DBEventUpdate, len(updates))
+	for _, update := range updates {
+		updatesByID[update.ID] = update
+	}
+
+	for _, group := range groupTransactions(dbEvents) {
+		var retried []*eventmodels.DBEventUpdate
+		for _, dbEvent := range group {
+			if update, ok := updatesByID[dbEvent.ID]; ok && !update.DeadLetter {
+				retried = append(retried, update)
+			}
+		}
+		if len(retried) == 0 {
+			continue
+		}
+
+		held := *retried[0]
+		for _, update := range retried[1:] {
+			if update.ProcessAfter.After(*held.ProcessAfter) {
+				held.ProcessAfter = update.ProcessAfter
+			}
+		}
+
+		for _, dbEvent := range group {
+			if update, ok := updatesByID[dbEvent.ID]; ok {
+				// Permanent failures keep DeadLetter, the retry time only matters when
+				// dead-lettering is disabled
+				update.ProcessAfter = held.ProcessAfter
+				continue
+			}
+			lastError := fmt.Sprintf("held back with transaction %d: %s", *dbEvent.TxID, *held.LastError)
+			update := &eventmodels.DBEventUpdate{
+				ID:           dbEvent.ID,
+				Retries:      dbEvent.Retries,
+				LastError:    &lastError,
+				LastRetryAt:  held.LastRetryAt,
+				ProcessAfter: held.ProcessAfter,
+			}
+			updatesByID[dbEvent.ID] = update
+			updates = append(updates, update)
+		}
+	}
+	return updates
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/typeeng/pg_track_events/agent/pkg/destinations"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+func txEvent(id, txID int64) *eventmodels.DBEvent {
+	return &eventmodels.DBEvent{ID: id, TxID: &txID, Retries: 1}
+}
+
+func failedUpdate(id int64, err error, processAfter time.Time) *eventmodels.DBEventUpdate {
+	update := GenerateEventErrorUpdate(id, 1, err)
+	update.ProcessAfter = &processAfter
+	return update
+}
+
+func TestGroupTransactions(t *testing.T) {
+	dbEvents := []*eventmodels.DBEvent{
+		txEvent(5, 200),
+		{ID: 1},
+		txEvent(3, 100),
+		txEvent(2, 200),
+		txEvent(4, 100),
+		{ID: 6, TxID: new(int64), TxOversized: true},
+	}
+
+	groups := groupTransactions(dbEvents)
+	var got [][]int64
+	for _, group := range groups {
+		var ids []int64
+		for _, dbEvent := range group {
+			ids = append(ids, dbEvent.ID)
+		}
+		got = append(got, ids)
+	}
+	want := [][]int64{{2, 5}, {3, 4}}
+	if !slices.EqualFunc(got, want, slices.Equal[[]int64]) {
+		t.Errorf("groupTransactions() = %v, want %v", got, want)
+	}
+}
+
+func TestHoldTransactions(t *testing.T) {
+	soon := time.Now().Add(time.Minute).Truncate(time.Second)
+	later := soon.Add(time.Hour)
+	retryable := destinations.NewRetryableError(errors.New("timeout"))
+	permanent := destinations.NewPermanentError(errors.New("invalid event"))
+
+	t.Run("a retried failure holds the whole transaction and permanent failures are dead-lettered", func(t *testing.T) {
+		dbEvents := []*eventmodels.DBEvent{txEvent(1, 100), txEvent(2, 100), txEvent(3, 100), {ID: 4}, txEvent(5, 200)}
+		updates := holdTransactions(dbEvents, []*eventmodels.DBEventUpdate{
+			failedUpdate(1, permanent, soon),
+			failedUpdate(2, retryable, soon),
+			failedUpdate(3, retryable, later),
+		})
+
+		if len(updates) != 3 {
+			t.Fatalf("holdTransactions() returned %d updates, want 3", len(updates))
+		}
+		for _, update := range updates {
+			if wantDeadLetter := update.ID == 1; update.DeadLetter != wantDeadLetter {
+				t.Errorf("event %d DeadLetter = %v, want %v", update.ID, update.DeadLetter, wantDeadLetter)
+			}
+			if !update.ProcessAfter.Equal(later) {
+				t.Errorf("event %d ProcessAfter = %v, want %v", update.ID, update.ProcessAfter, later)
+			}
+		}
+	})
+
+	t.Run("events without a failure are held back", func(t *testing.T) {
+		dbEvents := []*eventmodels.DBEvent{txEvent(1, 100), txEvent(2, 100), {ID: 3}}
+		updates := holdTransactions(dbEvents, []*eventmodels.DBEventUpdate{failedUpdate(1, retryable, soon)})
+
+		if len(updates) != 2 {
+			t.Fatalf("holdTransactions() returned %d updates, want 2", len(updates))
+		}
+		held := updates[1]
+		if held.ID != 2 || held.Retries != 1 || !held.ProcessAfter.Equal(soon) || held.DeadLetter {
+			t.Errorf("held update = %+v, want event 2 retried at %v without counting a retry", held, soon)
+		}
+		if want := "held back with transaction 100: timeout"; held.LastError == nil || *held.LastError != want {
+			t.Errorf("held LastError = %v, want %q", held.LastError, want)
+		}
+	})
+
+	t.Run("permanent failures are not held", func(t *testing.T) {
+		dbEvents := []*eventmodels.DBEvent{txEvent(1, 100), txEvent(2, 100)}
+		updates := holdTransactions(dbEvents, []*eventmodels.DBEventUpdate{failedUpdate(1, permanent, soon)})
+
+		if len(updates) != 1 || updates[0].ID != 1 || !updates[0].DeadLetter {
+			t.Errorf("holdTransactions() = %+v, want only event 1 dead-lettered", updates)
+		}
+	})
+
+	t.Run("events without a transaction are unaffected", func(t *testing.T) {
+		dbEvents := []*eventmodels.DBEvent{{ID: 1}, {ID: 2}}
+		updates := holdTransactions(dbEvents, []*eventmodels.DBEventUpdate{failedUpdate(1, retryable, soon)})
+
+		if len(updates) != 1 || updates[0].ID != 1 || !updates[0].ProcessAfter.Equal(soon) {
+			t.Errorf("holdTransactions() = %+v, want only event 1 retried", updates)
+		}
+	})
+}
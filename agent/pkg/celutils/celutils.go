@@ -2,8 +2,13 @@ package celutils
 
 import (
 	"fmt"
+	"slices"
 
 	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
@@ -11,14 +16,39 @@ import (
 	"google.golang.org/protobuf/types/dynamicpb"
 )
 
+// TransactionRuleTable is the table part of the track keys of transaction rules, e.g. tx.order_placed
+const TransactionRuleTable = "tx"
+
+// reservedTableNames are the names of the variables every table rule has besides new and old,
+// a table with one of these names can't be tracked because its variable would collide
+var reservedTableNames = []string{"meta", TransactionRuleTable, "changed_columns"}
+
 var (
 	eventRefsPbPkgName     = "__event_refs"
 	eventRefsPbFdName      = "__event_refs.proto"
 	eventRefPbTypeName     = "EventRef"
 	eventsRefPbMessageName = "Events"
 
+	txContextPbPkgName  = "__tx_context"
+	txContextPbFdName   = "__tx_context.proto"
+	txContextPbTypeName = "TxContext"
+	txContextPbFd       = mustGenerateTxContextPb()
+
 	newVarDyn = cel.Variable("new", cel.MapType(cel.StringType, cel.DynType))
 	oldVarDyn = cel.Variable("old", cel.MapType(cel.StringType, cel.DynType))
+	// metaVar is the event_log metadata the trigger copied from the session, e.g. who made the change
+	metaVar = cel.Variable("meta", cel.MapType(cel.StringType, cel.DynType))
+	// txVar is the transaction context recorded by the trigger, empty when it isn't recorded
+	txVar = cel.Variable("tx", cel.ObjectType(TxContextTypeName()))
+	// changesVar lists the changes a transaction made, for transaction rules
+	changesVar = cel.Variable("changes", cel.ListType(cel.MapType(cel.StringType, cel.DynType)))
+	// changedColumnsVar lists the columns an update changed, sorted by name
+	changedColumnsVar = cel.Variable("changed_columns", cel.ListType(cel.StringType))
+	// changedMacro expands changed("email") to "email" in changed_columns
+	changedMacro = cel.Macros(cel.GlobalMacro("changed", 1,
+		func(eh cel.MacroExprFactory, target ast.Expr, args []ast.Expr) (ast.Expr, *common.Error) {
+			return eh.NewCall(operators.In, args[0], eh.NewIdent("changed_columns")), nil
+		}))
 )
 
 // compileCELExpression compiles a CEL expression with the given environment
@@ -56,6 +86,25 @@ func CompileEventCondition(env *cel.Env, expr string) (cel.Program, error) {
 	return prg, nil
 }
 
+// CompileBoolCondition compiles a CEL expression that returns whether an event is emitted.
+func CompileBoolCondition(env *cel.Env, expr string) (cel.Program, error) {
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("CEL compilation error: %w", issues.Err())
+	}
+
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("condition must return a bool, got %v", ast.OutputType())
+	}
+
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("CEL program creation error: %w", err)
+	}
+
+	return prg, nil
+}
+
 // CompilePropertyExpression compiles a CEL expression that can return any value type.
 // This is used for property expressions that can return any valid CEL type.
 func CompilePropertyExpression(env *cel.Env, expr string) (cel.Program, error) {
@@ -170,8 +219,24 @@ func GenerateCELEventsOptions(events []string) ([]cel.EnvOption, error) {
 	return GenerateCELEventsOptionsFromPbFd(fd)
 }
 
+// IsReservedTableName reports whether a table's name is taken by a built-in CEL variable
+func IsReservedTableName(tableName string) bool {
+	return slices.Contains(reservedTableNames, tableName)
+}
+
+// IsTransactionRule reports whether the table and operation of a track key name a transaction
+// rule. tx.insert, tx.update and tx.delete would track a table named tx, which is reserved.
+func IsTransactionRule(tableName string, op string) bool {
+	return tableName == TransactionRuleTable && op != "insert" && op != "update" && op != "delete"
+}
+
 // CreateCELEnv creates a CEL environment with common declarations
 func GenerateBaseCELEnvOptions(pbPkgName *string, pbFd protoreflect.FileDescriptor, tableName string, op string) []cel.EnvOption {
+	// Transaction rules span tables, their changes are always dynamic
+	if IsTransactionRule(tableName, op) {
+		return []cel.EnvOption{metaVar, cel.TypeDescs(txContextPbFd), txVar, changesVar}
+	}
+
 	// Create base declarations
 	envOpts := []cel.EnvOption{}
 	var newVar, oldVar cel.EnvOption
@@ -187,12 +252,15 @@ func GenerateBaseCELEnvOptions(pbPkgName *string, pbFd protoreflect.FileDescript
 		oldVar = oldVarDyn
 	}
 
+	// Metadata is set by the app, not derived from the schema, so it is always dynamic
+	envOpts = append(envOpts, metaVar, cel.TypeDescs(txContextPbFd), txVar)
+
 	// Add new/old based on event type
 	switch op {
 	case "insert":
 		envOpts = append(envOpts, newVar)
 	case "update":
-		envOpts = append(envOpts, newVar, oldVar)
+		envOpts = append(envOpts, newVar, oldVar, changedColumnsVar, changedMacro)
 	case "delete":
 		envOpts = append(envOpts, oldVar)
 	}
@@ -200,6 +268,89 @@ func GenerateBaseCELEnvOptions(pbPkgName *string, pbFd protoreflect.FileDescript
 	return envOpts
 }
 
+// mustGenerateTxContextPb builds the descriptor of the tx variable, which doesn't depend on
+// the schema
+func mustGenerateTxContextPb() protoreflect.FileDescriptor {
+	stringField := func(name string, number int32) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+		}
+	}
+
+	f := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String(txContextPbFdName),
+		Syntax:  proto.String("proto3"),
+		Package: proto.String(txContextPbPkgName),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String(txContextPbTypeName),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{
+						Name:   proto.String("txid"),
+						Number: proto.Int32(1),
+						Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+						Type:   descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(),
+					},
+					stringField("application_name", 2),
+					stringField("current_user", 3),
+					stringField("session_user", 4),
+					{
+						Name:     proto.String("settings"),
+						Number:   proto.Int32(5),
+						Label:    descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+						Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+						TypeName: proto.String(fmt.Sprintf(".%s.SettingsEntry", TxContextTypeName())),
+					},
+				},
+				// map<string, string> settings
+				NestedType: []*descriptorpb.DescriptorProto{
+					{
+						Name:    proto.String("SettingsEntry"),
+						Field:   []*descriptorpb.FieldDescriptorProto{stringField("key", 1), stringField("value", 2)},
+						Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+			},
+		},
+	}
+
+	fd, err := protodesc.NewFile(f, nil)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create tx context file descriptor: %v", err))
+	}
+	return fd
+}
+
+// NewTxContextPb returns the value of the tx variable. Both arguments are nil for events
+// logged without the transaction context, which get an empty message.
+func NewTxContextPb(txID *int64, txContext *eventmodels.TxContext) proto.Message {
+	msgDesc := txContextPbFd.Messages().ByName(protoreflect.Name(txContextPbTypeName))
+	msg := dynamicpb.NewMessage(msgDesc)
+	fields := msgDesc.Fields()
+
+	if txID != nil {
+		msg.Set(fields.ByName("txid"), protoreflect.ValueOfInt64(*txID))
+	}
+	if txContext != nil {
+		msg.Set(fields.ByName("application_name"), protoreflect.ValueOfString(txContext.ApplicationName))
+		msg.Set(fields.ByName("current_user"), protoreflect.ValueOfString(txContext.CurrentUser))
+		msg.Set(fields.ByName("session_user"), protoreflect.ValueOfString(txContext.SessionUser))
+		settings := msg.Mutable(fields.ByName("settings")).Map()
+		for name, value := range txContext.Settings {
+			settings.Set(protoreflect.ValueOfString(name).MapKey(), protoreflect.ValueOfString(value))
+		}
+	}
+	return msg
+}
+
+// TxContextTypeName returns the fully qualified type name of the tx variable
+func TxContextTypeName() string {
+	return fmt.Sprintf("%s.%s", txContextPbPkgName, txContextPbTypeName)
+}
+
 // EventRefTypeName returns the fully qualified type name for an EventRef
 func EventRefTypeName() string {
 	return fmt.Sprintf("%s.%s", eventRefsPbPkgName, eventRefPbTypeName)
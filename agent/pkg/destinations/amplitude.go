@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -46,6 +47,9 @@ type amplitudeEvent struct {
 	EventProperties map[string]interface{} `json:"event_properties"`
 }
 
+// amplitudeMaxErrorBodySize caps how much of an error response is read into the error message
+const amplitudeMaxErrorBodySize = 64 * 1024
+
 // amplitudeRequest represents the request body format for Amplitude's batch API
 type amplitudeRequest struct {
 	APIKey string           `json:"api_key"`
@@ -100,9 +104,63 @@ func (a *AmplitudeDestination) SendBatch(ctx context.Context, processedEvents []
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("amplitude API returned non-200 status code: %d", resp.StatusCode)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, amplitudeMaxErrorBodySize))
+		statusErr := fmt.Errorf("amplitude API returned non-200 status code: %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusBadRequest {
+			if eventErrors := a.invalidEventErrors(body, processedEvents, statusErr); len(eventErrors) > 0 {
+				return eventErrors, nil
+			}
+		}
+		return nil, classifyHTTPStatus(resp.StatusCode, resp.Header, statusErr)
 	}
 
 	a.logger.Info("successfully sent events to Amplitude", "count", len(processedEvents))
 	return nil, nil
 }
+
+// amplitudeBadRequestResponse is the body Amplitude returns with a 400 status.
+// The maps are keyed by field name and list the indices of the offending events.
+type amplitudeBadRequestResponse struct {
+	Error                   string           `json:"error"`
+	EventsWithInvalidFields map[string][]int `json:"events_with_invalid_fields"`
+	EventsWithMissingFields map[string][]int `json:"events_with_missing_fields"`
+}
+
+// invalidEventErrors returns per-event errors for a 400 response that names the invalid events.
+// Amplitude rejects the whole batch, so the invalid events fail permanently and the rest are retried.
+// Returns nil if the response does not name any events.
+func (a *AmplitudeDestination) invalidEventErrors(body []byte, processedEvents []*eventmodels.ProcessedEvent, statusErr error) []*DestinationEventError {
+	var response amplitudeBadRequestResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil
+	}
+
+	invalidFields := make(map[int][]string)
+	for field, indices := range response.EventsWithInvalidFields {
+		for _, i := range indices {
+			invalidFields[i] = append(invalidFields[i], "invalid "+field)
+		}
+	}
+	for field, indices := range response.EventsWithMissingFields {
+		for _, i := range indices {
+			invalidFields[i] = append(invalidFields[i], "missing "+field)
+		}
+	}
+	if len(invalidFields) == 0 {
+		return nil
+	}
+
+	eventErrors := make([]*DestinationEventError, 0, len(processedEvents))
+	for i, event := range processedEvents {
+		var err error
+		if fields, ok := invalidFields[i]; ok {
+			err = NewPermanentError(fmt.Errorf("amplitude rejected event: %s: %s", response.Error, strings.Join(fields, ", ")))
+		} else {
+			err = batchRejectedError(statusErr)
+		}
+		eventErrors = append(eventErrors, NewProcessedEventError(event, err))
+	}
+
+	a.logger.Error("amplitude rejected invalid events", "invalid_count", len(invalidFields), "count", len(processedEvents))
+	return eventErrors
+}
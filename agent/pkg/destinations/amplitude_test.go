@@ -0,0 +1,49 @@
+package destinations
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+func TestAmplitudeInvalidEventErrors(t *testing.T) {
+	a := &AmplitudeDestination{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	processedEvents := []*eventmodels.ProcessedEvent{
+		{ID: "1", Key: "USER_SIGNUP", DBEventID: 1},
+		{ID: "2:USER_UPDATED", Key: "USER_UPDATED", DBEventID: 2},
+		{ID: "2:PLAN_CHANGED", Key: "PLAN_CHANGED", DBEventID: 2},
+	}
+	statusErr := errors.New("amplitude API returned non-200 status code: 400")
+
+	t.Run("invalid events fail permanently", func(t *testing.T) {
+		body := []byte(`{"code": 400, "error": "Request missing required field", "events_with_invalid_fields": {"time": [0]}, "events_with_missing_fields": {"user_id": [2]}}`)
+		eventErrors := a.invalidEventErrors(body, processedEvents, statusErr)
+
+		if len(eventErrors) != 3 {
+			t.Fatalf("invalidEventErrors() returned %d errors, want 3", len(eventErrors))
+		}
+		wantKinds := []ErrorKind{ErrorKindPermanent, ErrorKindRetryable, ErrorKindPermanent}
+		for i, eventError := range eventErrors {
+			if eventError.EventID != processedEvents[i].DBEventID || eventError.ProcessedEventKey != processedEvents[i].Key {
+				t.Errorf("error %d is for %d/%s, want %d/%s", i, eventError.EventID, eventError.ProcessedEventKey, processedEvents[i].DBEventID, processedEvents[i].Key)
+			}
+			if kind, _ := ClassifyError(eventError.Error); kind != wantKinds[i] {
+				t.Errorf("error %d kind = %v, want %v", i, kind, wantKinds[i])
+			}
+		}
+		if want := "amplitude rejected event: Request missing required field: missing user_id"; eventErrors[2].Error.Error() != want {
+			t.Errorf("error 2 = %q, want %q", eventErrors[2].Error.Error(), want)
+		}
+	})
+
+	t.Run("responses without invalid events", func(t *testing.T) {
+		for _, body := range []string{`{"code": 400, "error": "Invalid API key"}`, `not json`} {
+			if eventErrors := a.invalidEventErrors([]byte(body), processedEvents, statusErr); eventErrors != nil {
+				t.Errorf("invalidEventErrors(%s) = %v, want nil", body, eventErrors)
+			}
+		}
+	})
+}
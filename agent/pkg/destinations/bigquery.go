@@ -3,6 +3,7 @@ package destinations
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
@@ -10,6 +11,7 @@ import (
 
 	"cloud.google.com/go/bigquery"
 	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
@@ -82,7 +84,7 @@ func (b *BigQueryDestination) SendBatch(ctx context.Context, processedEvents []*
 			return nil, fmt.Errorf("failed to marshal properties: %w", err)
 		}
 		bigqueryEvents[i] = &bigqueryEvent{
-			ID:          event.DBEventIDStr,
+			ID:          event.ID,
 			Name:        event.Name,
 			Properties:  string(evtPropsJson),
 			UserID:      event.GetDistinctId(""),
@@ -100,9 +102,54 @@ func (b *BigQueryDestination) SendBatch(ctx context.Context, processedEvents []*
 	// Insert the events
 	if err := inserter.Put(ctx, bigqueryEvents); err != nil {
 		b.logger.Error("failed to insert events to BigQuery", "error", err)
-		return nil, fmt.Errorf("failed to insert events to BigQuery: %w", err)
+		return bigQueryInsertErrors(fmt.Errorf("failed to insert events to BigQuery: %w", err), len(processedEvents), func(row int, err error) *DestinationEventError {
+			return NewProcessedEventError(processedEvents[row], err)
+		})
 	}
 
 	b.logger.Info("successfully sent events to BigQuery", "count", len(processedEvents))
 	return nil, nil
 }
+
+// bigQueryInsertErrors converts an error from an insert into per-row errors when BigQuery reports
+// which rows failed, and classifies it otherwise. rowError returns the error of the event inserted
+// as the row at an index, out of rows rows.
+func bigQueryInsertErrors(err error, rows int, rowError func(row int, err error) *DestinationEventError) ([]*DestinationEventError, error) {
+	var putErr bigquery.PutMultiError
+	if errors.As(err, &putErr) {
+		eventErrors := make([]*DestinationEventError, 0, len(putErr))
+		for _, rowErr := range putErr {
+			if rowErr.RowIndex < 0 || rowErr.RowIndex >= rows {
+				continue
+			}
+			eventErrors = append(eventErrors, rowError(rowErr.RowIndex, classifyBigQueryRowError(&rowErr)))
+		}
+		return eventErrors, nil
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return nil, classifyHTTPStatus(apiErr.Code, apiErr.Header, err)
+	}
+	return nil, NewRetryableError(err)
+}
+
+// classifyBigQueryRowError marks rows that BigQuery found invalid as permanent.
+// Valid rows in a batch with invalid rows are reported as "stopped" and are retried.
+func classifyBigQueryRowError(rowErr *bigquery.RowInsertionError) error {
+	for _, err := range rowErr.Errors {
+		var bqErr *bigquery.Error
+		if errors.As(err, &bqErr) && bqErr.Reason == "invalid" {
+			return NewPermanentError(rowErr)
+		}
+	}
+	return NewRetryableError(rowErr)
+}
+
+// Close closes the BigQuery client
+func (b *BigQueryDestination) Close(ctx context.Context) error {
+	if err := b.client.Close(); err != nil {
+		return fmt.Errorf("failed to close BigQuery client: %w", err)
+	}
+	return nil
+}
@@ -106,9 +106,19 @@ func (b *BigQueryRawDBEventDestination) SendBatch(ctx context.Context, dbEvents
 	// Insert the events
 	if err := inserter.Put(ctx, bigqueryRawEvents); err != nil {
 		b.logger.Error("failed to insert raw DB events to BigQuery", "error", err)
-		return nil, fmt.Errorf("failed to insert raw DB events to BigQuery: %w", err)
+		return bigQueryInsertErrors(fmt.Errorf("failed to insert raw DB events to BigQuery: %w", err), len(dbEvents), func(row int, err error) *DestinationEventError {
+			return &DestinationEventError{EventID: dbEvents[row].ID, Error: err}
+		})
 	}
 
 	b.logger.Info("successfully sent raw DB events to BigQuery", "count", len(dbEvents))
 	return nil, nil
 }
+
+// Close closes the BigQuery client
+func (b *BigQueryRawDBEventDestination) Close(ctx context.Context) error {
+	if err := b.client.Close(); err != nil {
+		return fmt.Errorf("failed to close BigQuery client: %w", err)
+	}
+	return nil
+}
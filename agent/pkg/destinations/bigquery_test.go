@@ -0,0 +1,66 @@
+package destinations
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+func TestBigQueryInsertErrors(t *testing.T) {
+	rowError := func(row int, err error) *DestinationEventError {
+		return &DestinationEventError{EventID: int64(row + 1), Error: err}
+	}
+
+	t.Run("per-row errors", func(t *testing.T) {
+		err := fmt.Errorf("failed to insert events to BigQuery: %w", bigquery.PutMultiError{
+			{RowIndex: 0, Errors: bigquery.MultiError{&bigquery.Error{Reason: "invalid", Message: "no such field"}}},
+			{RowIndex: 1, Errors: bigquery.MultiError{&bigquery.Error{Reason: "stopped"}}},
+			{RowIndex: 7, Errors: bigquery.MultiError{&bigquery.Error{Reason: "invalid"}}},
+		})
+
+		eventErrors, err := bigQueryInsertErrors(err, 2, rowError)
+		if err != nil {
+			t.Fatalf("bigQueryInsertErrors() error = %v", err)
+		}
+		if len(eventErrors) != 2 {
+			t.Fatalf("bigQueryInsertErrors() returned %d errors, want 2", len(eventErrors))
+		}
+		wantKinds := []ErrorKind{ErrorKindPermanent, ErrorKindRetryable}
+		for i, eventError := range eventErrors {
+			if eventError.EventID != int64(i+1) {
+				t.Errorf("error %d is for event %d, want %d", i, eventError.EventID, i+1)
+			}
+			if kind, _ := ClassifyError(eventError.Error); kind != wantKinds[i] {
+				t.Errorf("error %d kind = %v, want %v", i, kind, wantKinds[i])
+			}
+		}
+	})
+
+	t.Run("request errors", func(t *testing.T) {
+		tests := []struct {
+			name string
+			err  error
+			want ErrorKind
+		}{
+			{name: "bad request", err: &googleapi.Error{Code: http.StatusBadRequest}, want: ErrorKindPermanent},
+			{name: "rate limited", err: &googleapi.Error{Code: http.StatusTooManyRequests}, want: ErrorKindRateLimited},
+			{name: "server error", err: &googleapi.Error{Code: http.StatusInternalServerError}, want: ErrorKindRetryable},
+			{name: "network error", err: errors.New("connection reset"), want: ErrorKindRetryable},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				eventErrors, err := bigQueryInsertErrors(fmt.Errorf("failed to insert events to BigQuery: %w", tt.err), 2, rowError)
+				if eventErrors != nil {
+					t.Errorf("bigQueryInsertErrors() = %v, want no per-row errors", eventErrors)
+				}
+				if kind, _ := ClassifyError(err); kind != tt.want {
+					t.Errorf("bigQueryInsertErrors() error kind = %v, want %v", kind, tt.want)
+				}
+			})
+		}
+	})
+}
@@ -7,8 +7,18 @@ import (
 )
 
 type DestinationEventError struct {
+	// EventID is the DB event that failed, or that the processed event was generated from
 	EventID int64
-	Error   error
+	// ProcessedEventKey is the key of the processed event that failed, empty for DB events
+	ProcessedEventKey string
+	Error             error
+	// Destination is the name of the destination that rejected the event, set by the agent
+	Destination string
+}
+
+// NewProcessedEventError returns the error for a processed event the destination rejected
+func NewProcessedEventError(event *eventmodels.ProcessedEvent, err error) *DestinationEventError {
+	return &DestinationEventError{EventID: event.DBEventID, ProcessedEventKey: event.Key, Error: err}
 }
 
 type ProcessedEventDestination interface {
@@ -18,3 +28,9 @@ type ProcessedEventDestination interface {
 type DBEventDestination interface {
 	SendBatch(ctx context.Context, dbEvents []*eventmodels.DBEvent) ([]*DestinationEventError, error)
 }
+
+// Closer is implemented by destinations that buffer events or hold resources. The agent calls
+// Close once when shutting down, after the last batch has been sent, so buffered events are flushed.
+type Closer interface {
+	Close(ctx context.Context) error
+}
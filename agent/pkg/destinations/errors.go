@@ -0,0 +1,119 @@
+package destinations
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorKind tells the agent how a failed delivery should be handled
+type ErrorKind int
+
+const (
+	// ErrorKindRetryable errors are retried with exponential backoff. Unclassified errors are retryable.
+	ErrorKindRetryable ErrorKind = iota
+	// ErrorKindPermanent errors will never succeed on retry, so the event is dead-lettered immediately
+	// when dead-lettering is enabled
+	ErrorKindPermanent
+	// ErrorKindRateLimited errors are retried once the destination's Retry-After has elapsed
+	ErrorKindRateLimited
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindPermanent:
+		return "permanent"
+	case ErrorKindRateLimited:
+		return "rate_limited"
+	default:
+		return "retryable"
+	}
+}
+
+// ClassifiedError wraps a destination error with its ErrorKind
+type ClassifiedError struct {
+	Kind ErrorKind
+	// RetryAfter is the delay requested by the destination, zero if it did not ask for one
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *ClassifiedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClassifiedError) Unwrap() error {
+	return e.Err
+}
+
+// NewRetryableError marks err as retryable
+func NewRetryableError(err error) error {
+	return &ClassifiedError{Kind: ErrorKindRetryable, Err: err}
+}
+
+// NewPermanentError marks err as permanent
+func NewPermanentError(err error) error {
+	return &ClassifiedError{Kind: ErrorKindPermanent, Err: err}
+}
+
+// NewRateLimitedError marks err as rate limited, retryAfter may be zero if the destination did not specify one
+func NewRateLimitedError(err error, retryAfter time.Duration) error {
+	return &ClassifiedError{Kind: ErrorKindRateLimited, RetryAfter: retryAfter, Err: err}
+}
+
+// ClassifyError returns the kind and requested retry delay of err.
+// Errors that were not classified by a destination are treated as retryable.
+func ClassifyError(err error) (ErrorKind, time.Duration) {
+	var classified *ClassifiedError
+	if errors.As(err, &classified) {
+		return classified.Kind, classified.RetryAfter
+	}
+	return ErrorKindRetryable, 0
+}
+
+// classifyHTTPStatus classifies err based on the HTTP status code returned by a destination.
+// Authentication and not found errors are retryable since they usually mean the destination
+// is misconfigured, and dead-lettering every event until the config is fixed is not useful.
+func classifyHTTPStatus(statusCode int, header http.Header, err error) error {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return NewRateLimitedError(err, parseRetryAfter(header.Get("Retry-After"), time.Now()))
+	case statusCode == http.StatusRequestTimeout,
+		statusCode == http.StatusUnauthorized,
+		statusCode == http.StatusForbidden,
+		statusCode == http.StatusNotFound,
+		statusCode == http.StatusRequestEntityTooLarge,
+		statusCode >= 500:
+		return NewRetryableError(err)
+	case statusCode >= 400:
+		return NewPermanentError(err)
+	default:
+		return NewRetryableError(err)
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// batchRejectedError is used for events that were valid but rejected along with invalid events in the same batch
+func batchRejectedError(err error) error {
+	return NewRetryableError(fmt.Errorf("batch rejected because of other invalid events: %w", err))
+}
@@ -0,0 +1,102 @@
+package destinations
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantKind       ErrorKind
+		wantRetryAfter time.Duration
+	}{
+		{name: "unclassified", err: errors.New("connection reset"), wantKind: ErrorKindRetryable},
+		{name: "retryable", err: NewRetryableError(errors.New("timeout")), wantKind: ErrorKindRetryable},
+		{name: "permanent", err: NewPermanentError(errors.New("invalid event")), wantKind: ErrorKindPermanent},
+		{
+			name:           "rate limited",
+			err:            NewRateLimitedError(errors.New("slow down"), 30*time.Second),
+			wantKind:       ErrorKindRateLimited,
+			wantRetryAfter: 30 * time.Second,
+		},
+		{
+			name:     "wrapped",
+			err:      fmt.Errorf("amplitude: %w", NewPermanentError(errors.New("invalid event"))),
+			wantKind: ErrorKindPermanent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, retryAfter := ClassifyError(tt.err)
+			if kind != tt.wantKind || retryAfter != tt.wantRetryAfter {
+				t.Errorf("ClassifyError() = %v, %v, want %v, %v", kind, retryAfter, tt.wantKind, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestClassifyHTTPStatus(t *testing.T) {
+	tests := []struct {
+		statusCode     int
+		retryAfter     string
+		wantKind       ErrorKind
+		wantRetryAfter time.Duration
+	}{
+		{statusCode: http.StatusBadRequest, wantKind: ErrorKindPermanent},
+		{statusCode: http.StatusUnprocessableEntity, wantKind: ErrorKindPermanent},
+		{statusCode: http.StatusUnauthorized, wantKind: ErrorKindRetryable},
+		{statusCode: http.StatusForbidden, wantKind: ErrorKindRetryable},
+		{statusCode: http.StatusNotFound, wantKind: ErrorKindRetryable},
+		{statusCode: http.StatusRequestTimeout, wantKind: ErrorKindRetryable},
+		{statusCode: http.StatusRequestEntityTooLarge, wantKind: ErrorKindRetryable},
+		{statusCode: http.StatusInternalServerError, wantKind: ErrorKindRetryable},
+		{statusCode: http.StatusServiceUnavailable, wantKind: ErrorKindRetryable},
+		{statusCode: http.StatusTooManyRequests, wantKind: ErrorKindRateLimited},
+		{statusCode: http.StatusTooManyRequests, retryAfter: "120", wantKind: ErrorKindRateLimited, wantRetryAfter: 2 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.statusCode, tt.retryAfter), func(t *testing.T) {
+			header := http.Header{}
+			if tt.retryAfter != "" {
+				header.Set("Retry-After", tt.retryAfter)
+			}
+			err := classifyHTTPStatus(tt.statusCode, header, errors.New("request failed"))
+			kind, retryAfter := ClassifyError(err)
+			if kind != tt.wantKind || retryAfter != tt.wantRetryAfter {
+				t.Errorf("classifyHTTPStatus() = %v, %v, want %v, %v", kind, retryAfter, tt.wantKind, tt.wantRetryAfter)
+			}
+			if err.Error() != "request failed" {
+				t.Errorf("classifyHTTPStatus() error = %q, want the original message", err.Error())
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "30", want: 30 * time.Second},
+		{value: " 5 ", want: 5 * time.Second},
+		{value: "-1", want: 0},
+		{value: "Mon, 01 Jan 2024 12:01:30 GMT", want: 90 * time.Second},
+		{value: "Mon, 01 Jan 2024 11:59:00 GMT", want: 0},
+		{value: "soon", want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -2,14 +2,21 @@ package destinations
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
+	"regexp"
 
 	"github.com/mixpanel/mixpanel-go"
 	"github.com/typeeng/pg_track_events/agent/internal/utils"
 	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
 )
 
+// mixpanelInsertIDPattern matches the IDs Mixpanel accepts as $insert_id
+var mixpanelInsertIDPattern = regexp.MustCompile(`^[a-zA-Z0-9-]{1,36}$`)
+
 // MixpanelDestination implements ProcessedEventDestination for sending events to Mixpanel
 type MixpanelDestination struct {
 	client *mixpanel.ApiClient
@@ -51,7 +58,7 @@ func (m *MixpanelDestination) SendBatch(ctx context.Context, processedEvents []*
 		// Best timestamp
 		mixpanelEvents[i].AddTime(event.Timestamp)
 		// Deduplication
-		mixpanelEvents[i].AddInsertID(event.DBEventIDStr)
+		mixpanelEvents[i].AddInsertID(mixpanelInsertID(event.ID))
 		// Ensure that server IPs dont get sent to Mixpanel
 		mixpanelEvents[i].Properties["ip"] = "0"
 	}
@@ -65,10 +72,61 @@ func (m *MixpanelDestination) SendBatch(ctx context.Context, processedEvents []*
 	})
 	if err != nil {
 		m.logger.Error("failed to send events to Mixpanel", "error", err)
-		return nil, fmt.Errorf("failed to send events to Mixpanel: %w", err)
+		if eventErrors := failedImportRecordErrors(err, processedEvents); len(eventErrors) > 0 {
+			return eventErrors, nil
+		}
+		return nil, classifyMixpanelError(fmt.Errorf("failed to send events to Mixpanel: %w", err))
 	}
 	m.logger.Info("mixpanel import status", "status", importStatus)
 
 	m.logger.Info("successfully sent events to Mixpanel", "count", len(mixpanelEvents))
 	return nil, nil
 }
+
+// mixpanelInsertID returns the event ID as a Mixpanel $insert_id, which must be at most 36
+// alphanumeric characters or dashes. Other IDs are replaced by their hex MD5 hash.
+func mixpanelInsertID(eventID string) string {
+	if mixpanelInsertIDPattern.MatchString(eventID) {
+		return eventID
+	}
+	sum := md5.Sum([]byte(eventID))
+	return hex.EncodeToString(sum[:])
+}
+
+// failedImportRecordErrors returns permanent per-event errors for the records Mixpanel failed to validate.
+// Imports are not strict, so the records that are not listed were ingested.
+func failedImportRecordErrors(err error, processedEvents []*eventmodels.ProcessedEvent) []*DestinationEventError {
+	var validationErr mixpanel.ImportFailedValidationError
+	if !errors.As(err, &validationErr) {
+		return nil
+	}
+
+	eventErrors := make([]*DestinationEventError, 0, len(validationErr.FailedImportRecords))
+	for _, record := range validationErr.FailedImportRecords {
+		if record.Index < 0 || record.Index >= len(processedEvents) {
+			continue
+		}
+		eventErrors = append(eventErrors, NewProcessedEventError(
+			processedEvents[record.Index],
+			NewPermanentError(fmt.Errorf("mixpanel rejected event: %s: %s", record.Field, record.Message)),
+		))
+	}
+	return eventErrors
+}
+
+// classifyMixpanelError classifies the errors returned by the Mixpanel import API
+func classifyMixpanelError(err error) error {
+	var rateLimitErr mixpanel.ImportRateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return NewRateLimitedError(err, 0)
+	}
+	var genericErr mixpanel.ImportGenericError
+	if errors.As(err, &genericErr) {
+		return classifyHTTPStatus(genericErr.Code, nil, err)
+	}
+	var validationErr mixpanel.ImportFailedValidationError
+	if errors.As(err, &validationErr) {
+		return NewPermanentError(err)
+	}
+	return NewRetryableError(err)
+}
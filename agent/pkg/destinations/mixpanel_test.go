@@ -0,0 +1,89 @@
+package destinations
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mixpanel/mixpanel-go"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+func TestMixpanelInsertID(t *testing.T) {
+	for _, eventID := range []string{"42", "a1-b2", strings.Repeat("1", 36)} {
+		if got := mixpanelInsertID(eventID); got != eventID {
+			t.Errorf("mixpanelInsertID(%q) = %q, want it unchanged", eventID, got)
+		}
+	}
+
+	seen := make(map[string]string)
+	for _, eventID := range []string{"42:USER_UPDATED", "42:PLAN_CHANGED", "tx:900:order_placed", strings.Repeat("1", 37)} {
+		got := mixpanelInsertID(eventID)
+		if !mixpanelInsertIDPattern.MatchString(got) {
+			t.Errorf("mixpanelInsertID(%q) = %q, want a valid insert ID", eventID, got)
+		}
+		if got != mixpanelInsertID(eventID) {
+			t.Errorf("mixpanelInsertID(%q) is not stable", eventID)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("mixpanelInsertID(%q) = mixpanelInsertID(%q) = %q", eventID, other, got)
+		}
+		seen[got] = eventID
+	}
+}
+
+func TestFailedImportRecordErrors(t *testing.T) {
+	processedEvents := []*eventmodels.ProcessedEvent{
+		{ID: "1", Key: "USER_SIGNUP", DBEventID: 1},
+		{ID: "2:USER_UPDATED", Key: "USER_UPDATED", DBEventID: 2},
+		{ID: "2:PLAN_CHANGED", Key: "PLAN_CHANGED", DBEventID: 2},
+	}
+	err := fmt.Errorf("failed to import events: %w", mixpanel.ImportFailedValidationError{
+		Code:     400,
+		ApiError: "some data points in the request failed validation",
+		FailedImportRecords: []mixpanel.ImportFailedRecords{
+			{Index: 2, Field: "properties.time", Message: "'properties.time' is invalid"},
+			{Index: 5, Field: "event", Message: "out of range"},
+		},
+	})
+
+	eventErrors := failedImportRecordErrors(err, processedEvents)
+	if len(eventErrors) != 1 {
+		t.Fatalf("failedImportRecordErrors() returned %d errors, want 1", len(eventErrors))
+	}
+	eventError := eventErrors[0]
+	if eventError.EventID != 2 || eventError.ProcessedEventKey != "PLAN_CHANGED" {
+		t.Errorf("error is for %d/%s, want 2/PLAN_CHANGED", eventError.EventID, eventError.ProcessedEventKey)
+	}
+	if kind, _ := ClassifyError(eventError.Error); kind != ErrorKindPermanent {
+		t.Errorf("error kind = %v, want permanent", kind)
+	}
+
+	if eventErrors := failedImportRecordErrors(errors.New("connection reset"), processedEvents); eventErrors != nil {
+		t.Errorf("failedImportRecordErrors() = %v for another error, want nil", eventErrors)
+	}
+}
+
+func TestClassifyMixpanelError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{name: "rate limited", err: mixpanel.ImportRateLimitError{ImportGenericError: mixpanel.ImportGenericError{Code: 429}}, want: ErrorKindRateLimited},
+		{name: "bad request", err: mixpanel.ImportGenericError{Code: 400}, want: ErrorKindPermanent},
+		{name: "unauthorized", err: mixpanel.ImportGenericError{Code: 401}, want: ErrorKindRetryable},
+		{name: "server error", err: mixpanel.ImportGenericError{Code: 503}, want: ErrorKindRetryable},
+		{name: "failed validation", err: mixpanel.ImportFailedValidationError{Code: 400}, want: ErrorKindPermanent},
+		{name: "network error", err: errors.New("connection reset"), want: ErrorKindRetryable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind, _ := ClassifyError(classifyMixpanelError(tt.err)); kind != tt.want {
+				t.Errorf("classifyMixpanelError() kind = %v, want %v", kind, tt.want)
+			}
+		})
+	}
+}
@@ -54,7 +54,7 @@ func (p *PostHogDestination) SendBatch(ctx context.Context, processedEvents []*e
 			Timestamp:  event.Timestamp,
 		})
 		if err != nil {
-			p.logger.Error("failed to send event to PostHog", "error", err, "event_id", event.DBEventID)
+			p.logger.Error("failed to send event to PostHog", "error", err, "event_id", event.ID)
 			return nil, fmt.Errorf("failed to send event to PostHog: %w", err)
 		}
 	}
@@ -62,3 +62,21 @@ func (p *PostHogDestination) SendBatch(ctx context.Context, processedEvents []*e
 	p.logger.Info("successfully sent events to PostHog", "count", len(processedEvents))
 	return nil, nil
 }
+
+// Close flushes the events queued by the PostHog client, giving up when ctx is done
+func (p *PostHogDestination) Close(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- p.client.Close()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to close PostHog client: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out flushing PostHog events: %w", ctx.Err())
+	}
+}
@@ -23,6 +23,7 @@ type s3ProcessedEvent struct {
 	Name        string                 `json:"name"`
 	Properties  map[string]interface{} `json:"properties,omitempty"`
 	UserID      string                 `json:"user_id,omitempty"`
+	Metadata    json.RawMessage        `json:"metadata,omitempty"`
 	Timestamp   time.Time              `json:"timestamp"`
 	ProcessedAt time.Time              `json:"processed_at"`
 }
@@ -79,10 +80,11 @@ func (s *S3Destination) SendBatch(ctx context.Context, processedEvents []*eventm
 		// Convert and write events to buffer
 		for _, event := range events {
 			s3Event := s3ProcessedEvent{
-				ID:          event.DBEventIDStr,
+				ID:          event.ID,
 				Name:        event.Name,
 				Properties:  event.Properties,
 				UserID:      event.GetDistinctId(""),
+				Metadata:    event.Metadata,
 				Timestamp:   event.Timestamp,
 				ProcessedAt: time.Now(),
 			}
@@ -137,8 +139,9 @@ func (s *S3Destination) FlushAll(ctx context.Context) ([]*DestinationEventError,
 }
 
 // Close flushes all buffers and cleans up resources
-func (s *S3Destination) Close(ctx context.Context) ([]*DestinationEventError, error) {
-	return s.FlushAll(ctx)
+func (s *S3Destination) Close(ctx context.Context) error {
+	_, err := s.FlushAll(ctx)
+	return err
 }
 
 // SetFlushOnBatch sets the flushOnBatch flag
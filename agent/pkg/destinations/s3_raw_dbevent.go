@@ -24,6 +24,9 @@ type s3RawDBEvent struct {
 	RowTableName string          `json:"row_table_name"`
 	OldRow       json.RawMessage `json:"old_row,omitempty"`
 	NewRow       json.RawMessage `json:"new_row,omitempty"`
+	Metadata     json.RawMessage `json:"metadata,omitempty"`
+	TxID         *int64          `json:"txid,omitempty"`
+	TxContext    json.RawMessage `json:"tx_context,omitempty"`
 	LoggedAt     time.Time       `json:"logged_at"`
 }
 
@@ -83,6 +86,9 @@ func (s *S3RawDBEventDestination) SendBatch(ctx context.Context, dbEvents []*eve
 				EventType:    string(event.EventType),
 				RowTableName: event.RowTableName,
 				LoggedAt:     event.LoggedAt,
+				Metadata:     event.Metadata,
+				TxID:         event.TxID,
+				TxContext:    event.TxContext,
 			}
 
 			if event.OldRow != nil {
@@ -143,8 +149,9 @@ func (s *S3RawDBEventDestination) FlushAll(ctx context.Context) ([]*DestinationE
 }
 
 // Close flushes all buffers and cleans up resources
-func (s *S3RawDBEventDestination) Close(ctx context.Context) ([]*DestinationEventError, error) {
-	return s.FlushAll(ctx)
+func (s *S3RawDBEventDestination) Close(ctx context.Context) error {
+	_, err := s.FlushAll(ctx)
+	return err
 }
 
 // SetFlushOnBatch sets the flushOnBatch flag
@@ -2,16 +2,56 @@ package eventmodels
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"time"
 )
 
 type ProcessedEvent struct {
-	DBEventID    int64          `json:"id"`
-	DBEventIDStr string         `json:"id_str"`
-	Name         string         `json:"name"`
-	Properties   map[string]any `json:"properties"`
-	Timestamp    time.Time      `json:"ts"`
-	DistinctId   *string        `json:"distinct_id,omitempty"`
+	// DBEventID is the DB event the event was generated from, its failures and deliveries are
+	// recorded on it. Transaction events use the first event of the transaction.
+	DBEventID    int64  `json:"id"`
+	DBEventIDStr string `json:"id_str"`
+	// ID uniquely identifies the event, see ProcessedEventID. It is not part of the JSON,
+	// destinations that store or deduplicate events set it on their own payloads.
+	ID string `json:"-"`
+	// Key identifies the event among the events recorded on its DB event: its name, or see
+	// TransactionEventKey. Deliveries are tracked by the key, it doesn't change when a failed
+	// replicated event is moved to the event log and gets a new DB event ID.
+	Key        string         `json:"-"`
+	Name       string         `json:"name"`
+	Properties map[string]any `json:"properties"`
+	Timestamp  time.Time      `json:"ts"`
+	DistinctId *string        `json:"distinct_id,omitempty"`
+	// Metadata is the session metadata logged with the change, passed through as is
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// ProcessedEventID returns the ID of the event a track key's rule emitted: the DB event ID,
+// followed by ":<event name>" for a list of rules. The rules of a list emit distinct event
+// names, so reordering them doesn't change the IDs.
+func ProcessedEventID(dbEventID int64, name string, ruleCount int) string {
+	id := strconv.FormatInt(dbEventID, 10)
+	if ruleCount > 1 {
+		id += ":" + name
+	}
+	return id
+}
+
+// TransactionEventKey returns the key of the event a transaction rule emitted, e.g.
+// "tx:order_placed:ORDER_PLACED" for tx.order_placed. The key of other events is their name.
+func TransactionEventKey(rule string, name string) string {
+	return "tx:" + rule + ":" + name
+}
+
+// TransactionEventID returns the ID of the event a transaction rule emitted, e.g.
+// "tx:<txid>:order_placed" for tx.order_placed, followed by ":<event name>" for a list of rules
+func TransactionEventID(txID int64, rule string, name string, ruleCount int) string {
+	id := fmt.Sprintf("tx:%d:%s", txID, rule)
+	if ruleCount > 1 {
+		id += ":" + name
+	}
+	return id
 }
 
 func (e *ProcessedEvent) GetDistinctId(fallback string) string {
@@ -41,6 +81,24 @@ type DBEvent struct {
 	OldRow       json.RawMessage `json:"old_row,omitempty"`
 	NewRow       json.RawMessage `json:"new_row,omitempty"`
 	Metadata     json.RawMessage `json:"metadata,omitempty"`
+	DeliveredTo  []string        `json:"delivered_to,omitempty"`
+	// TxID and TxContext are recorded by the triggers when tx_context is configured.
+	// Changes read from the replication slot only have the TxID.
+	TxID      *int64          `json:"txid,omitempty"`
+	TxContext json.RawMessage `json:"tx_context,omitempty"`
+	// TxOversized is set when the transaction has more than MAX_TRANSACTION_SIZE changes. Its
+	// changes are batched like any other changes and transaction rules are not evaluated for it.
+	TxOversized bool `json:"-"`
+	// EntityKey identifies the changed row for ORDERING=entity, nil for tables without a primary key
+	EntityKey *string `json:"-"`
+}
+
+// TxContext is who made a change, recorded by the triggers in the tx_context column
+type TxContext struct {
+	ApplicationName string            `json:"application_name"`
+	CurrentUser     string            `json:"current_user"`
+	SessionUser     string            `json:"session_user"`
+	Settings        map[string]string `json:"settings"`
 }
 
 type DBEventUpdate struct {
@@ -49,4 +107,9 @@ type DBEventUpdate struct {
 	LastError    *string
 	LastRetryAt  *time.Time
 	ProcessAfter *time.Time
+	DeliveredTo  []string
+	// FailedDestinations lists the destinations that rejected the event on this attempt
+	FailedDestinations []string
+	// DeadLetter moves the event to the dead letter table instead of scheduling a retry
+	DeadLetter bool
 }
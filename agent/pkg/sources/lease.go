@@ -0,0 +1,155 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+// leaseBatch is a batch of outbox events claimed with a lease. No transaction is open while
+// the events are delivered, one is only opened to record the results.
+type leaseBatch struct {
+	db     *pgxpool.Pool
+	events []*eventmodels.DBEvent
+	full   bool
+	// claimToken marks the rows claimed by the worker, see claimToken
+	claimToken   string
+	leaseTimeout time.Duration
+	claimedAt    time.Time
+	// tx holds the acks and nacks, opened by the first of them
+	tx pgx.Tx
+	// owned holds the IDs of the events still claimed by the agent when tx was opened
+	owned  map[int64]bool
+	logger *slog.Logger
+}
+
+func (b *leaseBatch) Events() []*eventmodels.DBEvent {
+	return b.events
+}
+
+func (b *leaseBatch) Full() bool {
+	return b.full
+}
+
+// begin opens the transaction and locks the events the worker still has a claim on
+func (b *leaseBatch) begin(ctx context.Context) error {
+	if b.tx != nil {
+		return nil
+	}
+
+	if elapsed := time.Since(b.claimedAt); elapsed > b.leaseTimeout {
+		b.logger.Warn("event batch took longer than the lease timeout, events may be delivered twice", "elapsed", elapsed, "lease_timeout", b.leaseTimeout)
+	}
+
+	tx, err := b.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	eventIDs := make([]int64, len(b.events))
+	for i, event := range b.events {
+		eventIDs[i] = event.ID
+	}
+	ownedIDs, err := db.LockClaimedDBEvents(ctx, tx, eventIDs, b.claimToken)
+	if err != nil {
+		tx.Rollback(ctx)
+		b.logger.Error("failed to lock claimed events", "error", err)
+		return err
+	}
+
+	b.owned = make(map[int64]bool, len(ownedIDs))
+	for _, id := range ownedIDs {
+		b.owned[id] = true
+	}
+	if lost := len(eventIDs) - len(ownedIDs); lost > 0 {
+		b.logger.Warn("lost the lease on events, leaving them to their new owner", "count", lost)
+	}
+
+	b.tx = tx
+	return nil
+}
+
+// Ack deletes the delivered events that are still claimed by the agent
+func (b *leaseBatch) Ack(ctx context.Context, eventIDs []int64) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	if err := b.begin(ctx); err != nil {
+		return err
+	}
+
+	var owned []int64
+	for _, id := range eventIDs {
+		if b.owned[id] {
+			owned = append(owned, id)
+		}
+	}
+	if len(owned) == 0 {
+		return nil
+	}
+
+	b.logger.Info("flushing successful events", "count", len(owned))
+	if err := db.FlushDBEvents(ctx, b.tx, owned); err != nil {
+		b.logger.Error("failed to delete processed events", "error", err)
+		return err
+	}
+	return nil
+}
+
+// Nack records the failed attempts on the events that are still claimed by the agent,
+// which also releases the claim
+func (b *leaseBatch) Nack(ctx context.Context, updates []*eventmodels.DBEventUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	if err := b.begin(ctx); err != nil {
+		return err
+	}
+
+	var owned []*eventmodels.DBEventUpdate
+	for _, update := range updates {
+		if b.owned[update.ID] {
+			owned = append(owned, update)
+		}
+	}
+	if len(owned) == 0 {
+		return nil
+	}
+	return recordFailedEvents(ctx, b.tx, owned, b.logger)
+}
+
+func (b *leaseBatch) Commit(ctx context.Context) error {
+	if b.tx == nil {
+		return nil
+	}
+	if err := b.tx.Commit(ctx); err != nil {
+		b.logger.Error("failed to commit event batch", "error", err)
+		return err
+	}
+	b.tx = nil
+	return nil
+}
+
+// Abort discards the acks and nacks and releases the claim so the events are retried right away
+func (b *leaseBatch) Abort(ctx context.Context) error {
+	if b.tx != nil {
+		b.tx.Rollback(ctx)
+		b.tx = nil
+	}
+
+	eventIDs := make([]int64, len(b.events))
+	for i, event := range b.events {
+		eventIDs[i] = event.ID
+	}
+	if err := db.ReleaseDBEvents(ctx, b.db, eventIDs, b.claimToken); err != nil {
+		b.logger.Error("failed to release claimed events", "error", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package sources
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+// MemorySource serves events held in memory, e.g. for tests or replaying exported events.
+// Failed events are retried once their ProcessAfter has passed and dead-lettered events are kept aside.
+type MemorySource struct {
+	mu           sync.Mutex
+	batchSize    int
+	pending      []*eventmodels.DBEvent
+	acked        []int64
+	deadLettered []*eventmodels.DBEvent
+}
+
+// NewMemorySource creates a source serving the given events in batches of batchSize
+func NewMemorySource(batchSize int, events ...*eventmodels.DBEvent) *MemorySource {
+	return &MemorySource{
+		batchSize: batchSize,
+		pending:   events,
+	}
+}
+
+func (s *MemorySource) Name() string {
+	return "memory"
+}
+
+// Add queues more events
+func (s *MemorySource) Add(events ...*eventmodels.DBEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, events...)
+}
+
+// Pending returns the number of events that have not been acked or dead-lettered
+func (s *MemorySource) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Acked returns the IDs of the events that were delivered to every destination
+func (s *MemorySource) Acked() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.acked...)
+}
+
+// DeadLettered returns the events that were dead-lettered
+func (s *MemorySource) DeadLettered() []*eventmodels.DBEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*eventmodels.DBEvent(nil), s.deadLettered...)
+}
+
+// FetchBatch takes up to batchSize events that are due out of the queue until the batch is done
+func (s *MemorySource) FetchBatch(ctx context.Context) (Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var events, remaining []*eventmodels.DBEvent
+	for _, event := range s.pending {
+		if len(events) < s.batchSize && (event.ProcessAfter == nil || event.ProcessAfter.Before(now)) {
+			events = append(events, event)
+		} else {
+			remaining = append(remaining, event)
+		}
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	s.pending = remaining
+
+	return &memoryBatch{
+		source:  s,
+		events:  events,
+		updates: make(map[int64]*eventmodels.DBEventUpdate),
+	}, nil
+}
+
+type memoryBatch struct {
+	source  *MemorySource
+	events  []*eventmodels.DBEvent
+	acked   []int64
+	updates map[int64]*eventmodels.DBEventUpdate
+}
+
+func (b *memoryBatch) Events() []*eventmodels.DBEvent {
+	return b.events
+}
+
+func (b *memoryBatch) Full() bool {
+	return len(b.events) == b.source.batchSize
+}
+
+func (b *memoryBatch) Ack(ctx context.Context, eventIDs []int64) error {
+	b.acked = append(b.acked, eventIDs...)
+	return nil
+}
+
+func (b *memoryBatch) Nack(ctx context.Context, updates []*eventmodels.DBEventUpdate) error {
+	for _, update := range updates {
+		b.updates[update.ID] = update
+	}
+	return nil
+}
+
+// Commit applies the failed attempts to the events and requeues or dead-letters them
+func (b *memoryBatch) Commit(ctx context.Context) error {
+	s := b.source
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.acked = append(s.acked, b.acked...)
+	for _, event := range b.events {
+		update, failed := b.updates[event.ID]
+		if !failed {
+			continue
+		}
+		event.Retries = update.Retries
+		event.LastError = update.LastError
+		event.LastRetryAt = update.LastRetryAt
+		event.ProcessAfter = update.ProcessAfter
+		event.DeliveredTo = update.DeliveredTo
+		if update.DeadLetter {
+			s.deadLettered = append(s.deadLettered, event)
+		} else {
+			s.pending = append(s.pending, event)
+		}
+	}
+	return nil
+}
+
+// Abort puts the events back in the queue untouched
+func (b *memoryBatch) Abort(ctx context.Context) error {
+	s := b.source
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, b.events...)
+	return nil
+}
@@ -0,0 +1,138 @@
+package sources
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+// OutboxSource reads the event_log table written by the triggers
+type OutboxSource struct {
+	db     *pgxpool.Pool
+	logger *slog.Logger
+}
+
+// NewOutboxSource creates a source for the event_log table
+func NewOutboxSource(db *pgxpool.Pool, logger *slog.Logger) *OutboxSource {
+	return &OutboxSource{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (s *OutboxSource) Name() string {
+	return "outbox"
+}
+
+// FetchBatch takes a batch of events that are due for processing. In lock mode the row locks
+// are held until the batch is committed or aborted, in lease mode the events are claimed
+// and the claim is committed right away.
+func (s *OutboxSource) FetchBatch(ctx context.Context) (Batch, error) {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ClaimMode == config.ClaimModeLease {
+		return s.claimBatch(ctx)
+	}
+
+	dbEvents, tx, err := db.FetchDBEvents(ctx, s.db, groupsTransactions(ctx))
+	if err != nil {
+		s.logger.Error("failed to fetch events", "error", err)
+		return nil, err
+	}
+
+	if len(dbEvents) == 0 {
+		// No events to process, rollback the empty transaction
+		if tx != nil {
+			tx.Rollback(ctx)
+		}
+		return nil, nil
+	}
+
+	return &outboxBatch{
+		tx:     tx,
+		events: dbEvents,
+		full:   len(dbEvents) >= cfg.BatchSize,
+		logger: s.logger,
+	}, nil
+}
+
+func (s *OutboxSource) claimBatch(ctx context.Context) (Batch, error) {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claimedAt := time.Now()
+	token := claimToken(ctx, cfg.AgentID)
+	dbEvents, err := db.ClaimDBEvents(ctx, s.db, token, cfg.LeaseTimeout, groupsTransactions(ctx))
+	if err != nil {
+		s.logger.Error("failed to claim events", "error", err)
+		return nil, err
+	}
+
+	if len(dbEvents) == 0 {
+		return nil, nil
+	}
+
+	return &leaseBatch{
+		db:           s.db,
+		events:       dbEvents,
+		full:         len(dbEvents) >= cfg.BatchSize,
+		claimToken:   token,
+		leaseTimeout: cfg.LeaseTimeout,
+		claimedAt:    claimedAt,
+		logger:       s.logger,
+	}, nil
+}
+
+type outboxBatch struct {
+	tx     pgx.Tx
+	events []*eventmodels.DBEvent
+	full   bool
+	logger *slog.Logger
+}
+
+func (b *outboxBatch) Events() []*eventmodels.DBEvent {
+	return b.events
+}
+
+func (b *outboxBatch) Full() bool {
+	return b.full
+}
+
+// Ack deletes the delivered events from the event log
+func (b *outboxBatch) Ack(ctx context.Context, eventIDs []int64) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	b.logger.Info("flushing successful events", "count", len(eventIDs))
+	if err := db.FlushDBEvents(ctx, b.tx, eventIDs); err != nil {
+		b.logger.Error("failed to delete processed events", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (b *outboxBatch) Nack(ctx context.Context, updates []*eventmodels.DBEventUpdate) error {
+	return recordFailedEvents(ctx, b.tx, updates, b.logger)
+}
+
+func (b *outboxBatch) Commit(ctx context.Context) error {
+	if err := b.tx.Commit(ctx); err != nil {
+		b.logger.Error("failed to commit event batch", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (b *outboxBatch) Abort(ctx context.Context) error {
+	return b.tx.Rollback(ctx)
+}
@@ -0,0 +1,200 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+	"github.com/typeeng/pg_track_events/agent/internal/replication"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+// ReplicationSource reads the tables configured under replication from a logical replication slot
+type ReplicationSource struct {
+	db        *pgxpool.Pool
+	batchSize int
+	logger    *slog.Logger
+}
+
+// NewReplicationSource creates a source for the replication slot, creating the slot if it doesn't exist
+func NewReplicationSource(ctx context.Context, db *pgxpool.Pool, batchSize int, logger *slog.Logger) (*ReplicationSource, error) {
+	if err := replication.EnsureSlot(ctx, db); err != nil {
+		return nil, err
+	}
+	return &ReplicationSource{
+		db:        db,
+		batchSize: batchSize,
+		logger:    logger,
+	}, nil
+}
+
+func (s *ReplicationSource) Name() string {
+	return "replication"
+}
+
+// Serial is true since batches are read from the start of the slot until they are committed,
+// concurrent fetches would get the same changes
+func (s *ReplicationSource) Serial() bool {
+	return true
+}
+
+// FetchBatch reads the next batch of changes without consuming them, the slot is only
+// advanced when the batch is committed. The slot is locked until then, so while another
+// agent is reading it there is nothing to process.
+func (s *ReplicationSource) FetchBatch(ctx context.Context) (Batch, error) {
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	locked, err := replication.LockSlot(ctx, conn)
+	if err != nil {
+		conn.Release()
+		s.logger.Error("failed to lock replication slot", "error", err)
+		return nil, err
+	}
+	if !locked {
+		conn.Release()
+		s.logger.Info("replication slot is being read by another agent")
+		return nil, nil
+	}
+
+	changes, err := replication.FetchChanges(ctx, s.db, s.batchSize)
+	if err != nil {
+		s.logger.Error("failed to read replication slot", "error", err)
+		releaseSlotLock(ctx, conn, s.logger)
+		return nil, err
+	}
+
+	if changes.EndLSN == 0 {
+		releaseSlotLock(ctx, conn, s.logger)
+		return nil, nil
+	}
+
+	// Transactions that only touched other tables still need to be committed so the WAL can be recycled
+	return &replicationBatch{
+		db:       s.db,
+		lockConn: conn,
+		changes:  changes,
+		logger:   s.logger,
+	}, nil
+}
+
+// releaseSlotLock unlocks the slot and returns the connection to the pool. A connection that
+// failed to unlock is closed instead, which releases the lock with its session.
+func releaseSlotLock(ctx context.Context, conn *pgxpool.Conn, logger *slog.Logger) {
+	if err := replication.UnlockSlot(ctx, conn); err != nil {
+		logger.Error("failed to unlock replication slot, closing its connection", "error", err)
+		conn.Conn().Close(ctx)
+	}
+	conn.Release()
+}
+
+type replicationBatch struct {
+	db *pgxpool.Pool
+	// lockConn holds the slot lock until the batch is committed or aborted
+	lockConn *pgxpool.Conn
+	changes  *replication.Batch
+	// tx holds the failed events copied to the event log, opened by the first Nack
+	tx     pgx.Tx
+	logger *slog.Logger
+}
+
+func (b *replicationBatch) Events() []*eventmodels.DBEvent {
+	return b.changes.Events
+}
+
+func (b *replicationBatch) Full() bool {
+	return b.changes.Full
+}
+
+// Ack is a no-op, the slot is advanced past the whole batch on commit
+func (b *replicationBatch) Ack(ctx context.Context, eventIDs []int64) error {
+	return nil
+}
+
+// Nack copies the failed events into the event log, with their failed attempt recorded,
+// so they are retried from the outbox once the slot has moved past them
+func (b *replicationBatch) Nack(ctx context.Context, updates []*eventmodels.DBEventUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	eventsByID := make(map[int64]*eventmodels.DBEvent, len(b.changes.Events))
+	for _, dbEvent := range b.changes.Events {
+		eventsByID[dbEvent.ID] = dbEvent
+	}
+	failedEvents := make([]*eventmodels.DBEvent, len(updates))
+	for i, update := range updates {
+		dbEvent, ok := eventsByID[update.ID]
+		if !ok {
+			return fmt.Errorf("event %d is not part of the batch", update.ID)
+		}
+		failedEvents[i] = dbEvent
+	}
+
+	if b.tx == nil {
+		tx, err := b.db.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		b.tx = tx
+	}
+
+	b.logger.Info("enqueueing failed replicated events for retry", "count", len(failedEvents))
+	ids, err := db.EnqueueDBEvents(ctx, b.tx, failedEvents)
+	if err != nil {
+		b.logger.Error("failed to enqueue failed replicated events", "error", err)
+		return err
+	}
+
+	// The events are now identified by their event log row
+	eventLogUpdates := make([]*eventmodels.DBEventUpdate, len(updates))
+	for i, update := range updates {
+		eventLogUpdate := *update
+		eventLogUpdate.ID = ids[i]
+		eventLogUpdates[i] = &eventLogUpdate
+	}
+	return recordFailedEvents(ctx, b.tx, eventLogUpdates, b.logger)
+}
+
+// Commit saves the failed events and then advances the slot past the batch
+func (b *replicationBatch) Commit(ctx context.Context) error {
+	defer b.unlock(ctx)
+
+	if b.tx != nil {
+		if err := b.tx.Commit(ctx); err != nil {
+			b.logger.Error("failed to commit failed replicated events", "error", err)
+			return err
+		}
+		b.tx = nil
+	}
+
+	if err := replication.AdvanceSlot(ctx, b.db, b.changes.EndLSN); err != nil {
+		b.logger.Error("failed to advance replication slot", "error", err)
+		return err
+	}
+	b.logger.Info("advanced replication slot", "lsn", b.changes.EndLSN)
+	return nil
+}
+
+func (b *replicationBatch) Abort(ctx context.Context) error {
+	defer b.unlock(ctx)
+	if b.tx == nil {
+		return nil
+	}
+	err := b.tx.Rollback(ctx)
+	b.tx = nil
+	return err
+}
+
+// unlock releases the slot lock once, Abort can follow a failed Commit
+func (b *replicationBatch) unlock(ctx context.Context) {
+	if b.lockConn == nil {
+		return
+	}
+	releaseSlotLock(ctx, b.lockConn, b.logger)
+	b.lockConn = nil
+}
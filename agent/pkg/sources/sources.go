@@ -0,0 +1,113 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/typeeng/pg_track_events/agent/internal/config"
+	"github.com/typeeng/pg_track_events/agent/internal/db"
+	"github.com/typeeng/pg_track_events/agent/pkg/eventmodels"
+)
+
+// Source provides batches of DB events for the agent to deliver
+type Source interface {
+	// Name identifies the source in logs
+	Name() string
+	// FetchBatch returns the next batch of events, or nil if there is nothing to process
+	FetchBatch(ctx context.Context) (Batch, error)
+}
+
+// SerialSource is implemented by sources that can only have one batch in flight at a time,
+// the agent reads them from a single worker
+type SerialSource interface {
+	Source
+	Serial() bool
+}
+
+// workerKey is used as a key for storing the worker index in context
+type workerKey struct{}
+
+// WithWorker returns a new context for the batches of the agent's worker with the given index
+func WithWorker(ctx context.Context, worker int) context.Context {
+	return context.WithValue(ctx, workerKey{}, worker)
+}
+
+// groupTransactionsKey is used as a key for storing whether the batch groups transactions in context
+type groupTransactionsKey struct{}
+
+// WithTransactionGrouping returns a new context for fetching a batch that is processed with
+// transaction rules, which need all of a transaction's changes in the same batch
+func WithTransactionGrouping(ctx context.Context, groupTransactions bool) context.Context {
+	return context.WithValue(ctx, groupTransactionsKey{}, groupTransactions)
+}
+
+func groupsTransactions(ctx context.Context) bool {
+	groupTransactions, _ := ctx.Value(groupTransactionsKey{}).(bool)
+	return groupTransactions
+}
+
+// claimToken identifies the worker claiming events in lease mode, the workers of an agent
+// share its ID but must not act on each other's claims
+func claimToken(ctx context.Context, agentID string) string {
+	worker, _ := ctx.Value(workerKey{}).(int)
+	return fmt.Sprintf("%s/%d", agentID, worker)
+}
+
+// IsSerial reports whether the source must be read by a single worker
+func IsSerial(source Source) bool {
+	serial, ok := source.(SerialSource)
+	return ok && serial.Serial()
+}
+
+// Batch is a set of events fetched from a source. The agent delivers the events, then
+// Nacks the ones that failed, Acks the rest and Commits. If anything goes wrong before
+// Commit it calls Abort and the events are fetched again later.
+type Batch interface {
+	// Events returns the events in the batch, it may be empty if the batch only needs committing
+	Events() []*eventmodels.DBEvent
+	// Full reports whether the source may have more events ready right away
+	Full() bool
+	// Ack marks the events as delivered to every destination
+	Ack(ctx context.Context, eventIDs []int64) error
+	// Nack records a failed delivery attempt. Each update either schedules a retry or,
+	// if DeadLetter is set, moves the event to the dead letter table.
+	Nack(ctx context.Context, updates []*eventmodels.DBEventUpdate) error
+	// Commit persists the acks and nacks
+	Commit(ctx context.Context) error
+	// Abort discards the acks and nacks
+	Abort(ctx context.Context) error
+}
+
+// recordFailedEvents records the failed attempt on each event in the event log and moves
+// the events that should be dead-lettered out of the queue, all within the given transaction
+func recordFailedEvents(ctx context.Context, tx pgx.Tx, updates []*eventmodels.DBEventUpdate, logger *slog.Logger) error {
+	cfg, err := config.ConfigFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("updating failed events", "count", len(updates))
+	if err := db.UpdateDBEvents(ctx, tx, updates); err != nil {
+		logger.Error("failed to update failed events", "error", err)
+		return err
+	}
+
+	var deadLetterIDs []int64
+	for _, update := range updates {
+		if update.DeadLetter {
+			deadLetterIDs = append(deadLetterIDs, update.ID)
+		}
+	}
+
+	// Move events that exhausted their retries or failed permanently out of the queue in the same transaction
+	if len(deadLetterIDs) > 0 {
+		logger.Warn("moving events to dead letter table", "count", len(deadLetterIDs), "max_retries", cfg.MaxRetries)
+		if err := db.DeadLetterDBEvents(ctx, tx, deadLetterIDs); err != nil {
+			logger.Error("failed to dead letter events", "error", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -64,10 +64,14 @@ func (validator *CELValidator) CheckInput() error {
 	if len(validator.Table) < 1 {
 		return fmt.Errorf("missing table name")
 	}
-	if validator.Operation != "insert" && validator.Operation != "update" && validator.Operation != "delete" {
+	isOperation := validator.Operation == "insert" || validator.Operation == "update" || validator.Operation == "delete"
+	if !isOperation && !celutils.IsTransactionRule(validator.Table, validator.Operation) {
 		return fmt.Errorf("invalid operation name: %s", validator.Operation)
 	}
-	if validator.ExprKind != "cond" && validator.ExprKind != "prop" {
+	if isOperation && celutils.IsReservedTableName(validator.Table) {
+		return fmt.Errorf("table %s can't be tracked, its name is reserved for the %s variable", validator.Table, validator.Table)
+	}
+	if validator.ExprKind != "cond" && validator.ExprKind != "prop" && validator.ExprKind != "bool_cond" {
 		return fmt.Errorf("invalid expression kind: %s", validator.ExprKind)
 	}
 	if len(validator.Expr) < 1 {
@@ -97,6 +101,19 @@ func (validator *CELValidator) RunValidation(schemaPb protoreflect.FileDescripto
 			validator.Error = fmt.Sprintf("%v", err)
 			return
 		}
+	} else if validator.ExprKind == "bool_cond" {
+		env, err := celutils.CreateCELEnv(baseEnvOpts...)
+		if err != nil {
+			validator.Valid = false
+			validator.Error = fmt.Sprintf("%v", err)
+			return
+		}
+		_, err = celutils.CompileBoolCondition(env, validator.Expr)
+		if err != nil {
+			validator.Valid = false
+			validator.Error = fmt.Sprintf("%v", err)
+			return
+		}
 	} else if validator.ExprKind == "cond" {
 		eventsEnvOpts, err := celutils.GenerateCELEventsOptions(validator.Events)
 		if err != nil {
@@ -2,6 +2,7 @@ import { expect, test, describe } from "bun:test";
 import { parse, stringify } from "yaml";
 import { parseConfigFile, verifyCELExpressions } from "../config/config";
 import { initWasm } from "../config/wasm";
+import { analyticsConfigSchema, isTransactionRule } from "../config/yaml-schema";
 
 
 describe("verify yaml", () => {
@@ -146,4 +147,65 @@ describe("verify CEL values", () => {
     `)
   })
 })
-})
\ No newline at end of file
+})
+
+test("tx keys are transaction rules unless they name an operation", () => {
+  expect(isTransactionRule("tx.order_placed")).toBe(true);
+  expect(isTransactionRule("tx.insert")).toBe(false);
+  expect(isTransactionRule("orders.insert")).toBe(false);
+  expect(isTransactionRule("orders.order_placed")).toBe(false);
+});
+
+test("tables named after a built-in variable can't be tracked", () => {
+  const rule = { event: "CHANGED" };
+  for (const table of ["meta", "tx", "changed_columns"]) {
+    expect(analyticsConfigSchema.safeParse({ track: { [`${table}.insert`]: rule } }).success).toBe(false);
+  }
+  expect(analyticsConfigSchema.safeParse({ track: { "tx.order_placed": rule } }).success).toBe(true);
+  expect(analyticsConfigSchema.safeParse({ track: { "metadata.insert": rule } }).success).toBe(true);
+});
+
+test("a track key takes a list of rules and simple events take a bool cond", () => {
+  const config = {
+    track: {
+      "users.update": [
+        { event: "USER_UPDATED", properties: { id: "new.id" } },
+        {
+          cond: "old.plan != new.plan",
+          event: "PLAN_CHANGED",
+          properties: { plan: "new.plan" },
+        },
+      ],
+      "users.insert": { event: "USER_SIGNUP", cond: "new.verified" },
+    },
+  };
+  expect(analyticsConfigSchema.safeParse(config).success).toBe(true);
+  expect(analyticsConfigSchema.safeParse({ track: { "users.update": [] } }).success).toBe(false);
+});
+
+test("when_changed is only allowed on update rules", () => {
+  const rule = { event: "PROFILE_CHANGED", when_changed: ["email", "plan"] };
+  expect(analyticsConfigSchema.safeParse({ track: { "users.update": rule } }).success).toBe(true);
+  expect(
+    analyticsConfigSchema.safeParse({
+      track: { "users.update": [{ cond: "changed(\"plan\") ? events.PLAN_CHANGED : null", when_changed: ["plan"], PLAN_CHANGED: {} }] },
+    }).success
+  ).toBe(true);
+
+  const result = analyticsConfigSchema.safeParse({ track: { "users.insert": [rule] } });
+  expect(result.success).toBe(false);
+  expect(result.error?.issues[0]?.path).toEqual(["track", "users.insert", 0, "when_changed"]);
+});
+
+test("the rules of a list emit different events", () => {
+  const result = analyticsConfigSchema.safeParse({
+    track: {
+      "users.update": [
+        { event: "USER_UPDATED" },
+        { cond: "true ? events.USER_UPDATED : events.PLAN_CHANGED", USER_UPDATED: {}, PLAN_CHANGED: {} },
+      ],
+    },
+  });
+  expect(result.success).toBe(false);
+  expect(result.error?.issues[0]?.path).toEqual(["track", "users.update", 1]);
+});
@@ -1,5 +1,12 @@
 import { expect, test } from "bun:test";
-import { extractColumnsFromFunction, logChangesBuilder } from "../sql_functions/log-changes-builder";
+import {
+  extractColumnsFromFunction,
+  extractNotifyChannelFromFunction,
+  extractPrimaryKeyFromFunction,
+  capturesSessionMetadata,
+  extractTxContextSettingsFromFunction,
+  logChangesBuilder,
+} from "../sql_functions/log-changes-builder";
 
 test("can extract current columns from function body", () => {
   const columns = extractColumnsFromFunction(example);
@@ -21,6 +28,86 @@ test("can extract single columns from function body", () => {
   expect(columns).toEqual(new Set(["affiliation"]));
 });
 
+test("can extract notify channel from function body", () => {
+  const [, functionBody] = logChangesBuilder(
+    "alien_types",
+    ["affiliation"],
+    "pg_track_events"
+  );
+  expect(extractNotifyChannelFromFunction(functionBody)).toEqual(
+    "pg_track_events"
+  );
+  expect(extractColumnsFromFunction(functionBody)).toEqual(
+    new Set(["affiliation"])
+  );
+});
+
+test("functions without notify have no channel", () => {
+  expect(extractNotifyChannelFromFunction(exampleOneCol[1])).toBeUndefined();
+});
+
+test("can extract primary key from function body", () => {
+  const [, functionBody] = logChangesBuilder(
+    "alien_types",
+    ["affiliation", "id", "planet_id"],
+    undefined,
+    ["planet_id", "id"]
+  );
+  expect(extractPrimaryKeyFromFunction(functionBody)).toEqual([
+    "planet_id",
+    "id",
+  ]);
+  expect(extractColumnsFromFunction(functionBody)).toEqual(
+    new Set(["affiliation", "id", "planet_id"])
+  );
+});
+
+test("functions for tables without a primary key have no entity key", () => {
+  expect(exampleOneCol[1]).not.toContain("json_build_array");
+  expect(extractPrimaryKeyFromFunction(exampleOneCol[1])).toEqual([]);
+});
+
+test("functions capture the session metadata", () => {
+  expect(capturesSessionMetadata(exampleOneCol[1])).toBe(true);
+  expect(exampleOneCol[1]).toContain("session_metadata\n            );");
+  expect(
+    capturesSessionMetadata(
+      exampleOneCol[1].replaceAll("pg_track_events.metadata", "")
+    )
+  ).toBe(false);
+});
+
+test("can extract transaction context settings from function body", () => {
+  const [, functionBody] = logChangesBuilder(
+    "alien_types",
+    ["affiliation"],
+    undefined,
+    [],
+    ["app.user_id", "app.request_id"]
+  );
+  expect(extractTxContextSettingsFromFunction(functionBody)).toEqual([
+    "app.request_id",
+    "app.user_id",
+  ]);
+  expect(extractColumnsFromFunction(functionBody)).toEqual(
+    new Set(["affiliation"])
+  );
+
+  const [, withoutSettings] = logChangesBuilder(
+    "alien_types",
+    ["affiliation"],
+    undefined,
+    [],
+    []
+  );
+  expect(extractTxContextSettingsFromFunction(withoutSettings)).toEqual([]);
+});
+
+test("functions without tx_context don't record the transaction", () => {
+  expect(exampleOneCol[1]).not.toContain("txid_current()");
+  expect(extractTxContextSettingsFromFunction(exampleOneCol[1])).toBeUndefined();
+});
+
 const example = logChangesBuilder("alien_types", 
     ["affiliation",
       "average_lifespan",
@@ -1,5 +1,10 @@
-import { parse, parseDocument, stringify } from "yaml";
-import { analyticsConfigSchema, zodErrorToString } from "./yaml-schema";
+import { isMap, isSeq, parse, parseDocument, stringify } from "yaml";
+import {
+  analyticsConfigSchema,
+  EventConfig,
+  isTransactionRule,
+  zodErrorToString,
+} from "./yaml-schema";
 import { z } from "zod";
 import kleur from "kleur";
 import { initWasm } from "./wasm";
@@ -7,6 +12,7 @@ import {
   allowedTableNames,
   applyIgnoresToSchema,
   DatabaseSchema,
+  getColumnsForTable,
 } from "./introspection";
 
 /*
@@ -46,6 +52,10 @@ export async function parseConfigFile(
     const lines = fileContents.split("\n");
 
     for (const table of Object.keys(parsedYaml.track)) {
+      // Transaction rules match changes to any table
+      if (isTransactionRule(table)) {
+        continue;
+      }
       const tableName = table.substring(0, table.lastIndexOf("."));
       const tableNode = document.getIn(["track", table]);
 
@@ -63,7 +73,43 @@ export async function parseConfigFile(
           errorLine: lineNumber,
           lines: getLinesNear(lines, [lineNumber, lineNumber], message).text,
         });
+        continue;
       }
+
+      // when_changed must list columns the triggers record
+      const columns = getColumnsForTable(
+        applyIgnoresToSchema(introspectedSchema, parsedYaml.ignore || {}),
+        tableName
+      );
+      const rules = parsedYaml.track[table];
+      const ruleList = Array.isArray(rules) ? rules : [rules];
+      ruleList.forEach((rule: unknown, index: number) => {
+        const whenChanged = (rule as { when_changed?: unknown })?.when_changed;
+        if (!Array.isArray(whenChanged)) {
+          return;
+        }
+        whenChanged.forEach((column: unknown, columnIndex: number) => {
+          if (typeof column !== "string" || columns.has(column)) {
+            return;
+          }
+          const path = Array.isArray(rules)
+            ? ["track", table, index, "when_changed", columnIndex]
+            : ["track", table, "when_changed", columnIndex];
+          const columnNode = document.getIn(path, true) as {
+            range?: [number, number];
+          };
+          const columnLine = fileContents
+            .substring(0, columnNode?.range?.[0])
+            .split("\n").length;
+          const message = `Column ${column} does not exist in table ${tableName}. Cannot track changes to it. `;
+          errors.push({
+            message,
+            startLine: columnLine,
+            errorLine: columnLine,
+            lines: getLinesNear(lines, [columnLine, columnLine], message).text,
+          });
+        });
+      });
     }
 
     if (!skipCELValidation) {
@@ -106,19 +152,28 @@ export async function parseConfigFile(
       const lines = fileContents.split("\n");
       const document = parseDocument(fileContents);
 
-      const flattenedErrors = error.issues.flatMap((issue) => {
-        if (issue.code === "invalid_union") {
-          const value = document.getIn(issue.path)!;
-
-          if (typeof value === "object" && value !== null && "cond" in value) {
-            return issue.unionErrors[0]!.issues;
-          } else {
-            return issue.unionErrors[1]!.issues;
-          }
+      // Report the errors of the union member the value was meant to be
+      const flattenIssue = (issue: z.ZodIssue): z.ZodIssue[] => {
+        if (issue.code !== "invalid_union") {
+          return [issue];
+        }
+        const value = document.getIn(issue.path);
+        const unionErrors = issue.unionErrors;
+
+        // A list of rules or the single rule it could have been
+        if (
+          unionErrors.length === 2 &&
+          unionErrors[0]!.issues.some((i) => i.code === "invalid_union")
+        ) {
+          const isList = isSeq(value);
+          return unionErrors[isList ? 1 : 0]!.issues.flatMap(flattenIssue);
         }
 
-        return [issue];
-      });
+        const isConditional =
+          isMap(value) && value.has("cond") && !value.has("event");
+        return unionErrors[isConditional ? 0 : 1]!.issues.flatMap(flattenIssue);
+      };
+      const flattenedErrors = error.issues.flatMap(flattenIssue);
 
       const errorMessages: ParseConfigError[] = flattenedErrors.map((issue) => {
         const node =
@@ -192,43 +247,81 @@ export async function verifyCELExpressions(
   const { wasmlibValidateCELs, wasmlibSetSchema } = await initWasm();
   await wasmlibSetSchema(introspectedSchema);
   const pendingValidations: {
-    path: string[];
-    exprKind: "prop" | "cond";
+    path: (string | number)[];
+    exprKind: "prop" | "cond" | "bool_cond";
     table: string;
-    operation: "insert" | "update" | "delete";
+    // insert, update or delete, or the rule name of a transaction rule
+    operation: string;
     expr: string;
     events?: string[];
   }[] = [];
 
-  Object.entries(config.track).forEach(([tablePath, eventConfig]) => {
-    // Split tablePath into table and operation (e.g. "users.insert" -> ["users", "insert"])
-    const [table, operation] = tablePath.split(".") as [
-      string,
-      "insert" | "update" | "delete"
-    ];
+  Object.entries(config.track).forEach(([tablePath, rules]) => {
+    // Split tablePath into table and operation (e.g. "users.insert" -> ["users", "insert"],
+    // "tx.order_placed" -> ["tx", "order_placed"])
+    const [table, operation] = tablePath.split(".") as [string, string];
+
+    // A single rule or a list of rules, listed rules are referenced by their index
+    const ruleList: [(string | number)[], EventConfig][] = Array.isArray(rules)
+      ? rules.map((rule, index): [(string | number)[], EventConfig] => [
+          [tablePath, index],
+          rule,
+        ])
+      : [[[tablePath], rules]];
+
+    ruleList.forEach(([rulePath, eventConfig]) => {
+      // Handle simple events, which may have a bool cond
+      if ("event" in eventConfig) {
+        if (eventConfig.cond !== undefined) {
+          pendingValidations.push({
+            path: [...rulePath, "cond"],
+            exprKind: "bool_cond",
+            table: table,
+            operation: operation,
+            expr: eventConfig.cond,
+          });
+        }
+
+        // Iterate through properties if they exist
+        if (eventConfig.properties) {
+          Object.entries(eventConfig.properties).forEach(
+            ([propPath, propExpr]) => {
+              // Full path as array: [...rulePath, 'properties', propPath]
+              const fullPath = [...rulePath, "properties", propPath];
+              pendingValidations.push({
+                path: fullPath,
+                exprKind: "prop",
+                table: table,
+                operation: operation,
+                expr: propExpr,
+              });
+            }
+          );
+        }
+        return;
+      }
 
-    // Handle conditional events
-    if ("cond" in eventConfig) {
+      // Handle conditional events
       // Verify the condition expression
       const condExpr = eventConfig.cond;
 
       pendingValidations.push({
-        path: [tablePath, "cond"],
+        path: [...rulePath, "cond"],
         exprKind: "cond",
         table: table,
         operation: operation,
         expr: condExpr,
-        events: Object.keys(eventConfig),
+        events: Object.keys(eventConfig).filter((key) => key !== "when_changed"),
       });
 
       // Iterate through each event's properties
       Object.entries(eventConfig).forEach(([key, value]) => {
-        if (key !== "cond") {
+        if (key !== "cond" && key !== "when_changed") {
           // Each key is an event name, value is record of properties
           Object.entries(value as Record<string, string>).forEach(
             ([propPath, propExpr]) => {
-              // Full path as array: [tablePath, eventName, propPath]
-              const fullPath = [tablePath, key, propPath];
+              // Full path as array: [...rulePath, eventName, propPath]
+              const fullPath = [...rulePath, key, propPath];
 
               pendingValidations.push({
                 path: fullPath,
@@ -241,26 +334,7 @@ export async function verifyCELExpressions(
           );
         }
       });
-    }
-    // Handle simple events
-    else {
-      // Iterate through properties if they exist
-      if (eventConfig.properties) {
-        Object.entries(eventConfig.properties).forEach(
-          ([propPath, propExpr]) => {
-            // Full path as array: [tablePath, 'properties', propPath]
-            const fullPath = [tablePath, "properties", propPath];
-            pendingValidations.push({
-              path: fullPath,
-              exprKind: "prop",
-              table: table,
-              operation: operation,
-              expr: propExpr,
-            });
-          }
-        );
-      }
-    }
+    });
   });
 
   const result = await wasmlibValidateCELs({
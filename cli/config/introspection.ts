@@ -143,3 +143,18 @@ export function getColumnsForTable(
   }
   return new Set(table.columns.map((column) => column.name));
 }
+
+export function getPrimaryKeyForTable(
+  schema: DatabaseSchema,
+  tableName: string
+): string[] {
+  const normalizedTableName = tableName.startsWith("public.")
+    ? tableName
+    : `public.${tableName}`;
+
+  const table = schema.find(
+    (t) => t.name === normalizedTableName || t.name === tableName
+  );
+
+  return table?.primaryKey || [];
+}
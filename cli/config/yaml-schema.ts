@@ -4,11 +4,17 @@ import { z } from "zod";
 // Property getters (CEL expressions)
 const celExpressionSchema = z.string();
 
+// Columns an update rule is limited to, it only runs when one of them changed
+const whenChangedSchema = z.array(z.string()).min(1);
+
 // Schema for simple events
 const simpleEventSchema = z
   .object({
     event: z.string(),
     properties: z.record(celExpressionSchema).optional(),
+    // Optional bool expression, the event is only emitted when it is true
+    cond: celExpressionSchema.optional(),
+    when_changed: whenChangedSchema.optional(),
   })
   .strict();
 
@@ -16,6 +22,7 @@ const simpleEventSchema = z
 const conditionalEventSchema = z
   .object({
     cond: z.string(),
+    when_changed: whenChangedSchema.optional(),
   })
   .catchall(z.record(celExpressionSchema));
 
@@ -35,18 +42,87 @@ const eventConfigSchema = z
     }
   });
 
+// A key tracks a single rule or a list of rules, each emitted independently
+const eventRulesSchema = z.union([
+  eventConfigSchema,
+  z.array(eventConfigSchema).min(1),
+]);
+
+// Transaction rules are named tx.{rule}, tx.insert etc. would track a table named tx
+export function isTransactionRule(key: string) {
+  return /^tx\.[a-zA-Z0-9_]+$/.test(key) && !/\.(insert|update|delete)$/.test(key);
+}
+
+// Tables named after a built-in CEL variable can't be tracked, their variable would collide
+export const reservedTableNames = ["meta", "tx", "changed_columns"];
+
+// The names of the events a rule can emit, a conditional event's other keys are its events
+function eventNames(rule: z.infer<typeof eventConfigSchema>): string[] {
+  if (typeof rule.event === "string") {
+    return [rule.event];
+  }
+  return Object.keys(rule).filter((key) => key !== "cond" && key !== "when_changed");
+}
+
 // Schema for tracking configuration
-const trackingConfigSchema = z.record(
-  // Key pattern: table_name.insert|update|delete
-  z.string().regex(/^[a-zA-Z0-9_]+\.(insert|update|delete)$/),
-  // Value is either a simple event or conditional event
-  eventConfigSchema
-);
+const trackingConfigSchema = z
+  .record(
+    // Key pattern: table_name.insert|update|delete or tx.rule_name
+    z.string().regex(/^([a-zA-Z0-9_]+\.(insert|update|delete)|tx\.[a-zA-Z0-9_]+)$/),
+    // Value is a simple event, a conditional event or a list of them
+    eventRulesSchema
+  )
+  .superRefine((track, ctx) => {
+    for (const [key, rules] of Object.entries(track)) {
+      const table = key.split(".")[0];
+      if (!isTransactionRule(key) && reservedTableNames.includes(table)) {
+        ctx.addIssue({
+          code: z.ZodIssueCode.custom,
+          path: [key],
+          message: `table ${table} can't be tracked, its name is reserved for the ${table} variable`,
+        });
+      }
+      // Deliveries of a list's events are tracked by event name
+      if (Array.isArray(rules)) {
+        const emittedBy = new Map<string, number>();
+        rules.forEach((rule, index) => {
+          for (const name of eventNames(rule)) {
+            const first = emittedBy.get(name);
+            if (first !== undefined) {
+              ctx.addIssue({
+                code: z.ZodIssueCode.custom,
+                path: [key, index],
+                message: `event ${name} is also emitted by ${key}[${first}], the rules of a list must emit different events`,
+              });
+              continue;
+            }
+            emittedBy.set(name, index);
+          }
+        });
+      }
+      if (key.endsWith(".update")) {
+        continue;
+      }
+      const ruleList = Array.isArray(rules) ? rules : [rules];
+      ruleList.forEach((rule, index) => {
+        if (rule.when_changed !== undefined) {
+          ctx.addIssue({
+            code: z.ZodIssueCode.custom,
+            path: Array.isArray(rules)
+              ? [key, index, "when_changed"]
+              : [key, "when_changed"],
+            message: "when_changed is only supported for update rules",
+          });
+        }
+      });
+    }
+  });
 
 // Schema for destination configuration
 const destinationConfigSchema = z.object({
   // TODO Make this stricter to validate setup of db event destinations
   filter: z.string().default("*"), // Default to "*" if not specified
+  type: z.string().optional(), // Destination kind, defaults to the destination name
 });
 
 // Schema for destinations
@@ -69,6 +145,7 @@ const ignoreSchema = z.record(
 const rawDBEventDestinationSchema= z.object({
   // TODO Make this stricter to validate setup of db event destinations
   filter: z.string().default("*"), // Default to "*" if not specified
+  type: z.string().optional(), // Destination kind, defaults to the destination name
 });
 
 const rawDBEventDestinationsSchema = z
@@ -78,6 +155,54 @@ const rawDBEventDestinationsSchema = z
 )
 .optional();
 
+// Tables read from a logical replication slot instead of triggers
+const replicationSchema = z
+  .object({
+    slot: z
+      .string()
+      .regex(/^[a-zA-Z0-9_]+$/, "slot must only contain letters, numbers and underscores")
+      .optional(),
+    publication: z
+      .string()
+      .regex(/^[a-zA-Z0-9_]+$/, "publication must only contain letters, numbers and underscores")
+      .optional(),
+    tables: z.array(z.string()).min(1),
+  })
+  .strict();
+
+// Go duration, e.g. "30s" or "15m"
+const durationSchema = z
+  .string()
+  .regex(/^(\d+(\.\d+)?(ns|us|µs|ms|s|m|h))+$/, "must be a duration such as 30s, 15m or 1h");
+
+// Queue lag thresholds the agent alerts on
+const monitoringSchema = z
+  .object({
+    interval: durationSchema.optional(),
+    max_pending: z.number().int().nonnegative().optional(),
+    max_retrying: z.number().int().nonnegative().optional(),
+    max_oldest_age: durationSchema.optional(),
+    webhook_url: z.string().optional(),
+  })
+  .strict();
+
+// Transaction context the triggers record with each change
+const txContextSchema = z
+  .object({
+    // Custom settings read with current_setting(name, true), e.g. app.user_id
+    settings: z
+      .array(
+        z
+          .string()
+          .regex(
+            /^[a-zA-Z_][a-zA-Z0-9_]*\.[a-zA-Z_][a-zA-Z0-9_]*$/,
+            "settings must be custom settings such as app.user_id"
+          )
+      )
+      .optional(),
+  })
+  .strict();
+
 // Main schema for the YAML file
 const analyticsConfigSchema = z
   .object({
@@ -85,6 +210,14 @@ const analyticsConfigSchema = z
     ignore: ignoreSchema.optional(),
     destinations: destinationsSchema,
     raw_db_event_destinations: rawDBEventDestinationsSchema,
+    // Channel the triggers pg_notify on so agents can LISTEN instead of polling
+    notify_channel: z
+      .string()
+      .regex(/^[a-zA-Z0-9_]+$/, "notify_channel must only contain letters, numbers and underscores")
+      .optional(),
+    replication: replicationSchema.optional(),
+    monitoring: monitoringSchema.optional(),
+    tx_context: txContextSchema.optional(),
   })
   .strict();
 
@@ -98,10 +231,13 @@ export function zodErrorToString(issue: z.ZodError["issues"][0]) {
     issue.code === "invalid_string" &&
     issue.validation === "regex"
   ) {
-    return `Transforms must be named {table}.{insert|update|delete}`;
+    return `Transforms must be named {table}.{insert|update|delete} or tx.{rule}`;
   }
 
   return issue.message;
 }
 
+export type EventConfig = z.infer<typeof eventConfigSchema>;
 export type IgnoreConfig = z.infer<typeof ignoreSchema>;
+export type ReplicationConfig = z.infer<typeof replicationSchema>;
+export type TxContextConfig = z.infer<typeof txContextSchema>;
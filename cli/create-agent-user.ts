@@ -34,7 +34,7 @@ export async function createAgentUser(sql: SQL, databaseUrl: string) {
          ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT TRIGGER ON TABLES TO schema_pg_track_events_agent;
          -- schema_pg_track_events schema permissions
          GRANT USAGE ON SCHEMA schema_pg_track_events TO schema_pg_track_events_agent;
-         GRANT SELECT, INSERT ON schema_pg_track_events.event_log TO schema_pg_track_events_agent;
+         GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA schema_pg_track_events TO schema_pg_track_events_agent;
          ALTER DEFAULT PRIVILEGES IN SCHEMA schema_pg_track_events GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO schema_pg_track_events_agent;
       END $$;
     `);
@@ -67,7 +67,7 @@ program
       await addTriggersForNewTables(
         sql,
         configPath,
-        config.data.ignore || {},
+        config.data,
         options.autoApply,
         options.autoMigrate
       );
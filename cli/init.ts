@@ -5,9 +5,18 @@ import kleur from "kleur";
 import { SQLBuilder } from "./sql_functions/sql-builder";
 import { parseDocument } from "yaml";
 import { logChangesBuilder } from "./sql_functions/log-changes-builder";
+import {
+  deadLetterTableDDL,
+  deadLetterTableDescription,
+  entityKeyIndexDDL,
+  entityKeyIndexDescription,
+  txidIndexDDL,
+  txidIndexDescription,
+} from "./sql_functions/schema-upgrades";
 import {
   getColumnsForTable,
   getIntrospectedSchema,
+  getPrimaryKeyForTable,
   getTableNames,
 } from "./config/introspection";
 const { MultiSelect, Input } = require("enquirer");
@@ -81,6 +90,12 @@ export async function init(tightDir: string, sql: SQL, reset: boolean = false) {
     old_row JSONB,
     new_row JSONB,
     metadata JSONB,
+    delivered_to TEXT[] NOT NULL DEFAULT '{}',
+    retry_history JSONB NOT NULL DEFAULT '[]',
+    claimed_by TEXT,
+    entity_key TEXT,
+    txid BIGINT,
+    tx_context JSONB,
     CONSTRAINT event_type_update_check CHECK (
       (event_type = 'update' AND old_row IS NOT NULL AND new_row IS NOT NULL) OR
       (event_type != 'update')
@@ -99,12 +114,17 @@ export async function init(tightDir: string, sql: SQL, reset: boolean = false) {
     )} ${kleur.bold(schemaName)} ${kleur.dim("schema")}`
   );
 
+  sqlBuilder.add(deadLetterTableDDL, deadLetterTableDescription);
+
   sqlBuilder.add(
     `CREATE INDEX CONCURRENTLY IF NOT EXISTS event_log_process_after_idx
     ON ${schemaName}.event_log (process_after)`,
     `${kleur.dim("+")} ${kleur.bold("event_log_process_after_idx")} ${kleur.dim("index")}`
   );
 
+  sqlBuilder.add(entityKeyIndexDDL, entityKeyIndexDescription);
+  sqlBuilder.add(txidIndexDDL, txidIndexDescription);
+
   // Add triggers for each table with progress indicator
 
   for (const table of selectedTables) {
@@ -112,7 +132,9 @@ export async function init(tightDir: string, sql: SQL, reset: boolean = false) {
 
     const [functionName, functionBody] = logChangesBuilder(
       table,
-      Array.from(allColumnNames)
+      Array.from(allColumnNames),
+      undefined,
+      getPrimaryKeyForTable(introspectedSchema, table)
     );
     console.log(functionBody);
     sqlBuilder.add(
@@ -1,10 +1,17 @@
+// Session setting the app sets to a JSON object describing who made the change, copied into
+// event_log.metadata and exposed to CEL as `meta`
+export const metadataSetting = "pg_track_events.metadata";
+
 export function tableNameToAuditFunctionName(tableName: string) {
   return `schema_pg_track_events.log_${tableName.toLowerCase()}_changes`;
 }
 
 export function logChangesBuilder(
   tableName: string,
-  includedColumns: string[]
+  includedColumns: string[],
+  notifyChannel?: string,
+  primaryKey: string[] = [],
+  txContextSettings?: string[]
 ) {
   const functionName = tableNameToAuditFunctionName(tableName);
 
@@ -15,50 +22,123 @@ export function logChangesBuilder(
       .map((col) => `'${col}', ${prefix}."${col}"`)
       .join(", ")})`;
 
+  // Identifies the row for ORDERING=entity, tables without a primary key are not ordered
+  const entityKey = (prefix: "NEW" | "OLD") =>
+    primaryKey.length > 0
+      ? `json_build_array(TG_TABLE_NAME, ${primaryKey
+          .map((col) => `${prefix}."${col}"`)
+          .join(", ")})::text`
+      : "NULL";
+
+  // Wake up agents listening on the channel. Postgres collapses identical notifications
+  // sent in the same transaction, so a constant payload means one notification per commit.
+  const notify = notifyChannel
+    ? `
+        PERFORM pg_notify('${notifyChannel}', '');`
+    : "";
+
+  // Who and what made the change, only recorded when tx_context is configured. The
+  // transaction id lets the agent group the changes made by one transaction.
+  const settings = (txContextSettings || [])
+    .slice()
+    .sort()
+    .map(
+      (setting) =>
+        `\n            '${setting}', NULLIF(current_setting('${setting}', true), '')`
+    )
+    .join(",");
+  const txContext = txContextSettings
+    ? `
+    transaction_context := jsonb_build_object(
+        'application_name', current_setting('application_name'),
+        'current_user', current_user,
+        'session_user', session_user,
+        'settings', jsonb_strip_nulls(jsonb_build_object(${
+          settings ? `${settings}\n        ` : ""
+        }))
+    );
+`
+    : "";
+  const txContextDeclaration = txContextSettings
+    ? `
+    transaction_context JSONB;`
+    : "";
+  const txContextColumns = txContextSettings
+    ? `,
+                txid,
+                tx_context`
+    : "";
+  const txContextValues = txContextSettings
+    ? `,
+                txid_current(),
+                transaction_context`
+    : "";
+
   const functionBody = `-- Generic trigger function for insert, update, and delete
 CREATE OR REPLACE FUNCTION ${functionName}()
 RETURNS TRIGGER
 SECURITY DEFINER
 AS $$
+DECLARE
+    session_metadata JSONB;${txContextDeclaration}
 BEGIN
+    -- Invalid JSON in the setting must not lose the event, it is logged without metadata
+    BEGIN
+        session_metadata := NULLIF(current_setting('${metadataSetting}', true), '')::jsonb;
+    EXCEPTION WHEN OTHERS THEN
+        RAISE WARNING 'Ignoring invalid ${metadataSetting} in ${functionName}: %', SQLERRM;
+    END;
+${txContext}
     BEGIN
         IF (TG_OP = 'INSERT') THEN
             INSERT INTO schema_pg_track_events.event_log (
                 event_type,
                 row_table_name,
                 old_row,
-                new_row
+                new_row,
+                entity_key,
+                metadata${txContextColumns}
             ) VALUES (
                 'insert',
                 TG_TABLE_NAME,
                 NULL,
-                ${jsonBuildObject("NEW")}
+                ${jsonBuildObject("NEW")},
+                ${entityKey("NEW")},
+                session_metadata${txContextValues}
             );
         ELSIF (TG_OP = 'UPDATE') THEN
             INSERT INTO schema_pg_track_events.event_log (
                 event_type,
                 row_table_name,
                 old_row,
-                new_row
+                new_row,
+                entity_key,
+                metadata${txContextColumns}
             ) VALUES (
                 'update',
                 TG_TABLE_NAME,
                 ${jsonBuildObject("OLD")},
-                ${jsonBuildObject("NEW")}
+                ${jsonBuildObject("NEW")},
+                ${entityKey("NEW")},
+                session_metadata${txContextValues}
             );
         ELSIF (TG_OP = 'DELETE') THEN
             INSERT INTO schema_pg_track_events.event_log (
                 event_type,
                 row_table_name,
                 old_row,
-                new_row
+                new_row,
+                entity_key,
+                metadata${txContextColumns}
             ) VALUES (
                 'delete',
                 TG_TABLE_NAME,
                 ${jsonBuildObject("OLD")},
-                NULL
+                NULL,
+                ${entityKey("OLD")},
+                session_metadata${txContextValues}
             );
-        END IF;
+        END IF;${notify}
     EXCEPTION WHEN OTHERS THEN
         -- Log the error to PostgreSQL's error log
         RAISE WARNING 'Error in ${functionName}: %', SQLERRM;
@@ -87,3 +167,38 @@ export function extractColumnsFromFunction(query: string): Set<string> {
 
   return columnSet;
 }
+
+export function extractNotifyChannelFromFunction(
+  query: string
+): string | undefined {
+  const match = /pg_notify\('([^']+)'/.exec(query);
+  return match ? match[1] : undefined;
+}
+
+export function extractPrimaryKeyFromFunction(query: string): string[] {
+  const match = /json_build_array\(TG_TABLE_NAME((?:, (?:NEW|OLD)\."[^"]+")*)\)/.exec(
+    query
+  );
+  if (!match) {
+    return [];
+  }
+  return Array.from(match[1].matchAll(/\."([^"]+)"/g), (m) => m[1]);
+}
+
+export function capturesSessionMetadata(query: string): boolean {
+  return query.includes(`current_setting('${metadataSetting}'`);
+}
+
+// Returns the settings recorded in the transaction context, or undefined when the function
+// doesn't record it
+export function extractTxContextSettingsFromFunction(
+  query: string
+): string[] | undefined {
+  if (!query.includes("txid_current()")) {
+    return undefined;
+  }
+  return Array.from(
+    query.matchAll(/'([^']+)', NULLIF\(current_setting\('\1', true\), ''\)/g),
+    (m) => m[1]
+  );
+}
@@ -0,0 +1,88 @@
+import { SQL } from "bun";
+import kleur from "kleur";
+import { SQLBuilder } from "./sql-builder";
+import { ReplicationConfig } from "../config/yaml-schema";
+import { difference, isEqual } from "./set-utils";
+
+export const defaultPublicationName = "pg_track_events";
+
+/**
+ * Stages the publication for replicated tables and sets their replica identity to FULL,
+ * so old rows in the WAL match what the triggers would have logged.
+ * @returns The number of staged statements
+ */
+export async function addReplicationChanges(
+  sql: SQL,
+  sqlBuilder: SQLBuilder,
+  replication: ReplicationConfig
+): Promise<number> {
+  const publication = replication.publication || defaultPublicationName;
+  const tables = new Set(replication.tables);
+  const tableList = Array.from(tables)
+    .sort()
+    .map((table) => `public."${table}"`)
+    .join(", ");
+
+  let staged = 0;
+
+  const publicationExists = !!(
+    await sql`SELECT pubname FROM pg_publication WHERE pubname = ${publication}`
+  )[0];
+  if (!publicationExists) {
+    sqlBuilder.add(
+      `CREATE PUBLICATION "${publication}" FOR TABLE ${tableList};`,
+      `${kleur.dim("+")} ${kleur.bold(publication)} ${kleur.dim(
+        "publication for"
+      )} ${kleur.bold(Array.from(tables).sort().join(", "))}`
+    );
+    staged++;
+  } else {
+    const published = await sql`
+      SELECT tablename
+      FROM pg_publication_tables
+      WHERE pubname = ${publication}
+        AND schemaname = 'public'
+    `;
+    const publishedTables = new Set<string>(
+      published.map((row: { tablename: string }) => row.tablename)
+    );
+    if (!isEqual(tables, publishedTables)) {
+      const added = Array.from(difference(tables, publishedTables)).sort();
+      const removed = Array.from(difference(publishedTables, tables)).sort();
+      sqlBuilder.add(
+        `ALTER PUBLICATION "${publication}" SET TABLE ${tableList};`,
+        `${kleur.dim("~")} ${kleur.bold(publication)} ${kleur.dim(
+          `publication updated.${
+            added.length ? ` Added (+${added.join(", ")})` : ""
+          }${added.length && removed.length ? " and" : ""}${
+            removed.length ? ` removed (-${removed.join(", ")})` : ""
+          }`
+        )}`
+      );
+      staged++;
+    }
+  }
+
+  const identities = await sql`
+    SELECT c.relname, c.relreplident
+    FROM pg_class c
+    JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE n.nspname = 'public'
+      AND c.relname IN ${sql(Array.from(tables))}
+  `;
+  for (const { relname, relreplident } of identities) {
+    // 'f' is FULL, anything else only logs the key columns of old rows
+    if (relreplident === "f") {
+      continue;
+    }
+    sqlBuilder.add(
+      `ALTER TABLE public."${relname}" REPLICA IDENTITY FULL;`,
+      `${kleur.dim("~")} ${kleur.bold(relname)} ${kleur.dim(
+        "table replica identity set to FULL"
+      )}`
+    );
+    staged++;
+  }
+
+  return staged;
+}
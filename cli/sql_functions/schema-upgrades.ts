@@ -0,0 +1,167 @@
+import { SQL } from "bun";
+import kleur from "kleur";
+import { SQLBuilder } from "./sql-builder";
+
+type ColumnUpgrade = {
+  name: string;
+  definition: string;
+};
+
+// Columns added to schema_pg_track_events.event_log after the initial release.
+// `init` creates them as part of the table, `apply-triggers` adds them to older installs.
+export const eventLogColumnUpgrades: ColumnUpgrade[] = [
+  // Destinations that acknowledged the event, skipped when the event is retried
+  { name: "delivered_to", definition: "TEXT[] NOT NULL DEFAULT '{}'" },
+  // One entry per failed attempt: {retry, at, error, destinations}
+  { name: "retry_history", definition: "JSONB NOT NULL DEFAULT '[]'" },
+  // Agent holding the lease on the event when running with CLAIM_MODE=lease
+  { name: "claimed_by", definition: "TEXT" },
+  // Table and primary key of the changed row, used by ORDERING=entity
+  { name: "entity_key", definition: "TEXT" },
+  // Transaction that made the change and its context, recorded when tx_context is configured
+  { name: "txid", definition: "BIGINT" },
+  { name: "tx_context", definition: "JSONB" },
+];
+
+// Columns added to schema_pg_track_events.dead_letter after it was introduced
+export const deadLetterColumnUpgrades: ColumnUpgrade[] = [
+  { name: "txid", definition: "BIGINT" },
+  { name: "tx_context", definition: "JSONB" },
+  // Kept so replayed events are ordered with the rest of their row's events
+  { name: "entity_key", definition: "TEXT" },
+];
+
+// Events that exhausted their retries are moved here by the agent
+export const deadLetterTableDDL = `CREATE TABLE IF NOT EXISTS schema_pg_track_events.dead_letter (
+    id BIGINT PRIMARY KEY,
+    event_type schema_pg_track_events.event_type NOT NULL,
+    row_table_name TEXT NOT NULL,
+    logged_at TIMESTAMPTZ NOT NULL,
+    retries INT NOT NULL,
+    last_error TEXT,
+    last_retry_at TIMESTAMPTZ,
+    failed_destinations TEXT[] NOT NULL DEFAULT '{}',
+    retry_history JSONB NOT NULL DEFAULT '[]',
+    old_row JSONB,
+    new_row JSONB,
+    metadata JSONB,
+    delivered_to TEXT[] NOT NULL DEFAULT '{}',
+    txid BIGINT,
+    tx_context JSONB,
+    entity_key TEXT,
+    dead_lettered_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp()
+  )`;
+
+export const deadLetterTableDescription = `${kleur.dim("+")} ${kleur.bold(
+  "dead_letter"
+)} ${kleur.dim("table in")} ${kleur.bold(
+  "schema_pg_track_events"
+)} ${kleur.dim("schema")}`;
+
+// Lets the agent find earlier pending events for the same row when ORDERING=entity
+export const entityKeyIndexDDL = `CREATE INDEX CONCURRENTLY IF NOT EXISTS event_log_entity_key_idx
+    ON schema_pg_track_events.event_log (entity_key, id)
+    WHERE entity_key IS NOT NULL`;
+
+export const entityKeyIndexDescription = `${kleur.dim("+")} ${kleur.bold(
+  "event_log_entity_key_idx"
+)} ${kleur.dim("index")}`;
+
+// Lets the agent find the other changes of a transaction in a batch
+export const txidIndexDDL = `CREATE INDEX CONCURRENTLY IF NOT EXISTS event_log_txid_idx
+    ON schema_pg_track_events.event_log (txid)
+    WHERE txid IS NOT NULL`;
+
+export const txidIndexDescription = `${kleur.dim("+")} ${kleur.bold(
+  "event_log_txid_idx"
+)} ${kleur.dim("index")}`;
+
+/**
+ * Stages statements for any event_log columns or tables missing from the database
+ * @returns The number of staged upgrade statements
+ */
+export async function addSchemaUpgrades(
+  sql: SQL,
+  sqlBuilder: SQLBuilder
+): Promise<number> {
+  const existing = await sql`
+    SELECT table_name, column_name
+    FROM information_schema.columns
+    WHERE table_schema = 'schema_pg_track_events'
+      AND table_name IN ('event_log', 'dead_letter')
+  `;
+  const existingColumns = new Set(
+    existing.map(
+      (row: { table_name: string; column_name: string }) =>
+        `${row.table_name}.${row.column_name}`
+    )
+  );
+
+  let staged = 0;
+  for (const column of eventLogColumnUpgrades) {
+    if (existingColumns.has(`event_log.${column.name}`)) {
+      continue;
+    }
+    sqlBuilder.add(
+      `ALTER TABLE schema_pg_track_events.event_log ADD COLUMN IF NOT EXISTS ${column.name} ${column.definition}`,
+      `${kleur.dim("+")} ${kleur.bold(column.name)} ${kleur.dim(
+        "column on"
+      )} ${kleur.bold("event_log")} ${kleur.dim("table")}`
+    );
+    staged++;
+  }
+
+  const deadLetterExists = !!(
+    await sql`
+    SELECT table_name
+    FROM information_schema.tables
+    WHERE table_schema = 'schema_pg_track_events'
+      AND table_name = 'dead_letter'
+  `
+  )[0];
+  if (!deadLetterExists) {
+    sqlBuilder.add(deadLetterTableDDL, deadLetterTableDescription);
+    staged++;
+  } else {
+    for (const column of deadLetterColumnUpgrades) {
+      if (existingColumns.has(`dead_letter.${column.name}`)) {
+        continue;
+      }
+      sqlBuilder.add(
+        `ALTER TABLE schema_pg_track_events.dead_letter ADD COLUMN IF NOT EXISTS ${column.name} ${column.definition}`,
+        `${kleur.dim("+")} ${kleur.bold(column.name)} ${kleur.dim(
+          "column on"
+        )} ${kleur.bold("dead_letter")} ${kleur.dim("table")}`
+      );
+      staged++;
+    }
+  }
+
+  const entityKeyIndexExists = !!(
+    await sql`
+    SELECT indexname
+    FROM pg_indexes
+    WHERE schemaname = 'schema_pg_track_events'
+      AND indexname = 'event_log_entity_key_idx'
+  `
+  )[0];
+  if (!entityKeyIndexExists) {
+    sqlBuilder.add(entityKeyIndexDDL, entityKeyIndexDescription);
+    staged++;
+  }
+
+  const txidIndexExists = !!(
+    await sql`
+    SELECT indexname
+    FROM pg_indexes
+    WHERE schemaname = 'schema_pg_track_events'
+      AND indexname = 'event_log_txid_idx'
+  `
+  )[0];
+  if (!txidIndexExists) {
+    sqlBuilder.add(txidIndexDDL, txidIndexDescription);
+    staged++;
+  }
+
+  return staged;
+}
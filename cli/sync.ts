@@ -7,32 +7,54 @@ import kleur from "kleur";
 import { SQLBuilder } from "./sql_functions/sql-builder";
 import { parseDocument } from "yaml";
 import { schemaName } from "./init";
-import { IgnoreConfig } from "./config/yaml-schema";
+import { AnalyticsConfig } from "./config/yaml-schema";
 import { addToIgnore } from "./config/yaml-utils";
 import path from "path";
 import {
   extractColumnsFromFunction,
+  extractNotifyChannelFromFunction,
+  extractPrimaryKeyFromFunction,
+  capturesSessionMetadata,
+  extractTxContextSettingsFromFunction,
   logChangesBuilder,
 } from "./sql_functions/log-changes-builder";
 import {
   getColumnsForTable,
   getIntrospectedSchema,
+  getPrimaryKeyForTable,
   getTableNames,
 } from "./config/introspection";
 import { difference, isEqual } from "./sql_functions/set-utils";
+import { addSchemaUpgrades } from "./sql_functions/schema-upgrades";
+import { addReplicationChanges } from "./sql_functions/replication";
 const { MultiSelect, Input } = require("enquirer");
 
 export async function addTriggersForNewTables(
   sql: SQL,
   configPath: string,
-  ignoreConfig: IgnoreConfig,
+  config: AnalyticsConfig,
   autoApply: boolean = false,
   autoMigrate: boolean = false
 ) {
   const sqlBuilder = new SQLBuilder(sql);
+  const ignoreConfig = config.ignore || {};
+  const notifyChannel = config.notify_channel;
+  // Settings the triggers record in the transaction context, undefined when it isn't recorded
+  const txContextSettings = config.tx_context
+    ? [...(config.tx_context.settings || [])].sort()
+    : undefined;
+  // Replicated tables are read from the WAL by the agent and must not have triggers
+  const replicatedTables = config.replication?.tables || [];
 
   const introspectedSchema = await getIntrospectedSchema(sql);
 
+  // Bring the internal schema up to date with the tables and columns the agent expects
+  const upgradeCount = await addSchemaUpgrades(sql, sqlBuilder);
+
+  const replicationCount = config.replication
+    ? await addReplicationChanges(sql, sqlBuilder, config.replication)
+    : 0;
+
   const spinner = ora(
     "Scanning for new tables and and triggers that need to be updated..."
   ).start();
@@ -65,6 +87,13 @@ export async function addTriggersForNewTables(
           AND n.nspname = 'schema_pg_track_events';
     `;
 
+    if (replicatedTables.includes(table)) {
+      if (triggerExists.length > 0) {
+        tablesWithTriggers.push(table);
+      }
+      continue;
+    }
+
     if (triggerExists.length === 0) {
       if (!fullyIgnoredTables.includes(table)) {
         tablesWithoutTriggers.push(table);
@@ -91,10 +120,37 @@ export async function addTriggersForNewTables(
           new Set(currentIgnoredColumns)
         );
 
-        if (!isEqual(includedColumns, currentIncludedColumns)) {
+        const currentNotifyChannel =
+          extractNotifyChannelFromFunction(currentFunction);
+        const columnsChanged = !isEqual(
+          includedColumns,
+          currentIncludedColumns
+        );
+        const notifyChanged = currentNotifyChannel !== notifyChannel;
+        const primaryKey = getPrimaryKeyForTable(introspectedSchema, table);
+        const primaryKeyChanged =
+          extractPrimaryKeyFromFunction(currentFunction).join(",") !==
+          primaryKey.join(",");
+        // Triggers created before session metadata was captured
+        const metadataMissing = !capturesSessionMetadata(currentFunction);
+        const txContextChanged =
+          extractTxContextSettingsFromFunction(currentFunction)
+            ?.sort()
+            .join(",") !== txContextSettings?.join(",");
+
+        if (
+          columnsChanged ||
+          notifyChanged ||
+          primaryKeyChanged ||
+          metadataMissing ||
+          txContextChanged
+        ) {
           const [functionName, functionBody] = logChangesBuilder(
             table,
-            Array.from(includedColumns)
+            Array.from(includedColumns),
+            notifyChannel,
+            primaryKey,
+            txContextSettings
           );
 
           const removed = Array.from(
@@ -105,15 +161,23 @@ export async function addTriggersForNewTables(
           ).sort();
 
           tablesWithUpdatedTriggers.push(table);
-          sqlBuilder.add(
-            functionBody,
-            `${kleur.dim("~")} ${kleur.bold(functionName)} ${kleur.dim(
-              `function updated.${
+          const columnsDescription = columnsChanged
+            ? `${
                 removed.length ? ` Removed (-${removed.join(", ")})` : ""
               }${removed.length && added.length ? " and" : ""}${
                 added.length ? ` added (+${added.join(", ")})` : ""
               } ignored columns for`
-            )} ${kleur.bold(table)} table`
+            : " Updated for";
+          const notifyDescription = notifyChanged
+            ? notifyChannel
+              ? ` (now notifies ${notifyChannel})`
+              : " (no longer notifies)"
+            : "";
+          sqlBuilder.add(
+            functionBody,
+            `${kleur.dim("~")} ${kleur.bold(functionName)} ${kleur.dim(
+              `function updated.${columnsDescription}`
+            )} ${kleur.bold(table)} table${kleur.dim(notifyDescription)}`
           );
         }
       }
@@ -134,17 +198,46 @@ export async function addTriggersForNewTables(
     }
   }
 
+  // Remove triggers for tables that are now read from the replication slot
+  for (const table of replicatedTables) {
+    if (tablesWithTriggers.includes(table)) {
+      sqlBuilder.add(
+        `DROP TRIGGER IF EXISTS "${table}_audit_trigger" ON public."${table}";`,
+        `${kleur.dim("-")} ${kleur.bold(table + "_audit_trigger")} ${kleur.dim(
+          "will be removed from"
+        )} ${kleur.bold(table)} ${kleur.dim("table (replicated in yaml config)")}`
+      );
+      toRemoveCount++;
+    }
+  }
+
   spinner.succeed();
+  if (upgradeCount > 0) {
+    console.log(
+      kleur.dim(
+        `Found ${upgradeCount} missing schema_pg_track_events objects. Staging upgrades...`
+      )
+    );
+  }
   if (toRemoveCount > 0) {
     console.log(
       kleur.dim(
-        `Found ${toRemoveCount} ignored tables with triggers. Staging trigger deletions...`
+        `Found ${toRemoveCount} ignored or replicated tables with triggers. Staging trigger deletions...`
+      )
+    );
+  }
+  if (replicationCount > 0) {
+    console.log(
+      kleur.dim(
+        `Found ${replicationCount} replication changes. Staging publication updates...`
       )
     );
   }
 
   if (
     tablesWithoutTriggers.length === 0 &&
+    upgradeCount === 0 &&
+    replicationCount === 0 &&
     toRemoveCount === 0 &&
     tablesWithUpdatedTriggers.length === 0
   ) {
@@ -198,7 +291,10 @@ export async function addTriggersForNewTables(
 
     const [functionName, functionBody] = logChangesBuilder(
       table,
-      Array.from(includedColumns)
+      Array.from(includedColumns),
+      notifyChannel,
+      getPrimaryKeyForTable(introspectedSchema, table),
+      txContextSettings
     );
 
     sqlBuilder.add(
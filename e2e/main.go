@@ -149,7 +149,12 @@ func runScenario(ctx context.Context, pool *pgxpool.Pool, scenario Scenario) err
 	go func() {
 		defer close(agentDone)
 
-		eventAgent, err := agent.NewAgent(ctx, pool, agent.WithE2EDBEventChan(dbEventChan), agent.WithE2EProcessedEventChan(processedEventChan))
+		cfg, err := agent.LoadAgentConfig(agent.WithConfigPath(scenario.ConfigPath), agent.WithDatabaseURL(dbURL))
+		if err != nil {
+			log.Fatalf("load agent config: %v", err)
+		}
+
+		eventAgent, err := agent.NewAgent(ctx, pool, cfg, agent.WithE2EDBEventChan(dbEventChan), agent.WithE2EProcessedEventChan(processedEventChan))
 		if err != nil {
 			log.Fatalf("initialize agent: %v", err)
 		}